@@ -33,7 +33,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	_ "github.com/rclone/rclone/backend/drive"
 	_ "github.com/rclone/rclone/backend/local"
-	_ "github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs"
 	_ "github.com/rclone/rclone/fs/config"
 	_ "github.com/rclone/rclone/fs/sync"
 	"golang.org/x/time/rate"
@@ -43,8 +43,10 @@ import (
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -178,8 +180,45 @@ type ProvisionController struct {
 
 	// Map UID -> *PVC with all claims that may be provisioned in the background.
 	claimsInProgress sync.Map
+	// Map UID -> *dataSourceCopy with all claims whose data source is being
+	// copied into their new volume.
+	dataSourceCopies sync.Map
+	// Set of the names of the volumes being replaced by their promoted
+	// volume, see replaceVolume.
+	promotions sync.Map
 
 	volumeStore VolumeStore
+
+	// The replication jobs of all volumes of this controller.
+	syncManager *SyncManager
+	// How long replication passes in flight may take to finish when the
+	// controller stops.
+	syncDrainTimeout time.Duration
+	// The most replication passes running at once, in total and per remote.
+	maxSyncs          int
+	maxSyncsPerRemote int
+
+	// The client RaidVolumes are written with, nil if they are not written.
+	raidVolumeClient dynamic.Interface
+	raidVolumes      *raidVolumeWriter
+
+	// The client VolumeSnapshots are taken with, nil if they are not taken.
+	snapshotClient dynamic.Interface
+	snapshots      *snapshotter
+
+	// How often the remotes are probed, 0 if they are not. The number of
+	// probes failing or succeeding in a row after which a remote turns
+	// unhealthy or healthy again.
+	remoteProbeInterval    time.Duration
+	remoteFailureThreshold int
+	remoteSuccessThreshold int
+	// The path of the remote health endpoint on the metrics server.
+	remoteHealthPath string
+	remoteHealth     *remoteHealthMonitor
+
+	// loops tracks the loops started by Run: the sync manager and those of
+	// raidVolumes, snapshots and remoteHealth.
+	loops sync.WaitGroup
 }
 
 const (
@@ -213,6 +252,8 @@ const (
 	DefaultMetricsPath = "/metrics"
 	// DefaultAddFinalizer is used when option function AddFinalizer is omitted
 	DefaultAddFinalizer = false
+	// DefaultSyncDrainTimeout is used when option function SyncDrainTimeout is omitted
+	DefaultSyncDrainTimeout = 30 * time.Second
 )
 
 var errRuntime = fmt.Errorf("cannot call option functions after controller has Run")
@@ -600,6 +641,150 @@ func DeletionTimeout(timeout time.Duration) func(*ProvisionController) error {
 	}
 }
 
+// SyncManager returns the manager of the replication jobs of this controller.
+func (ctrl *ProvisionController) SyncManager() *SyncManager {
+	return ctrl.syncManager
+}
+
+// SyncDrainTimeout sets how long replication passes in flight may take to
+// finish once the context passed to Run is done. Transfers still running
+// afterwards are cancelled. Defaults to 30 seconds.
+func SyncDrainTimeout(timeout time.Duration) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		c.syncDrainTimeout = timeout
+		return nil
+	}
+}
+
+// RaidVolumeClient sets the client the RaidVolume resources showing the
+// replication of the volumes are written with. The RaidVolume
+// CustomResourceDefinition must be installed. Default: nil, no RaidVolumes
+// are written.
+func RaidVolumeClient(client dynamic.Interface) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		c.raidVolumeClient = client
+		return nil
+	}
+}
+
+// SnapshotClient sets the client the VolumeSnapshots of the claims of the
+// provisioner are taken with: those whose VolumeSnapshotClass names the
+// provisioner as driver. The snapshot CustomResourceDefinitions must be
+// installed. Default: nil, no snapshots are taken.
+func SnapshotClient(client dynamic.Interface) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		c.snapshotClient = client
+		return nil
+	}
+}
+
+// MaxConcurrentSyncs is the most replication passes running at once. Passes
+// that are due wait in a queue. 0 means no limit. Default:
+// DefaultMaxConcurrentSyncs.
+func MaxConcurrentSyncs(maxSyncs int) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		if maxSyncs < 0 {
+			return fmt.Errorf("invalid maximum of concurrent syncs %d", maxSyncs)
+		}
+		c.maxSyncs = maxSyncs
+		return nil
+	}
+}
+
+// MaxConcurrentSyncsPerRemote is the most replication passes replicating to
+// the same target rclone remote at once. The source is not counted, the
+// passes reading from it are bounded by MaxConcurrentSyncs only. 0 means no
+// limit. Default: DefaultMaxConcurrentSyncsPerRemote.
+func MaxConcurrentSyncsPerRemote(maxSyncs int) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		if maxSyncs < 0 {
+			return fmt.Errorf("invalid maximum of concurrent syncs per remote %d", maxSyncs)
+		}
+		c.maxSyncsPerRemote = maxSyncs
+		return nil
+	}
+}
+
+// BandwidthLimit caps the rate at which all volumes together are replicated,
+// as a size per second such as "10M" or a timetable by time of day such as
+// "08:00,512k 19:00,off". The bandwidth is shared between the volumes by
+// their bandwidthPriority StorageClass parameter. Default: "off", no limit.
+func BandwidthLimit(limit string) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		timetable, err := parseBandwidth(limit)
+		if err != nil {
+			return fmt.Errorf("invalid bandwidth limit %q: %v", limit, err)
+		}
+		c.syncManager.SetBandwidthLimit(timetable)
+		return nil
+	}
+}
+
+// RemoteProbeInterval sets how often the rclone remotes used as sources or
+// targets are probed by listing their root and writing, reading and deleting
+// a canary object. The volumes stored on unhealthy remotes are degraded. 0
+// disables the probes. Default: DefaultRemoteProbeInterval.
+func RemoteProbeInterval(interval time.Duration) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		if interval < 0 {
+			return fmt.Errorf("invalid remote probe interval %v", interval)
+		}
+		c.remoteProbeInterval = interval
+		return nil
+	}
+}
+
+// RemoteHealthThresholds sets the number of probes of a remote failing in a
+// row after which it is unhealthy and the number of probes succeeding in a
+// row after which it is healthy again. Defaults:
+// DefaultRemoteFailureThreshold and DefaultRemoteSuccessThreshold.
+func RemoteHealthThresholds(failures, successes int) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		if failures < 1 || successes < 1 {
+			return fmt.Errorf("invalid remote health thresholds %d and %d", failures, successes)
+		}
+		c.remoteFailureThreshold = failures
+		c.remoteSuccessThreshold = successes
+		return nil
+	}
+}
+
+// RemoteHealthPath sets the path the health of the remotes is served on as
+// JSON by the metrics server. Default: DefaultRemoteHealthPath.
+func RemoteHealthPath(path string) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		c.remoteHealthPath = path
+		return nil
+	}
+}
+
 // HasRun returns whether the controller has Run
 func (ctrl *ProvisionController) HasRun() bool {
 	ctrl.hasRunLock.Lock()
@@ -653,6 +838,14 @@ func NewProvisionController(
 		addFinalizer:              DefaultAddFinalizer,
 		hasRun:                    false,
 		hasRunLock:                &sync.Mutex{},
+		syncManager:               NewSyncManager(id, eventRecorder),
+		syncDrainTimeout:          DefaultSyncDrainTimeout,
+		maxSyncs:                  DefaultMaxConcurrentSyncs,
+		maxSyncsPerRemote:         DefaultMaxConcurrentSyncsPerRemote,
+		remoteProbeInterval:       DefaultRemoteProbeInterval,
+		remoteFailureThreshold:    DefaultRemoteFailureThreshold,
+		remoteSuccessThreshold:    DefaultRemoteSuccessThreshold,
+		remoteHealthPath:          DefaultRemoteHealthPath,
 	}
 
 	for _, option := range options {
@@ -662,6 +855,25 @@ func NewProvisionController(
 		}
 	}
 
+	controller.syncManager.SetConcurrency(controller.maxSyncs, controller.maxSyncsPerRemote)
+	controller.syncManager.SetFailoverHandler(controller.failover)
+	controller.syncManager.SetSecretReader(controller.readSecret)
+	if controller.remoteProbeInterval > 0 {
+		controller.remoteHealth = newRemoteHealthMonitor(controller.remoteProbeInterval,
+			controller.remoteFailureThreshold, controller.remoteSuccessThreshold, controller.probedRemotes,
+			controller.syncManager.remoteHealthChanged)
+		controller.syncManager.SetRemoteHealth(controller.remoteHealth.healthy)
+	}
+
+	if controller.raidVolumeClient != nil {
+		controller.raidVolumes = newRaidVolumeWriter(controller.raidVolumeClient)
+		controller.syncManager.SetStatusHandler(controller.raidVolumes.update)
+	}
+	if controller.snapshotClient != nil {
+		controller.snapshots = newSnapshotter(controller.snapshotClient, controller.client, controller.provisionerName,
+			controller.syncManager, controller.volumeTargets, controller.eventRecorder)
+	}
+
 	var rateLimiter workqueue.RateLimiter
 	if controller.rateLimiter != nil {
 		// rateLimiter set via parameter takes precedence
@@ -829,6 +1041,12 @@ func (ctrl *ProvisionController) forgetVolume(obj interface{}) {
 func (ctrl *ProvisionController) Run(ctx context.Context) {
 	run := func(ctx context.Context) {
 		klog.Infof("Starting csi-raid provisioner controller %s!", ctrl.component)
+		// Replication stops with ctx.
+		ctrl.loops.Add(1)
+		go func() {
+			defer ctrl.loops.Done()
+			ctrl.syncManager.Run(ctx, ctrl.syncDrainTimeout)
+		}()
 
 		//kubernetes clientset = ctrl.client
 		//ctrl.client.AppsV1beta1().RESTClient().Get().Resource("storageclass")
@@ -861,7 +1079,7 @@ func (ctrl *ProvisionController) Run(ctx context.Context) {
 			//fmt.Printf("storageClass: %d provisioner: %s storageClass: %s \n", index, storageClass.Provisioner, storageClass.ObjectMeta.Name )
 			if ctrl.provisionerName == storageClass.Provisioner {
 				//storageClass for the actual provisioner
-				persistentVolumeList, err := ctrl.client.CoreV1().PersistentVolumes().List(context.TODO(), metav1.ListOptions{})
+				persistentVolumeList, err := ctrl.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
 				if err != nil {
 					panic(err.Error())
 				}
@@ -875,18 +1093,18 @@ func (ctrl *ProvisionController) Run(ctx context.Context) {
 							Active = ctrl.provisioner.GetActive()
 							fmt.Printf("start sync - persistentVolume: %d path: %s\n", index, persistentVolume.Spec.NFS.Path)
 							//now we should start sync - persistentVolume: 5 path: /mnt/optimal/nfs-provisioner/default-test-csi-claim-pvc-3913b8ca-d2f1-472a-8082-16b6e4d5b175
-							go CSIsyncVolume(ctx, Source, Target, persistentVolume.Spec.NFS.Path, Active)
+							ctrl.startClassVolumeSync(ctx, &persistentVolume, &storageClass)
 						}
 					}
 				}
 			}
 		}
-		pods, err := ctrl.client.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
+		pods, err := ctrl.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
 		if err != nil {
 			panic(err.Error())
 		}
 		klog.Infof("csi-raid provisioner: There are %d pods in the cluster\n", len(pods.Items))
-		pvs, err := ctrl.client.CoreV1().PersistentVolumes().List(context.TODO(), metav1.ListOptions{})
+		pvs, err := ctrl.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
 		klog.Infof("csi-raid provisioner: There are %d persistentVolumes in the cluster\n", len(pvs.Items))
 
 
@@ -894,7 +1112,7 @@ func (ctrl *ProvisionController) Run(ctx context.Context) {
 		Target = ctrl.provisioner.GetTarget()
 		Active = ctrl.provisioner.GetActive()
 		//remotePath = ctrl.provisioner.GetRemote()
-		klog.Infof("csi-raid provisioner Source: %s Target: %s Active: %b", Source, Target, Active)
+		klog.Infof("csi-raid provisioner Source: %s Target: %s Active: %t", Source, Target, Active)
 		defer utilruntime.HandleCrash()
 		defer ctrl.claimQueue.ShutDown()
 		defer ctrl.volumeQueue.ShutDown()
@@ -911,15 +1129,25 @@ func (ctrl *ProvisionController) Run(ctx context.Context) {
 				metrics.PersistentVolumeDeleteFailedTotal,
 				metrics.PersistentVolumeDeleteDurationSeconds,
 			}...)
+			prometheus.MustRegister(SM.Collectors()...)
+			prometheus.MustRegister(ctrl.syncManager.LagCollector())
 			http.Handle(ctrl.metricsPath, promhttp.Handler())
+			if ctrl.remoteHealth != nil {
+				http.Handle(ctrl.remoteHealthPath, ctrl.remoteHealth)
+			}
 			address := net.JoinHostPort(ctrl.metricsAddress, strconv.FormatInt(int64(ctrl.metricsPort), 10))
 			klog.Infof("Starting metrics server at %s\n", address)
-			go wait.Forever(func() {
-				err := http.ListenAndServe(address, nil)
-				if err != nil {
+			server := &http.Server{Addr: address}
+			go wait.Until(func() {
+				err := server.ListenAndServe()
+				if err != nil && err != http.ErrServerClosed {
 					klog.Errorf("Failed to listen on %s: %v", address, err)
 				}
-			}, 5*time.Second)
+			}, 5*time.Second, ctx.Done())
+			go func() {
+				<-ctx.Done()
+				server.Close()
+			}()
 		}
 
 		// If a external SharedInformer has been passed in, this controller
@@ -942,10 +1170,19 @@ func (ctrl *ProvisionController) Run(ctx context.Context) {
 			go wait.Until(func() { ctrl.runClaimWorker(ctx) }, time.Second, ctx.Done())
 			go wait.Until(func() { ctrl.runVolumeWorker(ctx) }, time.Second, ctx.Done())
 		}
+		for _, loop := range []func(context.Context){ctrl.raidVolumes.run, ctrl.snapshots.run, ctrl.remoteHealth.run} {
+			loop := loop
+			ctrl.loops.Add(1)
+			go func() {
+				defer ctrl.loops.Done()
+				loop(ctx)
+			}()
+		}
 
 		klog.Infof("Started provisioner controller %s!", ctrl.component)
 
-		select {}
+		<-ctx.Done()
+		klog.Infof("Stopping provisioner controller %s!", ctrl.component)
 	}
 
 	go ctrl.volumeStore.Run(ctx, DefaultThreadiness)
@@ -965,23 +1202,39 @@ func (ctrl *ProvisionController) Run(ctx context.Context) {
 		}
 
 		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
-			Lock:          rl,
-			LeaseDuration: ctrl.leaseDuration,
-			RenewDeadline: ctrl.renewDeadline,
-			RetryPeriod:   ctrl.retryPeriod,
+			Lock:            rl,
+			LeaseDuration:   ctrl.leaseDuration,
+			RenewDeadline:   ctrl.renewDeadline,
+			RetryPeriod:     ctrl.retryPeriod,
+			ReleaseOnCancel: true,
 			Callbacks: leaderelection.LeaderCallbacks{
 				OnStartedLeading: run,
 				OnStoppedLeading: func() {
-					klog.Fatalf("leaderelection lost")
+					if ctx.Err() == nil {
+						klog.Fatalf("leaderelection lost")
+					}
+					// Stopped on purpose: wait for replication to drain
+					// before returning.
+					ctrl.shutdown()
 				},
 			},
 		})
-		panic("unreachable")
 	} else {
 		run(ctx)
+		// Replication started by this controller is drained before Run
+		// returns.
+		ctrl.shutdown()
 	}
 }
 
+// shutdown waits for the loops started by run, which stop with its context,
+// the sync manager draining the replication of the volumes. The manager is
+// shut down as well if run did not get to start it.
+func (ctrl *ProvisionController) shutdown() {
+	ctrl.loops.Wait()
+	ctrl.syncManager.Shutdown(ctrl.syncDrainTimeout)
+}
+
 func (ctrl *ProvisionController) runClaimWorker(ctx context.Context) {
 	for ctrl.processNextClaimWorkItem(ctx) {
 	}
@@ -1175,7 +1428,50 @@ func (ctrl *ProvisionController) syncClaim(ctx context.Context, obj interface{})
 		}
 		return err
 	}
-	return nil
+	ctrl.acknowledgeDeletion(claim)
+	ctrl.resolveSplitBrain(ctx, claim)
+	return ctrl.createPromotedVolume(ctx, claim)
+}
+
+// acknowledgeDeletion lets the replicas of the volume of claim that are
+// frozen by the deletion brake proceed if the claim acknowledges their
+// deletion.
+func (ctrl *ProvisionController) acknowledgeDeletion(claim *v1.PersistentVolumeClaim) {
+	token, ok := claim.Annotations[annDeletionAcknowledged]
+	if !ok || claim.Spec.VolumeName == "" {
+		return
+	}
+	// The replicas record an event on the claim when they proceed. Volumes
+	// that are not replicated by this controller have nothing to release.
+	ctrl.syncManager.AcknowledgeDeletion(claim.Spec.VolumeName, token)
+}
+
+// resolveSplitBrain lets the replicas of the volume of claim that are fenced
+// after a split brain proceed if the claim names the copy to keep and the
+// token of the split brain. The annotation is removed once applied, so that
+// it does not resolve a later split brain.
+func (ctrl *ProvisionController) resolveSplitBrain(ctx context.Context, claim *v1.PersistentVolumeClaim) {
+	value, ok := claim.Annotations[annSplitBrainWinner]
+	if !ok || claim.Spec.VolumeName == "" {
+		return
+	}
+	winner, token := parseSplitBrainWinner(value)
+	if released, _ := ctrl.syncManager.ResolveSplitBrain(claim.Spec.VolumeName, winner, token); !released {
+		return
+	}
+
+	// The claim from method args can be pointing to watcher cache. We must not
+	// modify these, therefore create a copy.
+	newClaim := claim.DeepCopy()
+	delete(newClaim.Annotations, annSplitBrainWinner)
+	if _, err := ctrl.client.CoreV1().PersistentVolumeClaims(newClaim.Namespace).Update(ctx, newClaim, metav1.UpdateOptions{}); err != nil {
+		klog.Errorf("Failed to remove annotation %s of PersistentVolumeClaim %q: %v", annSplitBrainWinner, claimToClaimKey(newClaim), err)
+		return
+	}
+	// Save updated claim into informer cache to avoid applying it again.
+	if err := ctrl.claimInformer.GetStore().Update(newClaim); err != nil {
+		klog.Warningf("update claim informer cache for PersistentVolumeClaim %q: %v", claimToClaimKey(newClaim), err)
+	}
 }
 
 // syncVolume checks if the volume should be deleted and deletes if so
@@ -1191,7 +1487,7 @@ func (ctrl *ProvisionController) syncVolume(ctx context.Context, obj interface{}
 		ctrl.updateDeleteStats(volume, err, startTime)
 		return err
 	}
-	return nil
+	return ctrl.promoteRequested(ctx, volume)
 }
 
 // knownProvisioner checks if provisioner name has been
@@ -1426,6 +1722,17 @@ func (ctrl *ProvisionController) provisionClaimOperation(ctx context.Context, cl
 		}
 	}
 
+	// Resolve the data source before provisioning, a volume is not
+	// provisioned for a claim whose data source is missing.
+	var dataSource fs.Fs
+	if claim.Spec.DataSource != nil {
+		if dataSource, err = ctrl.dataSourceFs(ctx, claim); err != nil {
+			ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", err.Error())
+			klog.Error(logOperation(operation, "failed to provision volume: %v", err))
+			return ProvisioningFinished, err
+		}
+	}
+
 	options := ProvisionOptions{
 		StorageClass: class,
 		PVName:       pvName,
@@ -1487,12 +1794,36 @@ func (ctrl *ProvisionController) provisionClaimOperation(ctx context.Context, cl
 	metav1.SetMetaDataAnnotation(&volume.ObjectMeta, annDynamicallyProvisioned, class.Provisioner)
 	volume.Spec.StorageClassName = claimClass
 
+	// The volume is stored once its data source has been copied.
+	if dataSource != nil {
+		if result, err := ctrl.populateVolume(ctx, claim, volume, dataSource); err != nil {
+			if result != ProvisioningInBackground {
+				ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", err.Error())
+			}
+			klog.Info(logOperation(operation, "%v", err))
+			return result, err
+		}
+	}
+
 	klog.Info(logOperation(operation, "succeeded"))
-	go CSIsyncNew(ctx, Source, Target, pvName, claim.Namespace ,claim.Name, Active)
 
 	if err := ctrl.volumeStore.StoreVolume(claim, volume); err != nil {
 		return ProvisioningFinished, err
 	}
+	ctrl.startSync(SyncJobSpec{
+		VolumeName:     pvName,
+		Source:         Source,
+		Target:         Target,
+		Directory:      pvName,
+		ClaimNamespace: claim.Namespace,
+		ClaimName:      claim.Name,
+		ClaimUID:       claim.UID,
+		StorageClass:   claimClass,
+		New:            true,
+	}, class.Parameters, claim.Annotations)
+	if status, err := ctrl.syncManager.Status(pvName); err == nil {
+		ctrl.raidVolumes.create(ctx, status)
+	}
 	if err = ctrl.volumes.Add(volume); err != nil {
 		utilruntime.HandleError(err)
 	}
@@ -1520,7 +1851,29 @@ func (ctrl *ProvisionController) deleteVolumeOperation(ctx context.Context, volu
 	}
 
 	klog.Info(logOperation(operation, "volume deleted"))
-	go CSIdelete(ctx, Source, Target, volume)
+	source, targets := ctrl.volumeRoles(volume)
+	// The replicas must not be written to while they are purged.
+	if err = ctrl.syncManager.Stop(volume.Name); err != nil && err != ErrSyncJobNotFound {
+		klog.Info(logOperation(operation, "failed to stop replication: %v", err))
+	}
+	ctrl.raidVolumes.delete(ctx, volume.Name)
+	ctrl.syncManager.goBackground(func(ctx context.Context) {
+		for _, target := range targets {
+			CSIdelete(ctx, source, target, volume)
+		}
+		if source != Source {
+			// The provisioner deleted the volume on its own source only,
+			// the primary copy of a promoted volume is on another remote.
+			CSIdelete(ctx, Source, source, volume)
+		} else if Source != "" && volume.Spec.NFS != nil {
+			// The provisioner leaves the anchor of the volume.
+			if f, err := newFsDirFromVolume(ctx, Source, volume.Spec.NFS.Path); err == nil {
+				if err := removeVolumeAnchor(ctx, f); err != nil {
+					klog.Infof("Failed to delete the anchor of %s: %v", f, err)
+				}
+			}
+		}
+	})
 
 	// Delete the volume
 	if err = ctrl.client.CoreV1().PersistentVolumes().Delete(ctx, volume.Name, metav1.DeleteOptions{}); err != nil {
@@ -1579,6 +1932,82 @@ func (ctrl *ProvisionController) deleteVolumeOperation(ctx context.Context, volu
 	return nil
 }
 
+// startSync hands the replication of a volume over to the sync manager if
+// replication is active. The replication is configured by the parameters of
+// the StorageClass of the volume, some of which can be overridden by the
+// annotations of its claim. Errors are logged and returned.
+func (ctrl *ProvisionController) startSync(spec SyncJobSpec, parameters, annotations map[string]string) error {
+	if !Active {
+		return nil
+	}
+	// The targets of a promoted volume are recorded on it.
+	promotedTargets := spec.Targets
+	spec.Targets = ctrl.provisionerTargets()
+	err := applySyncParameters(&spec, parameters)
+	if err == nil {
+		err = applyClaimAnnotations(&spec, annotations)
+	}
+	if err == nil {
+		if len(promotedTargets) > 0 {
+			spec.Targets = promotedTargets
+		}
+		err = ctrl.syncManager.Start(spec)
+	}
+	if err != nil {
+		klog.Errorf("Failed to start replication of volume %q: %v", spec.VolumeName, err)
+	}
+	return err
+}
+
+// provisionerTargets returns the remotes the provisioner replicates volumes
+// to unless their StorageClass says otherwise.
+func (ctrl *ProvisionController) provisionerTargets() []string {
+	if p, ok := ctrl.provisioner.(MultiTargetProvisioner); ok {
+		return p.GetTargets()
+	}
+	return []string{ctrl.provisioner.GetTarget()}
+}
+
+// probedRemotes returns the remotes whose health is probed: the sources and
+// targets of the replicated volumes and the remotes new volumes of the
+// provisioner and its StorageClasses are stored on.
+func (ctrl *ProvisionController) probedRemotes() []string {
+	remotes := sets.NewString(ctrl.syncManager.remotes()...)
+	if !ctrl.provisioner.GetActive() {
+		return remotes.List()
+	}
+	remotes.Insert(ctrl.provisioner.GetSource())
+	remotes.Insert(ctrl.provisionerTargets()...)
+	for _, name := range ctrl.classes.ListKeys() {
+		class, err := ctrl.getStorageClass(name)
+		if err != nil || !ctrl.knownProvisioner(class.Provisioner) {
+			continue
+		}
+		if targets, ok := class.Parameters[paramTargets]; ok {
+			remotes.Insert(parseTargets(targets)...)
+		}
+	}
+	return remotes.List()
+}
+
+// volumeTargets returns the remotes holding a replica of volume: the targets
+// of its replication if it is running, otherwise the targets recorded on a
+// promoted volume or configured for its StorageClass.
+func (ctrl *ProvisionController) volumeTargets(volume *v1.PersistentVolume) []string {
+	if status, err := ctrl.syncManager.Status(volume.Name); err == nil {
+		return status.Targets
+	}
+	if targets, ok := volume.Annotations[annTargets]; ok {
+		return parseTargets(targets)
+	}
+	if class, err := ctrl.getStorageClass(volume.Spec.StorageClassName); err == nil {
+		if targets, ok := class.Parameters[paramTargets]; ok {
+			return parseTargets(targets)
+		}
+	}
+	return ctrl.provisionerTargets()
+}
+
 func logOperation(operation, format string, a ...interface{}) string {
 	return fmt.Sprintf(fmt.Sprintf("%s: %s", operation, format), a...)
 }
@@ -240,8 +240,18 @@ func TestController(t *testing.T) {
 				ctrl.enqueueClaim(test.enqueueClaim)
 			}
 
-			// Run forever...
-			go ctrl.Run(context.Background())
+			// Run until the test case is done, which waits for the
+			// controller to stop.
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan struct{})
+			go func() {
+				ctrl.Run(ctx)
+				close(stopped)
+			}()
+			defer func() {
+				cancel()
+				<-stopped
+			}()
 
 			// When we shutdown while something is happening the fake client panics
 			// with send on closed channel...but the test passed, so ignore
@@ -22,6 +22,7 @@ import (
 	"github.com/rclone/rclone/fs/fspath"
 	"log"
 	"path"
+	gosync "sync"
 	"time"
 
 	_ "github.com/rclone/rclone/backend/azureblob"
@@ -31,137 +32,330 @@ import (
 	"github.com/rclone/rclone/fs"
 	"github.com/rclone/rclone/fs/config"
 	"github.com/rclone/rclone/fs/config/configfile"
+	"github.com/rclone/rclone/fs/filter"
 )
 
+// rcloneConfigPath is the rclone config file defining the remotes.
+var rcloneConfigPath = "/csiraid.config"
+
+var rcloneConfigOnce gosync.Once
+
+// loadRcloneConfig makes rclone read its remotes from rcloneConfigPath. The
+// file is loaded once and reloaded by rclone whenever it changes.
+func loadRcloneConfig() {
+	rcloneConfigOnce.Do(func() {
+		configfile.Install()
+		config.SetConfigPath(rcloneConfigPath)
+		if err := config.Data().Load(); err != nil {
+			klog.Warningf("Failed to load rclone config %s: %v", rcloneConfigPath, err)
+		}
+	})
+}
+
+// CSIsyncNew replicates a newly provisioned volume until ctx is done. The
+// controller runs replication through its SyncManager, this is kept for
+// callers that drive a single volume themselves.
 func CSIsyncNew(ctx context.Context, source string, target string, directory string, namespace string, name string, active bool) {
-	fmt.Printf("csisync called source: %s, target: %s, directory: %s \n", source, target, directory)
+	klog.V(4).Infof("csisync called source: %s, target: %s, directory: %s", source, target, directory)
 
-	if len(source) == 0 {
+	if !active {
 		return
 	}
-	if len(target) == 0 {
+	job, err := newSyncJob(ctx, SyncJobSpec{
+		VolumeName:     directory,
+		Source:         source,
+		Target:         target,
+		Directory:      directory,
+		ClaimNamespace: namespace,
+		ClaimName:      name,
+		New:            true,
+	})
+	if err != nil {
+		klog.Info(err)
 		return
 	}
-
-	var fsrc fs.Fs
-	var fdst fs.Fs
-
-	configfile.Install()
-	config.SetConfigPath("/csiraid.config")
-
-	//fsrc, _ = NewFsFile(sourceDir)
-	//fmt.Printf("NewFsFile - f: %s \n", fsrc)
-
-	fsrc = newFsDir(ctx, source, directory, namespace, name)
-	fdst = newFsDir(ctx, target, directory, namespace, name)
-
-	fmt.Printf("fsrc: %s \n", fsrc)
-	fmt.Printf("fdst: %s \n", fdst)
-	//entries, err := fsrc.List(context.Background(), "")
-	//if err != nil {
-	//	log.Fatal(err)
-	//}
-	//fmt.Printf("source entries: %s", entries)
-	//entries, err = fdst.List(context.Background(), "")
-	//if err != nil {
-	//	log.Fatal(err)
-	//}
-	//fmt.Printf("target entries: %s", entries)
-	csisync(ctx, fsrc, fdst, true, active)
+	csisync(ctx, job)
 }
 
+// CSIsyncVolume replicates an existing volume until ctx is done. The
+// controller runs replication through its SyncManager, this is kept for
+// callers that drive a single volume themselves.
 func CSIsyncVolume(ctx context.Context, source string, target string, directory string, active bool) {
-	fmt.Printf("csisync called source: %s, target: %s, directory: %s \n", source, target, directory)
+	klog.V(4).Infof("csisync called source: %s, target: %s, directory: %s", source, target, directory)
 
-	if len(source) == 0 {
+	if !active {
 		return
 	}
-	if len(target) == 0 {
+	job, err := newSyncJob(ctx, SyncJobSpec{
+		VolumeName: directory,
+		Source:     source,
+		Target:     target,
+		Directory:  directory,
+	})
+	if err != nil {
+		klog.Info(err)
 		return
 	}
+	csisync(ctx, job)
+}
 
-	var fsrc fs.Fs
-	var fdst fs.Fs
-
-	configfile.Install()
-	config.SetConfigPath("/csiraid.config")
-
-	//fsrc, _ = NewFsFile(sourceDir)
-	//fmt.Printf("NewFsFile - f: %s \n", fsrc)
+// csisync replicates the volume of job until ctx is done or the volume is
+// gone from both remotes. A pass in flight is not interrupted by ctx, its
+// rclone calls are bound to the transfer context of the job.
+//
+// In poll mode both remotes are compared after every sync interval, which
+// backs off between MinSyncInterval and MaxSyncInterval while the volume
+// does not change. In notify mode the changed directories are replicated as
+// the source reports them, with a full pass on start and every
+// NotifyResyncInterval.
+func csisync(ctx context.Context, job *syncJob) {
+	interval := job.spec.MinSyncInterval
+	var changes <-chan []string
+	if job.spec.Mode == SyncModeNotify {
+		if watcher := newChangeWatcher(ctx, job.fsrc, job.spec.NotifyDebounce); watcher != nil {
+			changes = watcher.batches
+			interval = job.spec.NotifyResyncInterval
+			if job.getState() != SyncJobPaused && job.scheduled(ctx, job.syncPass) {
+				return
+			}
+		} else {
+			klog.Infof("Volume %q: %s does not report changes, polling", job.spec.VolumeName, job.fsrc)
+		}
+	}
 
-	fsrc = newFsDirFromVolume(ctx, source, directory)
-	fdst = newFsDirFromVolume(ctx, target, directory)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		job.setInterval(interval)
+		select {
+		case <-ctx.Done():
+			klog.V(4).Infof("Volume %q: replication to %s cancelled", job.spec.VolumeName, job.fdst)
+			return
+		case dirs := <-changes:
+			if job.getState() == SyncJobPaused {
+				continue
+			}
+			if job.scheduled(ctx, func() bool { return job.syncDirs(dirs) }) {
+				return
+			}
+			job.replicas.checkHealth(job)
+			job.replicas.reportStatus()
+		case <-timer.C:
+			if job.getState() != SyncJobPaused {
+				if job.scheduled(ctx, job.syncPass) {
+					return
+				}
+				job.replicas.checkHealth(job)
+				job.replicas.reportStatus()
+				if changes == nil {
+					next := nextSyncInterval(job.spec, interval, job.lastChanges > 0)
+					if next != interval {
+						klog.V(4).Infof("Volume %q: %d changes, next pass in %v", job.spec.VolumeName, job.lastChanges, next)
+					}
+					interval = next
+				}
+			}
+			timer.Reset(interval)
+		}
+	}
+}
 
-	fmt.Printf("fsrc: %s \n", fsrc)
-	fmt.Printf("fdst: %s \n", fdst)
-	//entries, err := fsrc.List(context.Background(), "")
-	//if err != nil {
-	//	log.Fatal(err)
-	//}
-	//fmt.Printf("source entries: %s", entries)
-	//entries, err = fdst.List(context.Background(), "")
-	//if err != nil {
-	//	log.Fatal(err)
-	//}
-	//fmt.Printf("target entries: %s", entries)
-	csisync(ctx, fsrc, fdst, false, active)
+// scheduled runs pass once the scheduler of the job lets it and no other
+// pass of the job runs, returning its result. Returns false without running
+// pass if ctx is done first.
+func (j *syncJob) scheduled(ctx context.Context, pass func() bool) bool {
+	if j.scheduler != nil {
+		release, err := j.scheduler.acquire(ctx, j.targetRemotes())
+		if err != nil {
+			return false
+		}
+		defer release()
+	}
+	j.passLock.Lock()
+	defer j.passLock.Unlock()
+	return pass()
 }
 
-func csisync(ctx context.Context,	fsrc fs.Fs, fdst fs.Fs, new bool, active bool) {
+// syncPass compares both remotes, recovers the source from the target if
+// the source is a wiped replica and replicates the source to the target.
+// Returns true if the job should stop because the volume is gone from both
+// remotes.
+func (j *syncJob) syncPass() bool {
+	if j.deletionHeld() {
+		return false
+	}
+	fsrc, fdst := j.fsrc, j.fdst
+	tctx := j.beginPass()
+	defer j.endPass(tctx)
+	//the markers and the files excluded by the StorageClass or claim are
+	//not replicated, neither by recovery nor by the sync
+	fi, err := j.spec.Filter.newFilter(true)
+	if err != nil {
+		klog.Infof("Volume %q: invalid filter: %v", j.spec.VolumeName, err)
+		j.recordSync(err)
+		return false
+	}
+	fctx := filter.ReplaceConfig(tctx, fi)
+
+	klog.V(4).Infof("Volume %q: pass to %s", j.spec.VolumeName, fdst)
+	entriesSource, errs := listVolume(tctx, fsrc)
+	if errs != nil {
+		klog.Info(errs)
+		j.recordSync(errs)
+		j.sourceFailed(errs)
+		return false
+	}
+	j.sourceReached()
+	entriesDest, errd := listVolume(tctx, fdst)
+	if errd != nil {
+		klog.Info(errd)
+		j.recordSync(errd)
+		return false
+	}
+	klog.V(4).Infof("Volume %q: %d source entries, %d target entries", j.spec.VolumeName, entriesSource.Len(), entriesDest.Len())
+	//check if sync have to be stopped, the replication state keeps an
+	//emptied volume alive
+	if (entriesSource.Len() == 0 && entriesDest.Len() == 0) && !j.spec.New {
+		klog.V(4).Infof("Volume %q: source and target are empty, stopping replication to %s", j.spec.VolumeName, fdst)
+		return true
+	}
+	//check if recovery is neccesssary
+	if countVolumeEntries(fctx, entriesSource) == 0 && countVolumeEntries(fctx, entriesDest) > 0 {
+		if !j.recover(fctx) {
+			return false
+		}
+	} else {
+		j.lastDecision = ""
+	}
+	if j.spec.Direction != SyncDirectionTwoWay && !j.checkSplitBrain(fctx) {
+		return false
+	}
 
-	if !active {
-		return
+	klog.V(4).Infof("Volume %q: syncing %s to %s", j.spec.VolumeName, fsrc, fdst)
+	vctx, err1 := j.withVersions(fctx, "")
+	if err1 != nil {
+		klog.Infof("Volume %q: failed to create versions directory: %v", j.spec.VolumeName, err1)
+	} else if j.spec.Direction == SyncDirectionTwoWay {
+		// Two-way passes of the replicas change the source, one at a time.
+		unlock := j.lockSource()
+		err1 = j.syncBidirectional(vctx)
+		unlock()
+	} else if err1 = j.initialSync(vctx); err1 == nil {
+		if err1 = j.brakeMirror(vctx); err1 == nil {
+			err1 = sync.Sync(vctx, fdst, fsrc, false)
+		}
 	}
-	ticker := time.NewTicker(1 * time.Second)
-	var tickerRunning bool
-	tickerRunning = true
-	for _ = range ticker.C {
-		fmt.Printf("tock for: %s\n", fsrc)
-		entriesSource, errs := fsrc.List(context.Background(), "")
-		if errs != nil {
-			klog.Info(errs)
+	j.recordSync(err1)
+	if err1 != nil {
+		klog.Info("Failed to sync fsrc: " + fsrc.String())
+		return false
+	}
+	klog.V(4).Infof("Volume %q: synced %s to %s", j.spec.VolumeName, fsrc, fdst)
+	j.updateReplicationState(passChanges(tctx) > 0, j.spec.Direction != SyncDirectionTwoWay)
+	if f := j.erasure; f != nil && time.Since(j.lastRepair) >= erasureRepairInterval {
+		j.lastRepair = time.Now()
+		repaired, err := f.repair(j.transferCtx)
+		if err != nil {
+			klog.Infof("Volume %q: failed to repair shards: %v", j.spec.VolumeName, err)
 		}
-		entriesDest, errd := fdst.List(context.Background(), "")
-		if errd != nil {
-			klog.Info(errd)
+		if repaired > 0 {
+			j.event(v1.EventTypeNormal, "ShardsRepaired", "Rewrote the missing shards of %d files on %s", repaired, f)
 		}
-		fmt.Printf("Source entries: %s Destination entries: %s \n", entriesSource, entriesDest)
-		//check if sync have to be stopped
-		if (entriesSource.Len() == 0 && entriesDest.Len() == 0) && !new {
-			fmt.Printf("SYNCHRONISATION will be stopped\n")
-			tickerRunning = false
-			ticker.Stop()
+	}
+	if j.scrubDue() {
+		j.scrub()
+	}
+	if j.pruneDue() {
+		if _, err := j.pruneVersions(j.transferCtx); err != nil {
+			klog.Infof("Volume %q: failed to prune versions: %v", j.spec.VolumeName, err)
 		}
-		//check if recovery is neccesssary
-		if entriesSource.Len() == 0 && entriesDest.Len() > 0 {
-			fmt.Printf("RECOVERY is starting\n")
-			tickerRunning = false
-			err1 := sync.Sync(context.Background(), fsrc,fdst, false)
-			tickerRunning = true
-			if err1 != nil {
-				klog.Info("Failed to RECOVERY: " + fdst.String())
-			}
-			fmt.Printf("RECOVERY done for volume: %s \n", fdst)
+	}
+	if j.keyCheckDue() {
+		j.checkKey()
+	}
+	if j.compressionCheckDue() {
+		j.measureCompression()
+	}
+	return false
+}
+
+// listVolume lists the root of a volume. A volume directory that does not
+// exist yet is empty.
+func listVolume(ctx context.Context, f fs.Fs) (fs.DirEntries, error) {
+	entries, err := f.List(ctx, "")
+	if err == fs.ErrorDirNotFound {
+		return nil, nil
+	}
+	return entries, err
+}
+
+// syncDirs replicates the given directories of the source, relative to the
+// volume root, to the target. It runs a full pass instead if
+//   - the root changed or a directory cannot be replicated on its own, e.g.
+//     because it has been removed in the meantime,
+//   - replication is two-way: a one-way sync of a directory would revert
+//     the changes made on the target,
+//   - the directories of the target are not remotes of their own: erasure
+//     layout, encryption and compression,
+//   - the filter has patterns anchored to the volume root,
+//   - the deletion brake is on, it compares deletions with the whole volume,
+//   - the replica may have diverged from the source or
+//   - its initial sync is not complete.
+func (j *syncJob) syncDirs(dirs []string) bool {
+	if j.spec.Direction == SyncDirectionTwoWay || j.spec.Layout == LayoutErasure || j.spec.Filter.rooted() ||
+		j.spec.DeletionBrake.enabled() || j.splitBrainUnchecked() || j.initialSyncPending() || j.spec.Encryption.enabled() ||
+		j.spec.Compression.Enabled {
+		return j.syncPass()
+	}
+	for _, dir := range dirs {
+		if dir == "" {
+			return j.syncPass()
 		}
+	}
+	if err := j.syncChangedDirs(dirs); err != nil {
+		klog.Infof("Failed to sync directories of %s, syncing volume: %v", j.fsrc, err)
+		return j.syncPass()
+	}
+	return false
+}
 
-		if tickerRunning {
-			fmt.Printf("sync starting for volume: %s \n", fsrc)
-			err1 := sync.Sync(context.Background(), fdst, fsrc, false)
-			if err1 != nil {
-				klog.Info("Failed to sync fsrc: " + fsrc.String())
+// syncChangedDirs replicates each of the given directories of the source on
+// its own.
+func (j *syncJob) syncChangedDirs(dirs []string) error {
+	tctx := j.beginPass()
+	defer j.endPass(tctx)
+	fi, err := j.spec.Filter.newFilter(false)
+	if err != nil {
+		return err
+	}
+	fctx := filter.ReplaceConfig(tctx, fi)
+	for _, dir := range dirs {
+		klog.V(4).Infof("Volume %q: syncing directory %s of %s", j.spec.VolumeName, dir, j.fsrc)
+		fsrc, err := fs.NewFs(tctx, fspath.JoinRootPath(fs.ConfigString(j.fsrc), dir))
+		if err == nil {
+			var fdst fs.Fs
+			fdst, err = fs.NewFs(tctx, fspath.JoinRootPath(fs.ConfigString(j.fdst), dir))
+			var vctx context.Context
+			if err == nil {
+				vctx, err = j.withVersions(fctx, dir)
+			}
+			if err == nil {
+				err = sync.Sync(vctx, newThrottledFs(fdst, j.bandwidth), newThrottledFs(fsrc, j.bandwidth), false)
 			}
-			fmt.Printf("sync done for volume: %s \n", fsrc)
-		} else {
-			fmt.Printf("tickerRunning is false for %s \n", fsrc)
+		}
+		if err != nil {
+			return fmt.Errorf("directory %s: %v", dir, err)
 		}
 	}
+	j.recordSync(nil)
+	j.updateReplicationState(passChanges(tctx) > 0, false)
+	return nil
 }
 
-
 func CSIdelete(ctx context.Context, source string, target string, volume *v1.PersistentVolume) {
-	fmt.Printf("CSIdelete source: %s, target: %s, volume: %s \n", source, target, volume)
+	klog.V(4).Infof("CSIdelete source: %s, target: %s, volume: %s", source, target, volume.Name)
 	if volume.Spec.NFS != nil {
-		fmt.Printf("CSIdelete source: %s, target: %s, path: %s \n", source, target, volume.Spec.NFS.Path)
+		klog.V(4).Infof("CSIdelete source: %s, target: %s, path: %s", source, target, volume.Spec.NFS.Path)
 	}
 
 	if len(source) == 0 {
@@ -171,19 +365,29 @@ func CSIdelete(ctx context.Context, source string, target string, volume *v1.Per
 		return
 	}
 
-	configfile.Install()
-	config.SetConfigPath("/csiraid.config")
+	loadRcloneConfig()
 	var fsrc fs.Fs
+	var err error
 	if volume.Spec.NFS != nil {
-		fsrc = newFsDirFromVolume(ctx, target, volume.Spec.NFS.Path)
+		fsrc, err = newFsDirFromVolume(ctx, target, volume.Spec.NFS.Path)
 	} else {
-		fsrc = newFsDirFromVolume(ctx, target, volume.Name)
+		fsrc, err = newFsDirFromVolume(ctx, target, volume.Name)
 	}
-	fmt.Printf("delete fsrc: %s \n", fsrc)
-	err := operations.Purge(context.Background(), fsrc, "")
+	if err != nil {
+		klog.Infof("Failed to delete volume %q on %s: %v", volume.Name, target, err)
+		return
+	}
+	klog.V(4).Infof("Deleting %s", fsrc)
+	err = operations.Purge(ctx, fsrc, "")
 	if err != nil {
 		klog.Info("Failed to delete fsrc: " + fsrc.String())
 	}
+	if err := purgeVersions(ctx, fsrc); err != nil {
+		klog.Infof("Failed to delete the versions of %s: %v", fsrc, err)
+	}
+	if err := removeVolumeAnchor(ctx, fsrc); err != nil {
+		klog.Infof("Failed to delete the anchor of %s: %v", fsrc, err)
+	}
 }
 
 func NewFsFile(remote string) (fs.Fs, string) {
@@ -207,18 +411,15 @@ func NewFsFile(remote string) (fs.Fs, string) {
 	return nil, ""
 }
 
-func newFsDirFromVolume(ctx context.Context, remote string, directory string) fs.Fs {
-	fmt.Printf("newFsDirFromVolume remote: %s directory: %s\n", remote, directory)
-	fmt.Printf("newFsDirFromVolume - config.GetConfigPath(): %s \n", config.GetConfigPath())
-	fmt.Printf("newFsDirFromVolume - config.Data().GetSectionList(): %s \n", config.Data().GetSectionList())
+// newFsDirFromVolume returns the file system of the volume directory on
+// remote, the last element of directory in the root of the remote.
+func newFsDirFromVolume(ctx context.Context, remote string, directory string) (fs.Fs, error) {
 	path, _ := config.Data().GetValue(remote,"path")
-	fmt.Printf("newFsDirFromVolume - config.Data().GetValue(remote,\"path\"): %s \n", path)
+	klog.V(4).Infof("newFsDirFromVolume remote: %s path: %s directory: %s", remote, path, directory)
 	config.Data().GetValue(remote,"path")
 	parts := strings.Split(directory, "/")
 	var relDirectory string
 	if len(parts) >= 1 {
-		fmt.Printf("length: %d\n", len(parts))
-		fmt.Printf("last element: %s\n", parts[len(parts)-1])
 		relDirectory = parts[len(parts)-1]
 	} else {
 		relDirectory = directory
@@ -231,12 +432,12 @@ func newFsDirFromVolume(ctx context.Context, remote string, directory string) fs
 	//res, _ := config.Get("user")
 	//fmt.Printf("newFsDir - fs.ConfigFs - config: %s \n", res)
 
-	fsource, err := fs.NewFs(context.Background(), remote+":"+path+"/"+relDirectory)
+	fsource, err := fs.NewFs(ctx, remote+":"+path+"/"+relDirectory)
 	if err != nil {
 		err = fs.CountError(err)
-		fmt.Printf("fs.NewFs Failed to create file system for %q: %v \n", remote, err)
+		return nil, fmt.Errorf("failed to create file system for %q: %v", remote, err)
 	}
-	fmt.Printf("newFsDir - fsource: %s \n", fsource)
+	klog.V(4).Infof("newFsDir - fsource: %s", fsource)
 
 	//f, err := cache.Get(context.Background(), "remotetest:")
 	////f, err := cache.GetFn(nil, remote, fs.NewFs)
@@ -246,14 +447,16 @@ func newFsDirFromVolume(ctx context.Context, remote string, directory string) fs
 	//	log.Fatalf("cache.Get Failed to create file system for %q: %v", remote, err)
 	//}
 	//cache.Pin(f) // pin indefinitely since it was on the CLI
-	return fsource
+	return fsource, nil
 }
 
-func newFsDir(ctx context.Context, remote string, directory string, namespace string, name string) fs.Fs {
+// newFsDir returns the file system of the directory of a new volume on
+// remote.
+func newFsDir(ctx context.Context, remote string, directory string, namespace string, name string) (fs.Fs, error) {
 	//fmt.Printf("newFsDir - config.GetConfigPath(): %s \n", config.GetConfigPath())
 	//fmt.Printf("newFsDir - config.Data().GetSectionList(): %s \n", config.Data().GetSectionList())
 	path, _ := config.Data().GetValue(remote,"path")
-	fmt.Printf("newFsDir - config.Data().GetValue(remote,\"path\"): %s \n", path)
+	klog.V(4).Infof("newFsDir - remote: %s path: %s", remote, path)
 	//?config.Data().GetValue(remote,"path")
 	//fsInfo, configName, fsPath, config, err := fs.ConfigFs(remote)
 	//fmt.Printf("newFsDir - fs.ConfigFs - fsInfo: %s \n", fsInfo.Name)
@@ -268,12 +471,12 @@ func newFsDir(ctx context.Context, remote string, directory string, namespace st
 	} else {
 		sourcePath = remote + ":" + directory
 	}
-	fsource, err := fs.NewFs(context.Background(),sourcePath)
+	fsource, err := fs.NewFs(ctx, sourcePath)
 	if err != nil {
 		err = fs.CountError(err)
-		fmt.Printf("fs.NewFs Failed to create file system for %q: %v \n", remote, err)
+		return nil, fmt.Errorf("failed to create file system for %q: %v", remote, err)
 	}
-	fmt.Printf("newFsDir - fsource: %s \n", fsource)
+	klog.V(4).Infof("newFsDir - fsource: %s", fsource)
 
 	//f, err := cache.Get(context.Background(), "remotetest:")
 	////f, err := cache.GetFn(nil, remote, fs.NewFs)
@@ -283,5 +486,5 @@ func newFsDir(ctx context.Context, remote string, directory string, namespace st
 	//	log.Fatalf("cache.Get Failed to create file system for %q: %v", remote, err)
 	//}
 	//cache.Pin(f) // pin indefinitely since it was on the CLI
-	return fsource
+	return fsource, nil
 }
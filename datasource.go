@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	klog "k8s.io/klog/v2"
+)
+
+// dataSourceCopyWait is how long provisioning waits for the data source of a
+// claim to be copied before the copy goes on in the background.
+const dataSourceCopyWait = 10 * time.Second
+
+// dataSourceCopy is the copy of the data source of a claim into its new
+// volume.
+type dataSourceCopy struct {
+	done chan struct{}
+	// err is the result of the copy, set before done is closed.
+	err error
+}
+
+// dataSourceFs returns the file system holding the data source of claim: the
+// volume of another claim of the provisioner in the same namespace, or a
+// VolumeSnapshot of one.
+func (ctrl *ProvisionController) dataSourceFs(ctx context.Context, claim *v1.PersistentVolumeClaim) (fs.Fs, error) {
+	source := claim.Spec.DataSource
+	group := ""
+	if source.APIGroup != nil {
+		group = *source.APIGroup
+	}
+	requested := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	switch {
+	case group == "" && source.Kind == "PersistentVolumeClaim":
+		sourceClaim, err := ctrl.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, source.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("data source: %v", err)
+		}
+		if sourceClaim.Spec.VolumeName == "" {
+			return nil, fmt.Errorf("data source: claim %q is not bound", source.Name)
+		}
+		volume, err := ctrl.client.CoreV1().PersistentVolumes().Get(ctx, sourceClaim.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("data source: %v", err)
+		}
+		if !ctrl.knownProvisioner(volume.Annotations[annDynamicallyProvisioned]) || volume.Spec.NFS == nil {
+			return nil, fmt.Errorf("data source: volume %q of claim %q is not provisioned by %s", volume.Name, source.Name, ctrl.provisionerName)
+		}
+		if capacity := volume.Spec.Capacity[v1.ResourceStorage]; requested.Cmp(capacity) < 0 {
+			return nil, fmt.Errorf("data source: requested size %s is smaller than the %s of claim %q", requested.String(), capacity.String(), source.Name)
+		}
+		// A promoted or failed over volume is read from its current source.
+		loadRcloneConfig()
+		f, err := newFsDirFromVolume(ctx, volumeSource(volume), volume.Spec.NFS.Path)
+		if err != nil {
+			return nil, fmt.Errorf("data source: volume %q: %v", volume.Name, err)
+		}
+		return f, nil
+	case group == VolumeSnapshotResource.Group && source.Kind == "VolumeSnapshot":
+		if ctrl.snapshotClient == nil {
+			return nil, fmt.Errorf("data source: snapshots are not enabled")
+		}
+		snapshot, err := ctrl.snapshotClient.Resource(VolumeSnapshotResource).Namespace(claim.Namespace).Get(ctx, source.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("data source: %v", err)
+		}
+		ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+		contentName, _, _ := unstructured.NestedString(snapshot.Object, "status", "boundVolumeSnapshotContentName")
+		if !ready || contentName == "" {
+			return nil, fmt.Errorf("data source: snapshot %q is not ready", source.Name)
+		}
+		content, err := ctrl.snapshotClient.Resource(VolumeSnapshotContentResource).Get(ctx, contentName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("data source: %v", err)
+		}
+		driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver")
+		handle, _, _ := unstructured.NestedString(content.Object, "status", "snapshotHandle")
+		if !ctrl.knownProvisioner(driver) || handle == "" {
+			return nil, fmt.Errorf("data source: snapshot %q is not taken by %s", source.Name, ctrl.provisionerName)
+		}
+		size, _, _ := unstructured.NestedInt64(content.Object, "status", "restoreSize")
+		if restoreSize := resource.NewQuantity(size, resource.BinarySI); requested.Cmp(*restoreSize) < 0 {
+			return nil, fmt.Errorf("data source: requested size %s is smaller than the %s of snapshot %q", requested.String(), restoreSize.String(), source.Name)
+		}
+		f, err := newSnapshotFs(ctx, handle)
+		if err != nil {
+			return nil, fmt.Errorf("data source: %v", err)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("data source: unsupported kind %q of API group %q", source.Kind, group)
+}
+
+// populateVolume copies source, the data source of claim, into volume, its
+// new volume on the source remote. Returns ProvisioningFinished without an
+// error once the data has been copied and ProvisioningInBackground with an
+// error while the copy goes on, to be asked again.
+func (ctrl *ProvisionController) populateVolume(ctx context.Context, claim *v1.PersistentVolumeClaim, volume *v1.PersistentVolume, source fs.Fs) (ProvisioningState, error) {
+	key := string(claim.UID)
+	value, running := ctrl.dataSourceCopies.Load(key)
+	if !running {
+		loadRcloneConfig()
+		dst, err := newFsDir(ctx, Source, volume.Name, claim.Namespace, claim.Name)
+		if err != nil {
+			return ProvisioningFinished, fmt.Errorf("volume %q: %v", volume.Name, err)
+		}
+		c := &dataSourceCopy{done: make(chan struct{})}
+		started := ctrl.syncManager.goBackground(func(ctx context.Context) {
+			c.err = copyVolume(ctx, dst, source)
+			if c.err != nil {
+				// A partial copy is not left behind as the volume.
+				if err := operations.Purge(ctx, dst, ""); err != nil && err != fs.ErrorDirNotFound {
+					klog.Infof("Volume %q: failed to remove the partial copy of the data source: %v", volume.Name, err)
+				}
+			}
+			close(c.done)
+		})
+		if !started {
+			return ProvisioningNoChange, fmt.Errorf("controller is shutting down")
+		}
+		klog.Infof("Copying data source %s %q of claim %q into volume %q", claim.Spec.DataSource.Kind, claim.Spec.DataSource.Name, claimToClaimKey(claim), volume.Name)
+		ctrl.eventRecorder.Eventf(claim, v1.EventTypeNormal, "Provisioning", "Copying data source %s %q into volume %q",
+			claim.Spec.DataSource.Kind, claim.Spec.DataSource.Name, volume.Name)
+		value = c
+		ctrl.dataSourceCopies.Store(key, c)
+	}
+
+	c := value.(*dataSourceCopy)
+	select {
+	case <-c.done:
+	case <-time.After(dataSourceCopyWait):
+		return ProvisioningInBackground, fmt.Errorf("data source of claim %q is being copied", claimToClaimKey(claim))
+	}
+	ctrl.dataSourceCopies.Delete(key)
+	if c.err != nil {
+		return ProvisioningFinished, fmt.Errorf("failed to copy data source: %v", c.err)
+	}
+	return ProvisioningFinished, nil
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestPopulateVolume(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "clone", time.Now())
+	writeFile(t, filepath.Join(targetRoot, snapshotsDir, "snapcontent-1", "a"), "snapshot", time.Now())
+	writeFile(t, filepath.Join(sourceRoot, "vol-3", "a"), "stale", time.Now())
+	writeFile(t, filepath.Join(targetRoot, "vol-3", "a"), "promoted", time.Now())
+	defer func(source string) { Source = source }(Source)
+	Source = "source"
+
+	snapshotGroup := VolumeSnapshotResource.Group
+	ctrl := &ProvisionController{
+		client: fake.NewSimpleClientset(
+			&v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "claim-1"},
+				Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-1"},
+			},
+			&v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv-1", Annotations: map[string]string{annDynamicallyProvisioned: "csiraid.io/test"}},
+				Spec: v1.PersistentVolumeSpec{
+					Capacity:               v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+					PersistentVolumeSource: v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Path: "/export/vol-1"}},
+				},
+			},
+			&v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "claim-3"},
+				Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-3"},
+			},
+			&v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv-3", Annotations: map[string]string{
+					annDynamicallyProvisioned: "csiraid.io/test",
+					annSource:                 "target",
+					annTargets:                "source",
+				}},
+				Spec: v1.PersistentVolumeSpec{
+					Capacity:               v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+					PersistentVolumeSource: v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Path: "/export/vol-3"}},
+				},
+			}),
+		snapshotClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+			&unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "snapshot.storage.k8s.io/v1",
+				"kind":       "VolumeSnapshot",
+				"metadata":   map[string]interface{}{"namespace": "default", "name": "snap-1"},
+				"status": map[string]interface{}{
+					"readyToUse":                     true,
+					"boundVolumeSnapshotContentName": "snapcontent-1",
+				},
+			}},
+			&unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "snapshot.storage.k8s.io/v1",
+				"kind":       "VolumeSnapshotContent",
+				"metadata":   map[string]interface{}{"name": "snapcontent-1"},
+				"spec":       map[string]interface{}{"driver": "csiraid.io/test"},
+				"status": map[string]interface{}{
+					"readyToUse":     true,
+					"snapshotHandle": "target:snapcontent-1",
+					"restoreSize":    int64(2 << 30),
+				},
+			}}),
+		provisionerName: "csiraid.io/test",
+		syncManager:     NewSyncManager("test", nil),
+		eventRecorder:   record.NewFakeRecorder(10),
+	}
+	defer ctrl.syncManager.Shutdown(time.Second)
+
+	tests := []struct {
+		name       string
+		dataSource v1.TypedLocalObjectReference
+		size       string
+		expected   string
+	}{
+		{
+			name:       "clone",
+			dataSource: v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "claim-1"},
+			size:       "1Gi",
+			expected:   "clone",
+		},
+		{
+			name:       "clone of promoted volume",
+			dataSource: v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "claim-3"},
+			size:       "1Gi",
+			expected:   "promoted",
+		},
+		{
+			name:       "clone smaller than source",
+			dataSource: v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "claim-1"},
+			size:       "1Mi",
+		},
+		{
+			name:       "restore",
+			dataSource: v1.TypedLocalObjectReference{APIGroup: &snapshotGroup, Kind: "VolumeSnapshot", Name: "snap-1"},
+			size:       "2Gi",
+			expected:   "snapshot",
+		},
+		{
+			name:       "restore smaller than snapshot",
+			dataSource: v1.TypedLocalObjectReference{APIGroup: &snapshotGroup, Kind: "VolumeSnapshot", Name: "snap-1"},
+			size:       "1Gi",
+		},
+		{
+			name:       "missing snapshot",
+			dataSource: v1.TypedLocalObjectReference{APIGroup: &snapshotGroup, Kind: "VolumeSnapshot", Name: "snap-2"},
+			size:       "2Gi",
+		},
+		{
+			name:       "unsupported kind",
+			dataSource: v1.TypedLocalObjectReference{Kind: "ConfigMap", Name: "claim-1"},
+			size:       "2Gi",
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "claim-2", UID: types.UID(test.name)},
+				Spec: v1.PersistentVolumeClaimSpec{
+					DataSource: &test.dataSource,
+					Resources: v1.ResourceRequirements{
+						Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse(test.size)},
+					},
+				},
+			}
+			source, err := ctrl.dataSourceFs(context.Background(), claim)
+			if test.expected == "" {
+				if err == nil {
+					t.Fatal("expected data source to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			volume := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-" + string(rune('a'+i))}}
+			if result, err := ctrl.populateVolume(context.Background(), claim, volume, source); err != nil || result != ProvisioningFinished {
+				t.Fatalf("expected data source to be copied but got %s: %v", result, err)
+			}
+			copied := filepath.Join(sourceRoot, "default-claim-2-"+volume.Name, "a")
+			if data, _ := ioutil.ReadFile(copied); string(data) != test.expected {
+				t.Errorf("expected %q to be copied but got %q", test.expected, data)
+			}
+		})
+	}
+
+	// A failed copy leaves no volume behind.
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "claim-2", UID: "failed"},
+		Spec: v1.PersistentVolumeClaimSpec{
+			DataSource: &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "claim-1"},
+		},
+	}
+	missing, err := fs.NewFs(context.Background(), filepath.Join(sourceRoot, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-failed"}}
+	if _, err := ctrl.populateVolume(context.Background(), claim, volume, missing); err == nil {
+		t.Fatal("expected copy to fail")
+	}
+	if exists(filepath.Join(sourceRoot, "default-claim-2-pvc-failed")) {
+		t.Error("expected partial copy to be removed")
+	}
+}
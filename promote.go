@@ -0,0 +1,377 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs/config"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// annSource and annTargets on a PersistentVolume are the remote holding
+	// the primary copy of a promoted volume and the comma separated remotes
+	// holding its replicas. Volumes without them are replicated from the
+	// source of the provisioner to the targets of their StorageClass.
+	annSource  = "csiraid.io/source"
+	annTargets = "csiraid.io/targets"
+	// annPromote on a PersistentVolume promotes the replica on the given
+	// target remote to the primary copy of the volume.
+	annPromote = "csiraid.io/promote"
+	// annPromotedVolume on a PersistentVolumeClaim is the PersistentVolume
+	// replacing the volume of the claim while it is promoted, encoded as
+	// JSON. It is recorded before the former volume is deleted and removed
+	// once the promoted volume has been created, see replaceVolume.
+	annPromotedVolume = "csiraid.io/promoted-volume"
+)
+
+// promoteVolumeBackoff is how often the replaced PersistentVolume of a
+// promoted volume is created.
+var promoteVolumeBackoff = wait.Backoff{Duration: time.Second, Factor: 2, Steps: 8}
+
+// volumeRoles returns the remote holding the primary copy of volume and the
+// remotes holding its replicas.
+func (ctrl *ProvisionController) volumeRoles(volume *v1.PersistentVolume) (string, []string) {
+	if source, ok := volume.Annotations[annSource]; ok {
+		return source, parseTargets(volume.Annotations[annTargets])
+	}
+	return Source, ctrl.volumeTargets(volume)
+}
+
+// volumeSource returns the remote holding the primary copy of volume.
+func volumeSource(volume *v1.PersistentVolume) string {
+	if source, ok := volume.Annotations[annSource]; ok {
+		return source
+	}
+	return Source
+}
+
+// volumeExport returns the NFS server and path exporting volume on remote.
+func (ctrl *ProvisionController) volumeExport(remote string, volume *v1.PersistentVolume) (string, string, error) {
+	directory := path.Base(volume.Spec.NFS.Path)
+	if exporter, ok := ctrl.provisioner.(Exporter); ok {
+		return exporter.GetExport(remote, directory)
+	}
+	loadRcloneConfig()
+	host, _ := config.Data().GetValue(remote, "host")
+	if host == "" {
+		return "", "", fmt.Errorf("remote %q has no host to export volumes", remote)
+	}
+	root, _ := config.Data().GetValue(remote, "path")
+	return host, path.Join("/", root, directory), nil
+}
+
+// Promote makes the replica of the given volume on target its primary copy:
+// after a final pass the replication is reversed, the PersistentVolume is
+// replaced by one pointing at target and the new roles are recorded on it.
+// Pods using the volume keep the former primary mounted until they are
+// restarted and should be stopped before.
+func (ctrl *ProvisionController) Promote(ctx context.Context, volumeName, target string) error {
+	return ctrl.promote(ctx, volumeName, target, true)
+}
+
+// promote promotes the replica of the given volume on target, after a final
+// pass if finalSync is set.
+func (ctrl *ProvisionController) promote(ctx context.Context, volumeName, target string, finalSync bool) error {
+	volume, err := ctrl.client.CoreV1().PersistentVolumes().Get(ctx, volumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if volume.Spec.NFS == nil || !ctrl.knownProvisioner(volume.Annotations[annDynamicallyProvisioned]) {
+		return fmt.Errorf("volume %q is not provisioned by %s", volumeName, ctrl.provisionerName)
+	}
+	source, targets := ctrl.volumeRoles(volume)
+	var newTargets []string
+	found := false
+	for _, t := range targets {
+		if t == target {
+			found = true
+		} else {
+			newTargets = append(newTargets, t)
+		}
+	}
+	if !found || target == source {
+		return fmt.Errorf("volume %q has no replica on %s", volumeName, target)
+	}
+	if status, err := ctrl.syncManager.Status(volumeName); err == nil && status.Layout == LayoutErasure {
+		return fmt.Errorf("volume %q: erasure coded replicas cannot be promoted", volumeName)
+	} else if err == nil && status.Encryption.enabled() {
+		return fmt.Errorf("volume %q: encrypted replicas cannot be promoted", volumeName)
+	} else if err == nil && status.Compression.Enabled {
+		return fmt.Errorf("volume %q: compressed replicas cannot be promoted", volumeName)
+	}
+	server, exportPath, err := ctrl.volumeExport(target, volume)
+	if err != nil {
+		return err
+	}
+
+	if finalSync {
+		if err := ctrl.syncManager.Flush(ctx, volumeName, target); err != nil && err != ErrSyncJobNotFound {
+			return fmt.Errorf("final sync: %v", err)
+		}
+	}
+	// Neither side may be written by replication while the roles change.
+	if err := ctrl.syncManager.Stop(volumeName); err != nil && err != ErrSyncJobNotFound {
+		return err
+	}
+	// The former primary copy is fenced if it is written to after the
+	// promotion and before it is replaced, see checkSplitBrain.
+	if err := ctrl.promoteReplicationState(ctx, volume, target); err != nil {
+		ctrl.startVolumeSync(ctx, volume)
+		return fmt.Errorf("failed to raise the epoch of the replica on %s: %v", target, err)
+	}
+
+	promoted := volume.DeepCopy()
+	promoted.ObjectMeta = metav1.ObjectMeta{
+		Name:        volume.Name,
+		Labels:      volume.Labels,
+		Annotations: map[string]string{},
+		Finalizers:  volume.Finalizers,
+	}
+	for key, value := range volume.Annotations {
+		if key != annPromote {
+			promoted.Annotations[key] = value
+		}
+	}
+	promoted.Annotations[annSource] = target
+	promoted.Annotations[annTargets] = strings.Join(append([]string{source}, newTargets...), ",")
+	promoted.Spec.NFS = &v1.NFSVolumeSource{Server: server, Path: exportPath, ReadOnly: volume.Spec.NFS.ReadOnly}
+	promoted.Status = v1.PersistentVolumeStatus{}
+
+	if deleted, err := ctrl.replaceVolume(ctx, volume, promoted); err != nil {
+		if !deleted {
+			// The volume keeps its roles, resume replicating it.
+			ctrl.startVolumeSync(ctx, volume)
+		}
+		return err
+	}
+	klog.Infof("Volume %q promoted: primary copy on %s, replicas on %s", volumeName, target, promoted.Annotations[annTargets])
+	ctrl.eventRecorder.Eventf(promoted, v1.EventTypeNormal, "VolumePromoted", "Promoted the replica on %s to the primary copy, exported by %s:%s",
+		target, server, exportPath)
+	if err := ctrl.startVolumeSync(ctx, promoted); err != nil {
+		return &replicationError{volume: promoted, err: err}
+	}
+	return nil
+}
+
+// replicationError is returned by promote when the volume has been promoted
+// but its replication could not be started, to all of its targets or some.
+type replicationError struct {
+	volume *v1.PersistentVolume
+	err    error
+}
+
+func (e *replicationError) Error() string {
+	return fmt.Sprintf("volume %q promoted, failed to start its replication: %v", e.volume.Name, e.err)
+}
+
+// replaceVolume replaces volume with promoted: the source of a
+// PersistentVolume cannot be changed. The claim bound to volume is bound to
+// promoted when it has been created. promoted is recorded on the claim before
+// volume is deleted, so that it is created by syncClaim if it cannot be
+// created here; deleted reports whether volume has been deleted.
+func (ctrl *ProvisionController) replaceVolume(ctx context.Context, volume, promoted *v1.PersistentVolume) (deleted bool, err error) {
+	claimRef := volume.Spec.ClaimRef
+	if claimRef == nil {
+		return false, fmt.Errorf("volume %q is not bound to a claim to record its promotion on", volume.Name)
+	}
+	ctrl.promotions.Store(volume.Name, true)
+	defer ctrl.promotions.Delete(volume.Name)
+	if err := ctrl.recordPromotedVolume(ctx, claimRef, promoted); err != nil {
+		return false, fmt.Errorf("failed to record promoted persistentvolume %q on claim %s/%s: %v", promoted.Name, claimRef.Namespace, claimRef.Name, err)
+	}
+
+	volumes := ctrl.client.CoreV1().PersistentVolumes()
+	// The protection of a bound volume would keep it from being deleted.
+	released := volume.DeepCopy()
+	released.Finalizers = nil
+	released, err = volumes.Update(ctx, released, metav1.UpdateOptions{})
+	if err != nil {
+		ctrl.forgetPromotedVolume(ctx, claimRef)
+		return false, err
+	}
+	err = volumes.Delete(ctx, volume.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &released.UID}})
+	if err != nil && !apierrs.IsNotFound(err) {
+		ctrl.forgetPromotedVolume(ctx, claimRef)
+		return false, err
+	}
+
+	var lastErr error
+	err = wait.ExponentialBackoff(promoteVolumeBackoff, func() (bool, error) {
+		if _, lastErr = volumes.Create(ctx, promoted, metav1.CreateOptions{}); lastErr != nil {
+			klog.Infof("Failed to create promoted persistentvolume %q: %v", promoted.Name, lastErr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		ctrl.eventRecorder.Eventf(claimRef, v1.EventTypeWarning, "PromotedVolumeNotCreated",
+			"Failed to create promoted persistentvolume %q, retrying: %v", promoted.Name, lastErr)
+		return true, fmt.Errorf("failed to create promoted persistentvolume %q: %v", promoted.Name, lastErr)
+	}
+	ctrl.forgetPromotedVolume(ctx, claimRef)
+	return true, nil
+}
+
+// recordPromotedVolume records promoted on the claim of claimRef.
+func (ctrl *ProvisionController) recordPromotedVolume(ctx context.Context, claimRef *v1.ObjectReference, promoted *v1.PersistentVolume) error {
+	data, err := json.Marshal(promoted)
+	if err != nil {
+		return err
+	}
+	claims := ctrl.client.CoreV1().PersistentVolumeClaims(claimRef.Namespace)
+	claim, err := claims.Get(ctx, claimRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if claim.UID != claimRef.UID {
+		return fmt.Errorf("claim has UID %s, expected %s", claim.UID, claimRef.UID)
+	}
+	metav1.SetMetaDataAnnotation(&claim.ObjectMeta, annPromotedVolume, string(data))
+	_, err = claims.Update(ctx, claim, metav1.UpdateOptions{})
+	return err
+}
+
+// forgetPromotedVolume removes the promoted volume recorded on the claim of
+// claimRef. Errors are logged: the volume is then created again by
+// syncClaim, which finds it exists.
+func (ctrl *ProvisionController) forgetPromotedVolume(ctx context.Context, claimRef *v1.ObjectReference) {
+	claims := ctrl.client.CoreV1().PersistentVolumeClaims(claimRef.Namespace)
+	claim, err := claims.Get(ctx, claimRef.Name, metav1.GetOptions{})
+	if err == nil {
+		delete(claim.Annotations, annPromotedVolume)
+		_, err = claims.Update(ctx, claim, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		klog.Errorf("Failed to remove annotation %s of PersistentVolumeClaim %s/%s: %v", annPromotedVolume, claimRef.Namespace, claimRef.Name, err)
+	}
+}
+
+// createPromotedVolume creates the promoted volume recorded on claim whose
+// creation failed during the promotion. An error is returned, and the claim
+// retried, until it has been created.
+func (ctrl *ProvisionController) createPromotedVolume(ctx context.Context, claim *v1.PersistentVolumeClaim) error {
+	data, ok := claim.Annotations[annPromotedVolume]
+	if !ok {
+		return nil
+	}
+	promoted := &v1.PersistentVolume{}
+	if err := json.Unmarshal([]byte(data), promoted); err != nil {
+		ctrl.eventRecorder.Eventf(claim, v1.EventTypeWarning, "PromotedVolumeNotCreated", "Invalid annotation %s: %v", annPromotedVolume, err)
+		return fmt.Errorf("invalid annotation %s of PersistentVolumeClaim %q: %v", annPromotedVolume, claimToClaimKey(claim), err)
+	}
+	if _, ok := ctrl.promotions.Load(promoted.Name); ok {
+		return fmt.Errorf("persistentvolume %q is being promoted", promoted.Name)
+	}
+	volume, err := ctrl.client.CoreV1().PersistentVolumes().Create(ctx, promoted, metav1.CreateOptions{})
+	switch {
+	case err == nil:
+		klog.Infof("Promoted persistentvolume %q created", promoted.Name)
+		ctrl.eventRecorder.Eventf(claim, v1.EventTypeNormal, "PromotedVolumeCreated", "Created promoted persistentvolume %q", promoted.Name)
+		ctrl.startVolumeSync(ctx, volume)
+	case apierrs.IsAlreadyExists(err):
+		existing, err := ctrl.client.CoreV1().PersistentVolumes().Get(ctx, promoted.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if existing.DeletionTimestamp != nil {
+			return fmt.Errorf("former persistentvolume %q is still being deleted", promoted.Name)
+		}
+		// Either created by an earlier attempt or the former volume was
+		// kept because the promotion failed before deleting it.
+		if volumeSource(existing) != volumeSource(promoted) {
+			klog.Infof("Promotion of persistentvolume %q was abandoned, keeping its former volume", promoted.Name)
+		}
+	default:
+		ctrl.eventRecorder.Eventf(claim, v1.EventTypeWarning, "PromotedVolumeNotCreated", "Failed to create promoted persistentvolume %q: %v", promoted.Name, err)
+		return fmt.Errorf("failed to create promoted persistentvolume %q: %v", promoted.Name, err)
+	}
+
+	newClaim := claim.DeepCopy()
+	delete(newClaim.Annotations, annPromotedVolume)
+	if _, err := ctrl.client.CoreV1().PersistentVolumeClaims(newClaim.Namespace).Update(ctx, newClaim, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to remove annotation %s of PersistentVolumeClaim %q: %v", annPromotedVolume, claimToClaimKey(newClaim), err)
+	}
+	if ctrl.claimInformer != nil {
+		if err := ctrl.claimInformer.GetStore().Update(newClaim); err != nil {
+			klog.Warningf("update claim informer cache for PersistentVolumeClaim %q: %v", claimToClaimKey(newClaim), err)
+		}
+	}
+	return nil
+}
+
+// startVolumeSync starts replicating an existing volume of the provisioner as
+// configured by its StorageClass, its claim and its roles. Errors are logged
+// and returned.
+func (ctrl *ProvisionController) startVolumeSync(ctx context.Context, volume *v1.PersistentVolume) error {
+	class, err := ctrl.client.StorageV1().StorageClasses().Get(ctx, volume.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Failed to start replication of volume %q: %v", volume.Name, err)
+		return err
+	}
+	return ctrl.startClassVolumeSync(ctx, volume, class)
+}
+
+// startClassVolumeSync starts replicating an existing volume of class.
+func (ctrl *ProvisionController) startClassVolumeSync(ctx context.Context, volume *v1.PersistentVolume, class *storage.StorageClass) error {
+	spec := SyncJobSpec{
+		VolumeName:   volume.Name,
+		Source:       Source,
+		Directory:    volume.Spec.NFS.Path,
+		StorageClass: class.Name,
+	}
+	if source, ok := volume.Annotations[annSource]; ok {
+		spec.Source = source
+		spec.Targets = parseTargets(volume.Annotations[annTargets])
+	}
+	var annotations map[string]string
+	if claimRef := volume.Spec.ClaimRef; claimRef != nil {
+		spec.ClaimNamespace = claimRef.Namespace
+		spec.ClaimName = claimRef.Name
+		spec.ClaimUID = claimRef.UID
+		// The informers may not be synced yet.
+		if claim, err := ctrl.client.CoreV1().PersistentVolumeClaims(claimRef.Namespace).Get(ctx, claimRef.Name, metav1.GetOptions{}); err == nil {
+			annotations = claim.Annotations
+		}
+	}
+	return ctrl.startSync(spec, class.Parameters, annotations)
+}
+
+// promoteRequested promotes volume to the target of its annPromote
+// annotation.
+func (ctrl *ProvisionController) promoteRequested(ctx context.Context, volume *v1.PersistentVolume) error {
+	target, ok := volume.Annotations[annPromote]
+	if !ok {
+		return nil
+	}
+	if err := ctrl.Promote(ctx, volume.Name, target); err != nil {
+		ctrl.eventRecorder.Eventf(volume, v1.EventTypeWarning, "PromotionFailed", "Failed to promote the replica on %s: %v", target, err)
+		return err
+	}
+	return nil
+}
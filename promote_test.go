@@ -0,0 +1,219 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"errors"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	testclient "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+type testExportProvisioner struct {
+	*testProvisioner
+}
+
+func (p *testExportProvisioner) GetExport(remote, directory string) (string, string, error) {
+	return remote + ".example.com", path.Join("/export", directory), nil
+}
+
+func TestPromote(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "data", time.Now())
+	defer func(source string, active bool) { Source, Active = source, active }(Source, Active)
+	Source, Active = "source", true
+
+	volume := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pv-1",
+			Annotations: map[string]string{annDynamicallyProvisioned: "csiraid.io/test", annPromote: "target"},
+			Finalizers:  []string{finalizerPV},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Server: "source.example.com", Path: "/export/vol-1"}},
+			ClaimRef:               &v1.ObjectReference{Namespace: "default", Name: "claim-1", UID: "uid-1"},
+			StorageClassName:       "class-1",
+		},
+	}
+	ctrl := &ProvisionController{
+		client: fake.NewSimpleClientset(volume, boundClaim("claim-1", "uid-1"),
+			&storage.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "class-1"}, Provisioner: "csiraid.io/test"}),
+		provisioner:     &testExportProvisioner{newTestProvisioner()},
+		provisionerName: "csiraid.io/test",
+		syncManager:     NewSyncManager("test", nil),
+		eventRecorder:   record.NewFakeRecorder(10),
+	}
+	defer ctrl.syncManager.Shutdown(time.Second)
+	ctx := context.Background()
+	ctrl.startVolumeSync(ctx, volume)
+
+	if err := ctrl.Promote(ctx, "pv-1", "target2"); err == nil {
+		t.Fatal("expected promotion to a remote without a replica to fail")
+	}
+	if err := ctrl.syncVolume(ctx, volume); err != nil {
+		t.Fatal(err)
+	}
+	// The final pass copied the volume before the roles changed.
+	waitForFile(t, filepath.Join(targetRoot, "vol-1", "a"), time.Second)
+	f, err := newFsDirFromVolume(ctx, "target", "/export/vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := readReplicationState(ctx, f); err != nil || state == nil || state.Epoch != 1 {
+		t.Errorf("expected epoch 1 on the promoted copy, got %+v: %v", state, err)
+	}
+
+	promoted, err := ctrl.client.CoreV1().PersistentVolumes().Get(ctx, "pv-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := v1.NFSVolumeSource{Server: "target.example.com", Path: "/export/vol-1"}
+	if *promoted.Spec.NFS != expected {
+		t.Errorf("expected NFS source %+v, got %+v", expected, *promoted.Spec.NFS)
+	}
+	if promoted.Spec.ClaimRef == nil || promoted.Spec.ClaimRef.UID != "uid-1" {
+		t.Errorf("expected claim reference to be kept, got %+v", promoted.Spec.ClaimRef)
+	}
+	if _, ok := promoted.Annotations[annPromote]; ok {
+		t.Errorf("expected %s annotation to be removed", annPromote)
+	}
+	claim, err := ctrl.client.CoreV1().PersistentVolumeClaims("default").Get(ctx, "claim-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := claim.Annotations[annPromotedVolume]; ok {
+		t.Errorf("expected %s annotation to be removed from the claim", annPromotedVolume)
+	}
+	source, targets := ctrl.volumeRoles(promoted)
+	if source != "target" || !reflect.DeepEqual(targets, []string{"source"}) {
+		t.Errorf("expected roles target -> [source], got %s -> %v", source, targets)
+	}
+
+	status, err := ctrl.syncManager.Status("pv-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Source != "target" || !reflect.DeepEqual(status.Targets, []string{"source"}) {
+		t.Errorf("expected replication target -> [source], got %s -> %v", status.Source, status.Targets)
+	}
+}
+
+func TestPromotedVolumeRecreated(t *testing.T) {
+	testRemotes(t)
+	defer func(backoff wait.Backoff) { promoteVolumeBackoff = backoff }(promoteVolumeBackoff)
+	promoteVolumeBackoff = wait.Backoff{Duration: time.Millisecond, Steps: 2}
+
+	volume := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pv-1",
+			Annotations: map[string]string{annDynamicallyProvisioned: "csiraid.io/test"},
+			Finalizers:  []string{finalizerPV},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Server: "source.example.com", Path: "/export/vol-1"}},
+			ClaimRef:               &v1.ObjectReference{Namespace: "default", Name: "claim-1", UID: "uid-1"},
+			StorageClassName:       "class-1",
+		},
+	}
+	promoted := volume.DeepCopy()
+	promoted.Annotations = map[string]string{annDynamicallyProvisioned: "csiraid.io/test", annSource: "target", annTargets: "source"}
+	promoted.Spec.NFS = &v1.NFSVolumeSource{Server: "target.example.com", Path: "/export/vol-1"}
+
+	client := fake.NewSimpleClientset(volume, boundClaim("claim-1", "uid-1"),
+		&storage.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "class-1"}, Provisioner: "csiraid.io/test"})
+	failCreate := true
+	client.Fake.PrependReactor("create", "persistentvolumes", func(action testclient.Action) (bool, runtime.Object, error) {
+		if failCreate {
+			return true, nil, errors.New("create failed")
+		}
+		return false, nil, nil
+	})
+	recorder := record.NewFakeRecorder(10)
+	ctrl := &ProvisionController{
+		client:          client,
+		provisioner:     &testExportProvisioner{newTestProvisioner()},
+		provisionerName: "csiraid.io/test",
+		syncManager:     NewSyncManager("test", nil),
+		eventRecorder:   recorder,
+	}
+	defer ctrl.syncManager.Shutdown(time.Second)
+	ctx := context.Background()
+
+	deleted, err := ctrl.replaceVolume(ctx, volume, promoted)
+	if err == nil || !deleted {
+		t.Fatalf("expected the former volume to be deleted and the creation to fail, got %v, %v", deleted, err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "Warning PromotedVolumeNotCreated") {
+		t.Errorf("expected a PromotedVolumeNotCreated warning, got %q", event)
+	}
+	claim, err := client.CoreV1().PersistentVolumeClaims("default").Get(ctx, "claim-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := claim.Annotations[annPromotedVolume]; !ok {
+		t.Fatalf("expected the promoted volume to be recorded on the claim")
+	}
+
+	// The claim is retried until the volume is created.
+	if err := ctrl.syncClaim(ctx, claim); err == nil {
+		t.Error("expected syncing the claim to fail while the volume cannot be created")
+	}
+	failCreate = false
+	if err := ctrl.syncClaim(ctx, claim); err != nil {
+		t.Fatal(err)
+	}
+	stale := claim
+	created, err := client.CoreV1().PersistentVolumes().Get(ctx, "pv-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volumeSource(created) != "target" || created.Spec.NFS.Server != "target.example.com" {
+		t.Errorf("expected the promoted volume to be created, got %+v", created)
+	}
+	claim, err = client.CoreV1().PersistentVolumeClaims("default").Get(ctx, "claim-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := claim.Annotations[annPromotedVolume]; ok {
+		t.Errorf("expected %s annotation to be removed from the claim", annPromotedVolume)
+	}
+	// Recorded again by a stale copy of the claim, the existing volume is kept.
+	if err := ctrl.createPromotedVolume(ctx, stale); err != nil {
+		t.Error(err)
+	}
+}
+
+func boundClaim(name, uid string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(uid)},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-1"},
+	}
+}
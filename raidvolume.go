@@ -0,0 +1,282 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	klog "k8s.io/klog/v2"
+)
+
+// RaidVolumeResource is the cluster scoped RaidVolume custom resource, one per
+// replicated PersistentVolume and named like it. It is defined by
+// raidvolume-crd.yaml.
+var RaidVolumeResource = schema.GroupVersionResource{Group: "csiraid.io", Version: "v1alpha1", Resource: "raidvolumes"}
+
+// raidVolumeStatusPeriod is how often changed RaidVolume statuses are
+// written.
+const raidVolumeStatusPeriod = 5 * time.Second
+
+// RaidVolume shows how a PersistentVolume is replicated.
+type RaidVolume struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RaidVolumeSpec   `json:"spec"`
+	Status RaidVolumeStatus `json:"status,omitempty"`
+}
+
+// RaidVolumeSpec is the replication configured for the volume.
+type RaidVolumeSpec struct {
+	Source         string   `json:"source"`
+	Targets        []string `json:"targets"`
+	Mode           SyncMode `json:"mode"`
+	Interval       string   `json:"interval"`
+	ClaimNamespace string   `json:"claimNamespace,omitempty"`
+	ClaimName      string   `json:"claimName,omitempty"`
+	StorageClass   string   `json:"storageClass,omitempty"`
+}
+
+// RaidVolumeStatus is the state of the replication of the volume.
+type RaidVolumeStatus struct {
+	Phase            ReplicationPhase `json:"phase,omitempty"`
+	LastSyncTime     *metav1.Time     `json:"lastSyncTime,omitempty"`
+	LastError        string           `json:"lastError,omitempty"`
+	BytesReplicated  int64            `json:"bytesReplicated"`
+	HealthyReplicas  int              `json:"healthyReplicas"`
+	Replicas         int              `json:"replicas"`
+	ObservedInterval string           `json:"observedInterval,omitempty"`
+	// InitialSync is the progress of the initial syncs of the replicas
+	// that have never been synced.
+	InitialSync *RaidVolumeInitialSync `json:"initialSync,omitempty"`
+}
+
+// RaidVolumeInitialSync is the combined progress of the initial syncs of the
+// replicas of the volume.
+type RaidVolumeInitialSync struct {
+	Percent    int64       `json:"percent"`
+	Files      int64       `json:"files"`
+	TotalFiles int64       `json:"totalFiles"`
+	Bytes      int64       `json:"bytes"`
+	TotalBytes int64       `json:"totalBytes"`
+	StartTime  metav1.Time `json:"startTime"`
+	ETA        string      `json:"eta,omitempty"`
+}
+
+// newRaidVolume returns the RaidVolume of the volume replicated as described
+// by status.
+func newRaidVolume(status SyncJobStatus) *RaidVolume {
+	interval := status.MinSyncInterval
+	if status.Mode == SyncModeNotify {
+		interval = status.NotifyResyncInterval
+	}
+	volume := &RaidVolume{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: RaidVolumeResource.GroupVersion().String(),
+			Kind:       "RaidVolume",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: status.VolumeName},
+		Spec: RaidVolumeSpec{
+			Source:         status.Source,
+			Targets:        status.Targets,
+			Mode:           status.Mode,
+			Interval:       interval.String(),
+			ClaimNamespace: status.ClaimNamespace,
+			ClaimName:      status.ClaimName,
+			StorageClass:   status.StorageClass,
+		},
+		Status: RaidVolumeStatus{
+			Phase:           status.Phase,
+			LastError:       status.LastError,
+			BytesReplicated: status.BytesTransferred,
+			HealthyReplicas: status.HealthyReplicas,
+			Replicas:        len(status.Replicas),
+		},
+	}
+	if !status.LastSyncTime.IsZero() {
+		volume.Status.LastSyncTime = &metav1.Time{Time: status.LastSyncTime}
+	}
+	if status.SyncInterval > 0 {
+		volume.Status.ObservedInterval = status.SyncInterval.String()
+	}
+	if p := status.InitialSync; p != nil {
+		volume.Status.InitialSync = &RaidVolumeInitialSync{
+			Percent:    int64(p.Percent()),
+			Files:      p.Files,
+			TotalFiles: p.TotalFiles,
+			Bytes:      p.Bytes,
+			TotalBytes: p.TotalBytes,
+			StartTime:  metav1.Time{Time: p.StartTime},
+		}
+		if p.ETA > 0 {
+			volume.Status.InitialSync.ETA = p.ETA.Round(time.Second).String()
+		}
+	}
+	return volume
+}
+
+// raidVolumeWriter keeps the RaidVolumes of the replicated volumes up to
+// date. Statuses are collected from the sync loops and written periodically,
+// the last one of each volume only.
+type raidVolumeWriter struct {
+	client dynamic.Interface
+
+	lock    sync.Mutex
+	pending map[string]SyncJobStatus
+	// written are the RaidVolumes as last written, by name.
+	written map[string]*RaidVolume
+}
+
+func newRaidVolumeWriter(client dynamic.Interface) *raidVolumeWriter {
+	return &raidVolumeWriter{
+		client:  client,
+		pending: map[string]SyncJobStatus{},
+		written: map[string]*RaidVolume{},
+	}
+}
+
+// update queues the status of a volume to be written. It does not block and
+// is a no-op on a nil writer.
+func (w *raidVolumeWriter) update(status SyncJobStatus) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.pending[status.VolumeName] = status
+}
+
+// run writes the queued statuses until ctx is done.
+func (w *raidVolumeWriter) run(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	ticker := time.NewTicker(raidVolumeStatusPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.flush(ctx)
+		}
+	}
+}
+
+// flush writes the queued statuses. Statuses that fail to be written are
+// queued again unless a newer one has been queued in the meantime.
+func (w *raidVolumeWriter) flush(ctx context.Context) {
+	w.lock.Lock()
+	pending := w.pending
+	w.pending = map[string]SyncJobStatus{}
+	w.lock.Unlock()
+
+	for name, status := range pending {
+		if err := w.write(ctx, newRaidVolume(status)); err != nil {
+			klog.Infof("Failed to update RaidVolume %q: %v", name, err)
+			w.lock.Lock()
+			if _, ok := w.pending[name]; !ok {
+				w.pending[name] = status
+			}
+			w.lock.Unlock()
+		}
+	}
+}
+
+// create creates the RaidVolume of a volume that has just been provisioned.
+// It is a no-op on a nil writer.
+func (w *raidVolumeWriter) create(ctx context.Context, status SyncJobStatus) {
+	if w == nil {
+		return
+	}
+	if err := w.write(ctx, newRaidVolume(status)); err != nil {
+		klog.Errorf("Failed to create RaidVolume %q: %v", status.VolumeName, err)
+	}
+}
+
+// delete deletes the RaidVolume of a deleted volume. It is a no-op on a nil
+// writer.
+func (w *raidVolumeWriter) delete(ctx context.Context, name string) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	delete(w.pending, name)
+	delete(w.written, name)
+	w.lock.Unlock()
+	err := w.client.Resource(RaidVolumeResource).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		klog.Errorf("Failed to delete RaidVolume %q: %v", name, err)
+	}
+}
+
+// write creates or updates volume, its spec and its status.
+func (w *raidVolumeWriter) write(ctx context.Context, volume *RaidVolume) error {
+	w.lock.Lock()
+	last := w.written[volume.Name]
+	w.lock.Unlock()
+	if last != nil && reflect.DeepEqual(last.Spec, volume.Spec) && reflect.DeepEqual(last.Status, volume.Status) {
+		return nil
+	}
+
+	client := w.client.Resource(RaidVolumeResource)
+	obj, err := toUnstructured(volume)
+	if err != nil {
+		return err
+	}
+	current, err := client.Get(ctx, volume.Name, metav1.GetOptions{})
+	switch {
+	case apierrs.IsNotFound(err):
+		// The status of a new object is ignored by the API server.
+		if current, err = client.Create(ctx, obj, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !reflect.DeepEqual(current.Object["spec"], obj.Object["spec"]):
+		current.Object["spec"] = obj.Object["spec"]
+		if current, err = client.Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	current.Object["status"] = obj.Object["status"]
+	if _, err := client.UpdateStatus(ctx, current, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	w.written[volume.Name] = volume
+	w.lock.Unlock()
+	return nil
+}
+
+func toUnstructured(volume *RaidVolume) (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(volume)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestRaidVolumeWriter(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "abc", time.Now())
+
+	ctx := context.Background()
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	writer := newRaidVolumeWriter(client)
+	m := NewSyncManager("test", nil)
+	defer m.Shutdown(time.Second)
+	m.SetStatusHandler(writer.update)
+
+	if err := m.Start(SyncJobSpec{
+		VolumeName:      "pv-1",
+		Source:          "source",
+		Target:          "target",
+		Directory:       "/export/vol-1",
+		MinSyncInterval: 10 * time.Millisecond,
+		MaxSyncInterval: 10 * time.Millisecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := m.Status("pv-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Phase != ReplicationSyncing {
+		t.Errorf("expected phase %s before the first pass but got %s", ReplicationSyncing, status.Phase)
+	}
+	writer.create(ctx, status)
+	waitForFile(t, filepath.Join(targetRoot, "vol-1", "a"), 10*time.Second)
+
+	var volume RaidVolume
+	deadline := time.Now().Add(5 * time.Second)
+	for volume.Status.Phase != ReplicationSynced {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected phase %s but got %+v", ReplicationSynced, volume.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+		writer.flush(ctx)
+		obj, err := client.Resource(RaidVolumeResource).Get(ctx, "pv-1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &volume); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if volume.Spec.Source != "source" || len(volume.Spec.Targets) != 1 || volume.Spec.Targets[0] != "target" {
+		t.Errorf("unexpected spec %+v", volume.Spec)
+	}
+	if volume.Status.BytesReplicated != 3 || volume.Status.LastSyncTime == nil || volume.Status.HealthyReplicas != 1 {
+		t.Errorf("unexpected status %+v", volume.Status)
+	}
+
+	if err := m.Stop("pv-1"); err != nil {
+		t.Fatal(err)
+	}
+	writer.delete(ctx, "pv-1")
+	writer.flush(ctx)
+	if _, err := client.Resource(RaidVolumeResource).Get(ctx, "pv-1", metav1.GetOptions{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected RaidVolume to be deleted but got %v", err)
+	}
+}
+
+func TestNewRaidVolume(t *testing.T) {
+	volume := newRaidVolume(SyncJobStatus{
+		SyncJobSpec: SyncJobSpec{
+			VolumeName:           "pv-1",
+			Mode:                 SyncModeNotify,
+			NotifyResyncInterval: 10 * time.Minute,
+		},
+		Phase: ReplicationDegraded,
+	})
+	obj, err := toUnstructured(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval, _, _ := unstructured.NestedString(obj.Object, "spec", "interval"); interval != "10m0s" {
+		t.Errorf("expected resync interval in notify mode but got %q", interval)
+	}
+	if phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase"); phase != string(ReplicationDegraded) {
+		t.Errorf("expected phase %s but got %q", ReplicationDegraded, phase)
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(obj.Object, "status", "lastSyncTime"); found {
+		t.Error("expected no lastSyncTime before the first pass")
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/object"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// DefaultRemoteProbeInterval is used when option function
+	// RemoteProbeInterval is omitted, remotes are not probed by default
+	DefaultRemoteProbeInterval = 0
+	// DefaultRemoteFailureThreshold is used when option function
+	// RemoteHealthThresholds is omitted
+	DefaultRemoteFailureThreshold = 3
+	// DefaultRemoteSuccessThreshold is used when option function
+	// RemoteHealthThresholds is omitted
+	DefaultRemoteSuccessThreshold = 2
+	// DefaultRemoteHealthPath is used when option function RemoteHealthPath
+	// is omitted
+	DefaultRemoteHealthPath = "/remotes"
+)
+
+// canaryPrefix is the prefix of the objects written to the root of the
+// remotes by the probes.
+const canaryPrefix = ".csiraid-canary-"
+
+// RemoteHealth is the health of an rclone remote as probed by the
+// controller. A remote turns unhealthy after a number of failed probes in a
+// row and healthy again after a number of successful ones.
+type RemoteHealth struct {
+	Remote  string `json:"remote"`
+	Healthy bool   `json:"healthy"`
+	// ConsecutiveFailures and ConsecutiveSuccesses count the last probes
+	// with the same outcome, one of them is 0.
+	ConsecutiveFailures  int       `json:"consecutiveFailures"`
+	ConsecutiveSuccesses int       `json:"consecutiveSuccesses"`
+	LastProbeTime        time.Time `json:"lastProbeTime"`
+	LastTransitionTime   time.Time `json:"lastTransitionTime,omitempty"`
+	LastError            string    `json:"lastError,omitempty"`
+	// Usage is the space used on the remote as of the last probe, nil if
+	// the remote cannot tell.
+	Usage *fs.Usage `json:"usage,omitempty"`
+}
+
+// remoteHealthMonitor periodically probes the rclone remotes volumes are
+// stored on.
+type remoteHealthMonitor struct {
+	interval         time.Duration
+	failureThreshold int
+	successThreshold int
+	// remotes returns the remotes to probe.
+	remotes func() []string
+	// probe checks a remote, returning its usage if known.
+	probe func(ctx context.Context, remote string) (*fs.Usage, error)
+	// handler is called when a remote turns unhealthy or healthy again, may
+	// be nil. It must not block.
+	handler func(remote string, healthy bool)
+
+	lock   sync.Mutex
+	health map[string]*RemoteHealth
+}
+
+func newRemoteHealthMonitor(interval time.Duration, failureThreshold, successThreshold int, remotes func() []string, handler func(string, bool)) *remoteHealthMonitor {
+	return &remoteHealthMonitor{
+		interval:         interval,
+		failureThreshold: failureThreshold,
+		successThreshold: successThreshold,
+		remotes:          remotes,
+		probe:            probeRemote,
+		handler:          handler,
+		health:           map[string]*RemoteHealth{},
+	}
+}
+
+// run probes the remotes every interval until ctx is done. It is a no-op on
+// a nil monitor.
+func (m *remoteHealthMonitor) run(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	wait.UntilWithContext(ctx, m.probeAll, m.interval)
+}
+
+// probeAll probes every remote at once, each for at most one interval.
+func (m *remoteHealthMonitor) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, remote := range m.remotes() {
+		remote := remote
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, m.interval)
+			defer cancel()
+			start := time.Now()
+			usage, err := m.probe(pctx, remote)
+			SM.RemoteProbeDurationSeconds.WithLabelValues(remote).Observe(time.Since(start).Seconds())
+			if ctx.Err() != nil {
+				return
+			}
+			m.record(remote, usage, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// record updates the health of remote with the outcome of a probe.
+func (m *remoteHealthMonitor) record(remote string, usage *fs.Usage, err error) {
+	m.lock.Lock()
+	h, ok := m.health[remote]
+	if !ok {
+		// Remotes are healthy until proven otherwise.
+		h = &RemoteHealth{Remote: remote, Healthy: true}
+		m.health[remote] = h
+	}
+	h.LastProbeTime = time.Now()
+	transition := false
+	if err != nil {
+		h.LastError = err.Error()
+		h.ConsecutiveFailures++
+		h.ConsecutiveSuccesses = 0
+		transition = h.Healthy && h.ConsecutiveFailures >= m.failureThreshold
+		SM.RemoteProbeFailuresTotal.WithLabelValues(remote).Inc()
+	} else {
+		h.LastError = ""
+		h.ConsecutiveSuccesses++
+		h.ConsecutiveFailures = 0
+		transition = !h.Healthy && h.ConsecutiveSuccesses >= m.successThreshold
+		if usage != nil {
+			h.Usage = usage
+			if usage.Free != nil {
+				SM.RemoteFreeBytes.WithLabelValues(remote).Set(float64(*usage.Free))
+			}
+		}
+	}
+	if transition {
+		h.Healthy = !h.Healthy
+		h.LastTransitionTime = h.LastProbeTime
+	}
+	healthy := h.Healthy
+	m.lock.Unlock()
+
+	if healthy {
+		SM.RemoteHealthy.WithLabelValues(remote).Set(1)
+	} else {
+		SM.RemoteHealthy.WithLabelValues(remote).Set(0)
+	}
+	if !transition {
+		if err != nil {
+			klog.V(4).Infof("Probe of remote %s failed: %v", remote, err)
+		}
+		return
+	}
+	if healthy {
+		klog.Infof("Remote %s is healthy again", remote)
+	} else {
+		klog.Warningf("Remote %s is unhealthy: %v", remote, err)
+	}
+	if m.handler != nil {
+		m.handler(remote, healthy)
+	}
+}
+
+// healthy tells whether remote is healthy. Remotes that have not been
+// probed yet are. It is true for any remote on a nil monitor.
+func (m *remoteHealthMonitor) healthy(remote string) bool {
+	if m == nil {
+		return true
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	h, ok := m.health[remote]
+	return !ok || h.Healthy
+}
+
+// list returns the health of the probed remotes sorted by name.
+func (m *remoteHealthMonitor) list() []RemoteHealth {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	list := make([]RemoteHealth, 0, len(m.health))
+	for _, h := range m.health {
+		list = append(list, *h)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Remote < list[b].Remote })
+	return list
+}
+
+// ServeHTTP writes the health of the remotes as JSON. The status is 503 if
+// any remote is unhealthy.
+func (m *remoteHealthMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	list := m.list()
+	w.Header().Set("Content-Type", "application/json")
+	for _, h := range list {
+		if !h.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			break
+		}
+	}
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		klog.Errorf("Failed to write remote health: %v", err)
+	}
+}
+
+// probeRemote lists the root of remote, the directory the volumes are
+// stored in, writes a canary object to it, reads it back and deletes it.
+// Returns the usage of the remote if its backend can tell.
+func probeRemote(ctx context.Context, remote string) (*fs.Usage, error) {
+	loadRcloneConfig()
+	root, _ := config.Data().GetValue(remote, "path")
+	f, err := fs.NewFs(ctx, remote+":"+root)
+	if err != nil {
+		return nil, err
+	}
+	// The root is created with the first volume.
+	if _, err := f.List(ctx, ""); err != nil && err != fs.ErrorDirNotFound {
+		return nil, fmt.Errorf("list: %v", err)
+	}
+
+	name := fmt.Sprintf("%s%d", canaryPrefix, time.Now().UnixNano())
+	data := []byte(name)
+	o, err := f.Put(ctx, bytes.NewReader(data), object.NewStaticObjectInfo(name, time.Now(), int64(len(data)), true, nil, f))
+	if err != nil {
+		return nil, fmt.Errorf("write canary: %v", err)
+	}
+	err = readCanary(ctx, o, data)
+	if rerr := o.Remove(ctx); err == nil && rerr != nil {
+		err = fmt.Errorf("delete canary: %v", rerr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	about := f.Features().About
+	if about == nil {
+		return nil, nil
+	}
+	usage, err := about(ctx)
+	if err != nil {
+		// Not all remotes of a backend support it.
+		klog.V(4).Infof("Failed to get usage of remote %s: %v", remote, err)
+		return nil, nil
+	}
+	return usage, nil
+}
+
+// readCanary checks that the canary object o holds data.
+func readCanary(ctx context.Context, o fs.Object, data []byte) error {
+	in, err := o.Open(ctx)
+	if err != nil {
+		return fmt.Errorf("read canary: %v", err)
+	}
+	defer in.Close()
+	read, err := ioutil.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("read canary: %v", err)
+	}
+	if !bytes.Equal(read, data) {
+		return fmt.Errorf("read canary: content differs from what was written")
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestProbeRemote(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	ctx := context.Background()
+	if _, err := probeRemote(ctx, "source"); err != nil {
+		t.Fatalf("expected missing root to be created by the probe: %v", err)
+	}
+	entries, err := ioutil.ReadDir(sourceRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected canary to be deleted, found %s", entries[0].Name())
+	}
+
+	// A root that is a file cannot hold volumes.
+	if err := ioutil.WriteFile(targetRoot, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(targetRoot)
+	if _, err := probeRemote(ctx, "target"); err == nil {
+		t.Error("expected probe of a remote whose root is a file to fail")
+	}
+}
+
+func TestRemoteHealthHysteresis(t *testing.T) {
+	var transitions []bool
+	remotes := func() []string { return []string{"remote"} }
+	m := newRemoteHealthMonitor(time.Minute, 2, 2, remotes, func(remote string, healthy bool) {
+		transitions = append(transitions, healthy)
+	})
+	var probeErr error
+	m.probe = func(ctx context.Context, remote string) (*fs.Usage, error) { return nil, probeErr }
+	ctx := context.Background()
+
+	steps := []struct {
+		err     error
+		healthy bool
+	}{
+		{nil, true},
+		{errors.New("down"), true},
+		{nil, true},
+		{errors.New("down"), true},
+		{errors.New("down"), false},
+		{errors.New("down"), false},
+		{nil, false},
+		{nil, true},
+	}
+	for i, step := range steps {
+		probeErr = step.err
+		m.probeAll(ctx)
+		if m.healthy("remote") != step.healthy {
+			t.Errorf("probe %d: expected healthy %t", i, step.healthy)
+		}
+	}
+	if !reflect.DeepEqual(transitions, []bool{false, true}) {
+		t.Errorf("expected to turn unhealthy and healthy again, got %v", transitions)
+	}
+	if !m.healthy("unknown") {
+		t.Error("expected a remote not probed yet to be healthy")
+	}
+
+	probeErr = errors.New("down")
+	m.probeAll(ctx)
+	m.probeAll(ctx)
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, DefaultRemoteHealthPath, nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", recorder.Code)
+	}
+	var list []RemoteHealth
+	if err := json.Unmarshal(recorder.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Remote != "remote" || list[0].Healthy || list[0].LastError != "down" {
+		t.Errorf("unexpected remote health %+v", list)
+	}
+}
+
+func TestUnhealthyRemoteDegradesVolume(t *testing.T) {
+	sourceRoot, _ := testRemotes(t)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "data", time.Now())
+	m := NewSyncManager("test", nil)
+	defer m.Shutdown(time.Second)
+	m.SetRemoteHealth(func(remote string) bool { return remote != "target2" })
+	if err := m.Start(SyncJobSpec{
+		VolumeName:      "pv-1",
+		Source:          "source",
+		Targets:         []string{"target", "target2"},
+		MinReplicas:     1,
+		Directory:       "/export/vol-1",
+		MinSyncInterval: time.Hour,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := m.Status("pv-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Degraded || !reflect.DeepEqual(status.UnhealthyRemotes, []string{"target2"}) {
+		t.Errorf("expected volume to be degraded by target2, got %t %v", status.Degraded, status.UnhealthyRemotes)
+	}
+}
+
+func TestProbedRemotes(t *testing.T) {
+	provisioner := newTestProvisioner()
+	ctrl := newTestProvisionController(fake.NewSimpleClientset(), "foo.bar/baz", provisioner)
+	ctrl.syncManager.volumes["pv-1"] = &replicaSet{spec: SyncJobSpec{Source: "promoted", Targets: []string{"source"}}}
+	if remotes := ctrl.probedRemotes(); !reflect.DeepEqual(remotes, []string{"promoted", "source"}) {
+		t.Errorf("expected only the remotes of the volumes while inactive, got %v", remotes)
+	}
+
+	provisioner.active = true
+	class := newStorageClass("class-1", "foo.bar/baz")
+	class.Parameters = map[string]string{paramTargets: "target-2,target-3"}
+	other := newStorageClass("class-2", "other.bar/baz")
+	other.Parameters = map[string]string{paramTargets: "unused"}
+	for _, c := range []*storage.StorageClass{class, other} {
+		if err := ctrl.classes.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"promoted", "source", "target", "target-2", "target-3"}
+	if remotes := ctrl.probedRemotes(); !reflect.DeepEqual(remotes, expected) {
+		t.Errorf("expected remotes %v, got %v", expected, remotes)
+	}
+}
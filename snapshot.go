@@ -0,0 +1,426 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/sync"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	klog "k8s.io/klog/v2"
+)
+
+// The resources of the Kubernetes snapshot API.
+var (
+	VolumeSnapshotResource        = schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshots"}
+	VolumeSnapshotContentResource = schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshotcontents"}
+	VolumeSnapshotClassResource   = schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshotclasses"}
+)
+
+const (
+	// snapshotsDir is the directory next to the volumes on a target that
+	// holds the snapshots, one directory per VolumeSnapshotContent.
+	snapshotsDir = ".csiraid-snapshots"
+	// snapshotPeriod is how often the cached VolumeSnapshots and
+	// VolumeSnapshotContents are checked.
+	snapshotPeriod = 5 * time.Second
+	// contentPrefix is the prefix of the names of the VolumeSnapshotContents
+	// created by the provisioner. It differs from the one of the snapshot
+	// controller of Kubernetes, which creates the contents of the other
+	// drivers.
+	contentPrefix = "csiraid-snapcontent-"
+	// finalizerSnapshotContent keeps a VolumeSnapshotContent until its copy
+	// on the remote has been deleted.
+	finalizerSnapshotContent = "csiraid.io/snapshot-cleanup"
+)
+
+// snapshotter takes the VolumeSnapshots of the volumes of a provisioner: it
+// copies the replica of the volume on its first target within that remote
+// and records the copy in a VolumeSnapshotContent. The copy is deleted with
+// the VolumeSnapshotContent, which is deleted with the VolumeSnapshot if its
+// deletion policy is Delete.
+type snapshotter struct {
+	client     dynamic.Interface
+	kubeClient kubernetes.Interface
+	// driver is the driver of the VolumeSnapshotClasses of the provisioner,
+	// its name.
+	driver      string
+	syncManager *SyncManager
+	// targets returns the remotes holding a replica of a volume.
+	targets  func(*v1.PersistentVolume) []string
+	recorder record.EventRecorder
+	// informers cache the objects of the snapshot API, which are checked
+	// from the cache.
+	informers                    dynamicinformer.DynamicSharedInformerFactory
+	snapshots, contents, classes cache.SharedIndexInformer
+}
+
+func newSnapshotter(client dynamic.Interface, kubeClient kubernetes.Interface, driver string, syncManager *SyncManager,
+	targets func(*v1.PersistentVolume) []string, recorder record.EventRecorder) *snapshotter {
+	informers := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	return &snapshotter{
+		client:      client,
+		kubeClient:  kubeClient,
+		driver:      driver,
+		syncManager: syncManager,
+		targets:     targets,
+		recorder:    recorder,
+		informers:   informers,
+		snapshots:   informers.ForResource(VolumeSnapshotResource).Informer(),
+		contents:    informers.ForResource(VolumeSnapshotContentResource).Informer(),
+		classes:     informers.ForResource(VolumeSnapshotClassResource).Informer(),
+	}
+}
+
+// start starts the informers and waits until their caches are synced.
+func (s *snapshotter) start(ctx context.Context) bool {
+	s.informers.Start(ctx.Done())
+	return cache.WaitForCacheSync(ctx.Done(), s.snapshots.HasSynced, s.contents.HasSynced, s.classes.HasSynced)
+}
+
+// run takes and deletes snapshots until ctx is done. It is a no-op on a nil
+// snapshotter.
+func (s *snapshotter) run(ctx context.Context) {
+	if s == nil || !s.start(ctx) {
+		return
+	}
+	ticker := time.NewTicker(snapshotPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sync(ctx)
+		}
+	}
+}
+
+// sync takes the pending snapshots of the VolumeSnapshotClasses of the
+// driver and deletes the copies of the deleted ones. The objects are read
+// from the caches of the informers, which are not modified.
+func (s *snapshotter) sync(ctx context.Context) {
+	classes := map[string]*unstructured.Unstructured{}
+	for _, obj := range s.classes.GetStore().List() {
+		class := obj.(*unstructured.Unstructured)
+		if driver, _, _ := unstructured.NestedString(class.Object, "driver"); driver == s.driver {
+			classes[class.GetName()] = class
+		}
+	}
+	if len(classes) > 0 {
+		for _, obj := range s.snapshots.GetStore().List() {
+			snapshot := obj.(*unstructured.Unstructured)
+			className, _, _ := unstructured.NestedString(snapshot.Object, "spec", "volumeSnapshotClassName")
+			class, ok := classes[className]
+			if !ok {
+				continue
+			}
+			if err := s.syncSnapshot(ctx, snapshot, class); err != nil {
+				klog.Infof("VolumeSnapshot %s/%s: %v", snapshot.GetNamespace(), snapshot.GetName(), err)
+				s.recorder.Event(snapshot, v1.EventTypeWarning, "SnapshotFailed", err.Error())
+				s.setSnapshotError(ctx, snapshot, err)
+			}
+		}
+	}
+	for _, obj := range s.contents.GetStore().List() {
+		content := obj.(*unstructured.Unstructured)
+		if err := s.syncContent(ctx, content); err != nil {
+			klog.Infof("VolumeSnapshotContent %s: %v", content.GetName(), err)
+		}
+	}
+}
+
+// syncSnapshot takes a VolumeSnapshot of class, a VolumeSnapshotClass of the
+// driver, that is not ready yet.
+func (s *snapshotter) syncSnapshot(ctx context.Context, snapshot, class *unstructured.Unstructured) error {
+	claimName, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "persistentVolumeClaimName")
+	ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+	if claimName == "" || ready || snapshot.GetDeletionTimestamp() != nil {
+		return nil
+	}
+
+	// The content is read from the API server: the cache may not hold the
+	// one created by the last check yet.
+	contents := s.client.Resource(VolumeSnapshotContentResource)
+	contentName := contentPrefix + string(snapshot.GetUID())
+	content, err := contents.Get(ctx, contentName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		content, err = s.takeSnapshot(ctx, snapshot, claimName, class, contentName)
+	}
+	if err != nil {
+		return err
+	}
+	return s.bindSnapshot(ctx, snapshot, content)
+}
+
+// takeSnapshot copies the volume bound to the claim of snapshot and creates
+// the VolumeSnapshotContent recording the copy.
+func (s *snapshotter) takeSnapshot(ctx context.Context, snapshot *unstructured.Unstructured, claimName string,
+	class *unstructured.Unstructured, contentName string) (*unstructured.Unstructured, error) {
+	claim, err := s.kubeClient.CoreV1().PersistentVolumeClaims(snapshot.GetNamespace()).Get(ctx, claimName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if claim.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("claim %q is not bound", claimName)
+	}
+	volume, err := s.kubeClient.CoreV1().PersistentVolumes().Get(ctx, claim.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if volume.Spec.NFS == nil {
+		return nil, fmt.Errorf("volume %q is not an NFS volume", volume.Name)
+	}
+	targets := s.targets(volume)
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("volume %q has no replica", volume.Name)
+	}
+	handle := targets[0] + ":" + contentName
+	snapshotFs, err := newSnapshotFs(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.Infof("Taking snapshot %s/%s of volume %q on %s", snapshot.GetNamespace(), snapshot.GetName(), volume.Name, targets[0])
+	take := func(replica fs.Fs) error { return copyVolume(ctx, snapshotFs, replica) }
+	taken, err := s.syncManager.Snapshot(ctx, volume.Name, targets[0], take)
+	if err == ErrSyncJobNotFound {
+		// Without replication the replica is copied as it is.
+		taken = time.Now()
+		loadRcloneConfig()
+		var replica fs.Fs
+		if replica, err = newFsDirFromVolume(ctx, targets[0], volume.Spec.NFS.Path); err == nil {
+			err = take(replica)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy volume %q: %v", volume.Name, err)
+	}
+
+	deletionPolicy, _, _ := unstructured.NestedString(class.Object, "deletionPolicy")
+	content := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": VolumeSnapshotContentResource.GroupVersion().String(),
+		"kind":       "VolumeSnapshotContent",
+		"metadata": map[string]interface{}{
+			"name":       contentName,
+			"finalizers": []interface{}{finalizerSnapshotContent},
+		},
+		"spec": map[string]interface{}{
+			"driver":                  s.driver,
+			"deletionPolicy":          deletionPolicy,
+			"volumeSnapshotClassName": class.GetName(),
+			"source":                  map[string]interface{}{"snapshotHandle": handle},
+			"volumeSnapshotRef": map[string]interface{}{
+				"apiVersion": VolumeSnapshotResource.GroupVersion().String(),
+				"kind":       "VolumeSnapshot",
+				"namespace":  snapshot.GetNamespace(),
+				"name":       snapshot.GetName(),
+				"uid":        string(snapshot.GetUID()),
+			},
+		},
+	}}
+	contents := s.client.Resource(VolumeSnapshotContentResource)
+	if content, err = contents.Create(ctx, content, metav1.CreateOptions{}); err != nil {
+		return nil, err
+	}
+	// The status of a new object is ignored by the API server.
+	content.Object["status"] = map[string]interface{}{
+		"snapshotHandle": handle,
+		"creationTime":   taken.UnixNano(),
+		"readyToUse":     true,
+		"restoreSize":    volumeSize(volume),
+	}
+	if content, err = contents.UpdateStatus(ctx, content, metav1.UpdateOptions{}); err != nil {
+		return nil, err
+	}
+	s.recorder.Eventf(snapshot, v1.EventTypeNormal, "SnapshotCreated", "Copied volume %s as of %s on %s",
+		volume.Name, taken.UTC().Format(time.RFC3339), targets[0])
+	return content, nil
+}
+
+// bindSnapshot marks snapshot as ready with the status of its content.
+func (s *snapshotter) bindSnapshot(ctx context.Context, snapshot, content *unstructured.Unstructured) error {
+	ready, _, _ := unstructured.NestedBool(content.Object, "status", "readyToUse")
+	if !ready {
+		return nil
+	}
+	taken, _, _ := unstructured.NestedInt64(content.Object, "status", "creationTime")
+	size, _, _ := unstructured.NestedInt64(content.Object, "status", "restoreSize")
+	snapshot = snapshot.DeepCopy()
+	snapshot.Object["status"] = map[string]interface{}{
+		"boundVolumeSnapshotContentName": content.GetName(),
+		"creationTime":                   time.Unix(0, taken).UTC().Format(time.RFC3339),
+		"readyToUse":                     true,
+		"restoreSize":                    fmt.Sprint(size),
+	}
+	_, err := s.client.Resource(VolumeSnapshotResource).Namespace(snapshot.GetNamespace()).UpdateStatus(ctx, snapshot, metav1.UpdateOptions{})
+	return err
+}
+
+// setSnapshotError records err in the status of snapshot.
+func (s *snapshotter) setSnapshotError(ctx context.Context, snapshot *unstructured.Unstructured, err error) {
+	snapshot = snapshot.DeepCopy()
+	status, _, _ := unstructured.NestedMap(snapshot.Object, "status")
+	if status == nil {
+		status = map[string]interface{}{}
+	}
+	status["readyToUse"] = false
+	status["error"] = map[string]interface{}{
+		"message": err.Error(),
+		"time":    time.Now().UTC().Format(time.RFC3339),
+	}
+	snapshot.Object["status"] = status
+	if _, err := s.client.Resource(VolumeSnapshotResource).Namespace(snapshot.GetNamespace()).UpdateStatus(ctx, snapshot, metav1.UpdateOptions{}); err != nil {
+		klog.Infof("Failed to update VolumeSnapshot %s/%s: %v", snapshot.GetNamespace(), snapshot.GetName(), err)
+	}
+}
+
+// syncContent deletes the copy of a VolumeSnapshotContent of the provisioner
+// that is being deleted, or that belongs to a deleted VolumeSnapshot and is
+// to be deleted with it.
+func (s *snapshotter) syncContent(ctx context.Context, content *unstructured.Unstructured) error {
+	driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver")
+	handle, _, _ := unstructured.NestedString(content.Object, "status", "snapshotHandle")
+	if driver != s.driver || !hasFinalizer(content, finalizerSnapshotContent) {
+		return nil
+	}
+	contents := s.client.Resource(VolumeSnapshotContentResource)
+	deletionPolicy, _, _ := unstructured.NestedString(content.Object, "spec", "deletionPolicy")
+	if content.GetDeletionTimestamp() == nil {
+		namespace, _, _ := unstructured.NestedString(content.Object, "spec", "volumeSnapshotRef", "namespace")
+		name, _, _ := unstructured.NestedString(content.Object, "spec", "volumeSnapshotRef", "name")
+		uid, _, _ := unstructured.NestedString(content.Object, "spec", "volumeSnapshotRef", "uid")
+		snapshot, err := s.client.Resource(VolumeSnapshotResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		switch {
+		case err != nil && !apierrs.IsNotFound(err):
+			return err
+		case err == nil && string(snapshot.GetUID()) == uid, deletionPolicy != "Delete":
+			return nil
+		}
+	}
+
+	if deletionPolicy == "Delete" && handle != "" {
+		if err := deleteSnapshot(ctx, handle); err != nil {
+			return fmt.Errorf("failed to delete snapshot %s: %v", handle, err)
+		}
+		klog.Infof("Deleted snapshot %s", handle)
+	}
+	content = content.DeepCopy()
+	var finalizers []string
+	for _, finalizer := range content.GetFinalizers() {
+		if finalizer != finalizerSnapshotContent {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	content.SetFinalizers(finalizers)
+	content, err := contents.Update(ctx, content, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	if content.GetDeletionTimestamp() == nil {
+		err = contents.Delete(ctx, content.GetName(), metav1.DeleteOptions{})
+		if apierrs.IsNotFound(err) {
+			err = nil
+		}
+	}
+	return err
+}
+
+func hasFinalizer(obj metav1.Object, finalizer string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// volumeSize returns the capacity of volume in bytes.
+func volumeSize(volume *v1.PersistentVolume) int64 {
+	capacity := volume.Spec.Capacity[v1.ResourceStorage]
+	return capacity.Value()
+}
+
+// snapshotPath returns the path of the snapshot with the given handle,
+// "remote:name".
+func snapshotPath(handle string) (string, error) {
+	i := strings.Index(handle, ":")
+	if i <= 0 || i == len(handle)-1 || strings.Contains(handle[i+1:], "/") {
+		return "", fmt.Errorf("invalid snapshot handle %q", handle)
+	}
+	remote, name := handle[:i], handle[i+1:]
+	loadRcloneConfig()
+	root, _ := config.Data().GetValue(remote, "path")
+	return remote + ":" + path.Join(root, snapshotsDir, name), nil
+}
+
+func newSnapshotFs(ctx context.Context, handle string) (fs.Fs, error) {
+	p, err := snapshotPath(handle)
+	if err != nil {
+		return nil, err
+	}
+	return fs.NewFs(ctx, p)
+}
+
+// copyVolume makes the files of the volume at the root of dst those of src,
+// using server-side copies where the remote supports them. The replication
+// state is not copied.
+func copyVolume(ctx context.Context, dst, src fs.Fs) error {
+	fi, err := FilterSpec{}.newFilter(true)
+	if err != nil {
+		return err
+	}
+	ctx = filter.ReplaceConfig(ctx, fi)
+	// The copy is accounted on its own: the IO errors of other transfers
+	// must not keep it from deleting, nor its own those of others.
+	ctx = accounting.WithStatsGroup(ctx, "csiraid-copy-"+fs.ConfigString(dst))
+	accounting.Stats(ctx).ResetCounters()
+	if err := operations.Mkdir(ctx, dst, ""); err != nil {
+		return err
+	}
+	return sync.Sync(ctx, dst, src, true)
+}
+
+// deleteSnapshot deletes the snapshot with the given handle.
+func deleteSnapshot(ctx context.Context, handle string) error {
+	f, err := newSnapshotFs(ctx, handle)
+	if err != nil {
+		return err
+	}
+	if _, err := f.List(ctx, ""); err == fs.ErrorDirNotFound {
+		return nil
+	}
+	return operations.Purge(ctx, f, "")
+}
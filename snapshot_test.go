@@ -0,0 +1,180 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSnapshotter(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "abc", time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewSyncManager("test", nil)
+	defer m.Shutdown(time.Second)
+	if err := m.Start(SyncJobSpec{
+		VolumeName:      "pv-1",
+		Source:          "source",
+		Target:          "target",
+		Directory:       "/export/vol-1",
+		MinSyncInterval: time.Hour,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	kubeClient := fake.NewSimpleClientset(
+		&v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "claim-1"},
+			Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-1"},
+		},
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+			Spec: v1.PersistentVolumeSpec{
+				Capacity:               v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+				PersistentVolumeSource: v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Path: "/export/vol-1"}},
+			},
+		})
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion":     "snapshot.storage.k8s.io/v1",
+			"kind":           "VolumeSnapshotClass",
+			"metadata":       map[string]interface{}{"name": "class-1"},
+			"driver":         "csiraid.io/test",
+			"deletionPolicy": "Delete",
+		}},
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "snapshot.storage.k8s.io/v1",
+			"kind":       "VolumeSnapshot",
+			"metadata":   map[string]interface{}{"namespace": "default", "name": "snap-1", "uid": "uid-1"},
+			"spec": map[string]interface{}{
+				"volumeSnapshotClassName": "class-1",
+				"source":                  map[string]interface{}{"persistentVolumeClaimName": "claim-1"},
+			},
+		}})
+	targets := func(*v1.PersistentVolume) []string { return []string{"target"} }
+	s := newSnapshotter(client, kubeClient, "csiraid.io/test", m, targets, record.NewFakeRecorder(10))
+	if !s.start(ctx) {
+		t.Fatal("caches not synced")
+	}
+
+	s.sync(ctx)
+	copied := filepath.Join(targetRoot, snapshotsDir, "csiraid-snapcontent-uid-1", "a")
+	if data, _ := ioutil.ReadFile(copied); string(data) != "abc" {
+		t.Fatalf("expected snapshot to hold the volume but got %q", data)
+	}
+	snapshot, err := client.Resource(VolumeSnapshotResource).Namespace("default").Get(ctx, "snap-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+	bound, _, _ := unstructured.NestedString(snapshot.Object, "status", "boundVolumeSnapshotContentName")
+	size, _, _ := unstructured.NestedString(snapshot.Object, "status", "restoreSize")
+	if !ready || bound != "csiraid-snapcontent-uid-1" || size != "1073741824" {
+		t.Errorf("unexpected snapshot status %v", snapshot.Object["status"])
+	}
+	content, err := client.Resource(VolumeSnapshotContentResource).Get(ctx, bound, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handle, _, _ := unstructured.NestedString(content.Object, "status", "snapshotHandle"); handle != "target:csiraid-snapcontent-uid-1" {
+		t.Errorf("unexpected snapshot handle %q", handle)
+	}
+
+	// The snapshot does not change with the volume.
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "changed", time.Now())
+	s.sync(ctx)
+	if data, _ := ioutil.ReadFile(copied); string(data) != "abc" {
+		t.Errorf("expected snapshot to be immutable but got %q", data)
+	}
+
+	if err := client.Resource(VolumeSnapshotResource).Namespace("default").Delete(ctx, "snap-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForCache(t, s.snapshots, 0)
+	waitForCache(t, s.contents, 1)
+	s.sync(ctx)
+	if exists(filepath.Dir(copied)) {
+		t.Error("expected snapshot to be deleted with the VolumeSnapshot")
+	}
+	if _, err := client.Resource(VolumeSnapshotContentResource).Get(ctx, bound, metav1.GetOptions{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected VolumeSnapshotContent to be deleted but got %v", err)
+	}
+}
+
+func TestSnapshotPath(t *testing.T) {
+	testRemotes(t)
+	if _, err := snapshotPath("target"); err == nil {
+		t.Error("expected handle without name to be rejected")
+	}
+	if _, err := snapshotPath("target:../vol-1"); err == nil {
+		t.Error("expected handle with path to be rejected")
+	}
+}
+
+// waitForCache waits until the cache of informer holds n objects.
+func waitForCache(t *testing.T, informer cache.SharedIndexInformer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(informer.GetStore().List()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d cached objects but got %d", n, len(informer.GetStore().List()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSnapshotOfUnsyncedReplica(t *testing.T) {
+	testRemotes(t)
+	job, err := newSyncJob(context.Background(), SyncJobSpec{
+		VolumeName: "pv-unsynced",
+		Source:     "source",
+		Target:     "target",
+		Directory:  "/export/vol-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.setState(SyncJobPaused)
+	m := NewSyncManager("test", nil)
+	defer m.Shutdown(time.Second)
+	m.volumes[job.spec.VolumeName] = &replicaSet{spec: job.spec, jobs: []*syncJob{job}}
+	taken := false
+	if _, err := m.Snapshot(context.Background(), job.spec.VolumeName, "target", func(fs.Fs) error {
+		taken = true
+		return nil
+	}); err == nil || taken {
+		t.Errorf("expected a paused replica that never synced not to be copied, got %v", err)
+	}
+}
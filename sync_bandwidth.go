@@ -0,0 +1,364 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"golang.org/x/time/rate"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// bandwidthRebalanceInterval is how often the bandwidth is shared anew
+	// between the volumes transferring data.
+	bandwidthRebalanceInterval = time.Second
+	// bandwidthBurst is the most bytes read at once from a throttled object.
+	bandwidthBurst = 256 * 1024
+)
+
+// parseBandwidth parses a bandwidth limit: a size per second such as "10M",
+// "off" for no limit, or a timetable of limits by time of day in the rclone
+// --bwlimit format, e.g. "08:00,512k 19:00,off". Upload and download limits
+// cannot differ, all data read by a replication counts.
+func parseBandwidth(value string) (fs.BwTimetable, error) {
+	var timetable fs.BwTimetable
+	if err := timetable.Set(value); err != nil {
+		return nil, err
+	}
+	for _, slot := range timetable {
+		if slot.Bandwidth.Tx != slot.Bandwidth.Rx {
+			return nil, fmt.Errorf("separate upload and download limits are not supported")
+		}
+	}
+	return timetable, nil
+}
+
+// bandwidthAt returns the limit of timetable at t in bytes per second,
+// +Inf for no limit.
+func bandwidthAt(timetable fs.BwTimetable, t time.Time) float64 {
+	limit := timetable.LimitAt(t).Bandwidth
+	if !limit.IsSet() {
+		return math.Inf(1)
+	}
+	return float64(limit.Tx)
+}
+
+// bandwidthScheduler shares the bandwidth of the controller between the
+// volumes by weight. Only volumes that transferred data since the last
+// rebalance get a share, a share above the limit of a volume is shared by
+// the others.
+type bandwidthScheduler struct {
+	lock    sync.Mutex
+	limit   fs.BwTimetable
+	volumes map[string]*volumeBandwidth
+}
+
+// volumeBandwidth limits the rate at which the replication of a volume reads
+// data.
+type volumeBandwidth struct {
+	limit   fs.BwTimetable
+	weight  int
+	limiter *rate.Limiter
+	// read counts the bytes read since the last rebalance.
+	read int64
+}
+
+func newBandwidthScheduler() *bandwidthScheduler {
+	return &bandwidthScheduler{volumes: map[string]*volumeBandwidth{}}
+}
+
+// setLimit sets the bandwidth of the controller.
+func (s *bandwidthScheduler) setLimit(limit fs.BwTimetable) {
+	s.lock.Lock()
+	s.limit = limit
+	s.lock.Unlock()
+	s.rebalance(time.Now())
+}
+
+// register adds a volume with its own limit and weight. Returns nil if
+// neither the controller nor the volume is limited.
+func (s *bandwidthScheduler) register(volumeName string, limit fs.BwTimetable, weight int) *volumeBandwidth {
+	s.lock.Lock()
+	if len(s.limit) == 0 && len(limit) == 0 {
+		s.lock.Unlock()
+		return nil
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	v := &volumeBandwidth{
+		limit:   limit,
+		weight:  weight,
+		limiter: rate.NewLimiter(rate.Inf, bandwidthBurst),
+	}
+	s.volumes[volumeName] = v
+	s.lock.Unlock()
+	s.rebalance(time.Now())
+	return v
+}
+
+// unregister removes a volume.
+func (s *bandwidthScheduler) unregister(volumeName string) {
+	s.lock.Lock()
+	delete(s.volumes, volumeName)
+	s.lock.Unlock()
+}
+
+// run rebalances the bandwidth until ctx is done.
+func (s *bandwidthScheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(bandwidthRebalanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.rebalance(now)
+		}
+	}
+}
+
+// rebalance shares the bandwidth at now between the active volumes. An idle
+// volume is limited to the share it would get if it became active.
+func (s *bandwidthScheduler) rebalance(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	total := bandwidthAt(s.limit, now)
+	var active, idle []*volumeBandwidth
+	for _, v := range s.volumes {
+		if atomic.SwapInt64(&v.read, 0) > 0 {
+			active = append(active, v)
+		} else {
+			idle = append(idle, v)
+		}
+	}
+	shares := fairShares(total, active, now)
+	for i, v := range active {
+		v.setRate(shares[i])
+	}
+	for _, v := range idle {
+		shares := fairShares(total, append(active[:len(active):len(active)], v), now)
+		v.setRate(shares[len(shares)-1])
+	}
+}
+
+// fairShares shares total between volumes by weight, giving no volume more
+// than its limit at now. Returns the share of each volume.
+func fairShares(total float64, volumes []*volumeBandwidth, now time.Time) []float64 {
+	shares := make([]float64, len(volumes))
+	pending := make([]int, len(volumes))
+	for i := range volumes {
+		pending[i] = i
+	}
+	// Volumes limited below their fair share get their limit, the rest is
+	// shared again by the others.
+	sort.Slice(pending, func(a, b int) bool {
+		va, vb := volumes[pending[a]], volumes[pending[b]]
+		return bandwidthAt(va.limit, now)/float64(va.weight) < bandwidthAt(vb.limit, now)/float64(vb.weight)
+	})
+	weights := 0
+	for _, v := range volumes {
+		weights += v.weight
+	}
+	for _, i := range pending {
+		v := volumes[i]
+		fair := total * float64(v.weight) / float64(weights)
+		if limit := bandwidthAt(v.limit, now); limit < fair {
+			fair = limit
+		}
+		shares[i] = fair
+		if !math.IsInf(total, 1) {
+			total -= fair
+		}
+		weights -= v.weight
+	}
+	return shares
+}
+
+func (v *volumeBandwidth) setRate(bytesPerSecond float64) {
+	limit := rate.Inf
+	if !math.IsInf(bytesPerSecond, 1) {
+		limit = rate.Limit(bytesPerSecond)
+	}
+	if v.limiter.Limit() != limit {
+		klog.V(5).Infof("Bandwidth limited to %v bytes/s", limit)
+		v.limiter.SetLimit(limit)
+	}
+}
+
+// wait accounts n bytes read and blocks until they are within the limit.
+func (v *volumeBandwidth) wait(ctx context.Context, n int) error {
+	atomic.AddInt64(&v.read, int64(n))
+	return v.limiter.WaitN(ctx, n)
+}
+
+// throttledFs limits the rate at which objects of the wrapped file system
+// are read. Writes are limited by the reads of the data written.
+type throttledFs struct {
+	fs.Fs
+	bandwidth *volumeBandwidth
+	features  *fs.Features
+}
+
+// newThrottledFs wraps f, returning f itself if bandwidth is nil.
+func newThrottledFs(f fs.Fs, bandwidth *volumeBandwidth) fs.Fs {
+	if bandwidth == nil || f == nil {
+		return f
+	}
+	t := &throttledFs{Fs: f, bandwidth: bandwidth}
+	inner := f.Features()
+	features := *inner
+	features.Copy, features.Move, features.DirMove, features.ListR, features.PutStream = nil, nil, nil, nil, nil
+	features.PutUnchecked, features.MergeDirs, features.SetWrapper = nil, nil, nil
+	features.UnWrap = func() fs.Fs { return f }
+	features.WrapFs = func() fs.Fs { return t }
+	if inner.Copy != nil {
+		features.Copy = func(ctx context.Context, src fs.Object, remote string) (fs.Object, error) {
+			return t.wrap(inner.Copy(ctx, unwrapObject(src), remote))
+		}
+	}
+	if inner.Move != nil {
+		features.Move = func(ctx context.Context, src fs.Object, remote string) (fs.Object, error) {
+			return t.wrap(inner.Move(ctx, unwrapObject(src), remote))
+		}
+	}
+	if inner.DirMove != nil {
+		features.DirMove = func(ctx context.Context, src fs.Fs, srcRemote, dstRemote string) error {
+			if ts, ok := src.(*throttledFs); ok {
+				src = ts.Fs
+			}
+			return inner.DirMove(ctx, src, srcRemote, dstRemote)
+		}
+	}
+	if inner.ListR != nil {
+		features.ListR = func(ctx context.Context, dir string, callback fs.ListRCallback) error {
+			return inner.ListR(ctx, dir, func(entries fs.DirEntries) error {
+				return callback(t.wrapEntries(entries))
+			})
+		}
+	}
+	if inner.PutStream != nil {
+		features.PutStream = func(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+			return t.wrap(inner.PutStream(ctx, in, src, options...))
+		}
+	}
+	t.features = &features
+	return t
+}
+
+// Features returns the optional features of the wrapped file system.
+func (t *throttledFs) Features() *fs.Features {
+	return t.features
+}
+
+// List lists the wrapped file system.
+func (t *throttledFs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
+	entries, err := t.Fs.List(ctx, dir)
+	return t.wrapEntries(entries), err
+}
+
+// NewObject finds an object of the wrapped file system.
+func (t *throttledFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	return t.wrap(t.Fs.NewObject(ctx, remote))
+}
+
+// Put writes an object to the wrapped file system.
+func (t *throttledFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	return t.wrap(t.Fs.Put(ctx, in, src, options...))
+}
+
+func (t *throttledFs) wrap(obj fs.Object, err error) (fs.Object, error) {
+	if obj == nil {
+		return nil, err
+	}
+	return &throttledObject{Object: obj, f: t}, err
+}
+
+func (t *throttledFs) wrapEntries(entries fs.DirEntries) fs.DirEntries {
+	for i, entry := range entries {
+		if obj, ok := entry.(fs.Object); ok {
+			entries[i] = &throttledObject{Object: obj, f: t}
+		}
+	}
+	return entries
+}
+
+// throttledObject is an object of a throttledFs.
+type throttledObject struct {
+	fs.Object
+	f *throttledFs
+}
+
+// Fs returns the throttledFs of the object.
+func (o *throttledObject) Fs() fs.Info {
+	return o.f
+}
+
+// UnWrap returns the wrapped object.
+func (o *throttledObject) UnWrap() fs.Object {
+	return o.Object
+}
+
+// Open opens the wrapped object for reading at the rate of the volume.
+func (o *throttledObject) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
+	in, err := o.Object.Open(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledReader{ReadCloser: in, ctx: ctx, bandwidth: o.f.bandwidth}, nil
+}
+
+func unwrapObject(obj fs.Object) fs.Object {
+	if o, ok := obj.(*throttledObject); ok {
+		return o.Object
+	}
+	return obj
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	ctx       context.Context
+	bandwidth *volumeBandwidth
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthBurst {
+		p = p[:bandwidthBurst]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := r.bandwidth.wait(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+var (
+	_ fs.Fs              = (*throttledFs)(nil)
+	_ fs.Object          = (*throttledObject)(nil)
+	_ fs.ObjectUnWrapper = (*throttledObject)(nil)
+)
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+func TestFairShares(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	limited := func(value string) fs.BwTimetable {
+		timetable, err := parseBandwidth(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return timetable
+	}
+	tests := []struct {
+		name     string
+		total    float64
+		volumes  []*volumeBandwidth
+		expected []float64
+	}{
+		{
+			name:     "by weight",
+			total:    400,
+			volumes:  []*volumeBandwidth{{weight: 1}, {weight: 3}},
+			expected: []float64{100, 300},
+		},
+		{
+			name:     "share above limit is shared by the others",
+			total:    4000,
+			volumes:  []*volumeBandwidth{{weight: 1}, {weight: 1, limit: limited("1k")}, {weight: 1}},
+			expected: []float64{1488, 1024, 1488},
+		},
+		{
+			name:     "limit by time of day",
+			total:    math.Inf(1),
+			volumes:  []*volumeBandwidth{{weight: 1, limit: limited("08:00,1k 18:00,off")}, {weight: 1}},
+			expected: []float64{1024, math.Inf(1)},
+		},
+		{
+			name:     "no limit",
+			total:    math.Inf(1),
+			volumes:  []*volumeBandwidth{{weight: 1}, {weight: 2}},
+			expected: []float64{math.Inf(1), math.Inf(1)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shares := fairShares(test.total, test.volumes, now)
+			for i := range shares {
+				if shares[i] != test.expected[i] {
+					t.Errorf("expected shares %v but got %v", test.expected, shares)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestApplyBandwidthParameters(t *testing.T) {
+	var spec SyncJobSpec
+	if err := applySyncParameters(&spec, map[string]string{"bandwidthLimit": "10M", "bandwidthPriority": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.BandwidthLimit) != 1 || spec.BandwidthLimit[0].Bandwidth.Tx != 10*1024*1024 || spec.BandwidthPriority != 2 {
+		t.Errorf("unexpected bandwidth %v priority %d", spec.BandwidthLimit, spec.BandwidthPriority)
+	}
+	if err := applyClaimAnnotations(&spec, map[string]string{annBandwidthPriority: "5"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.BandwidthLimit) != 1 || spec.BandwidthPriority != 5 {
+		t.Errorf("expected annotation to override priority only but got %v priority %d", spec.BandwidthLimit, spec.BandwidthPriority)
+	}
+	for _, parameters := range []map[string]string{
+		{"bandwidthLimit": "10M:1M"},
+		{"bandwidthLimit": "fast"},
+		{"bandwidthPriority": "0"},
+	} {
+		if err := applySyncParameters(&SyncJobSpec{}, parameters); err == nil {
+			t.Errorf("expected %v to be rejected", parameters)
+		}
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	data := make([]byte, 3*bandwidthBurst)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), string(data), time.Now())
+
+	m := NewSyncManager("test", nil)
+	defer m.Shutdown(time.Second)
+	limit, err := parseBandwidth("512k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetBandwidthLimit(limit)
+	start := time.Now()
+	if err := m.Start(SyncJobSpec{
+		VolumeName:      "pv-1",
+		Source:          "source",
+		Target:          "target",
+		Directory:       "/export/vol-1",
+		MinSyncInterval: 10 * time.Millisecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(targetRoot, "vol-1", "a")
+	waitForFile(t, target, 10*time.Second)
+	for {
+		if info, err := os.Stat(target); err == nil && info.Size() == int64(len(data)) {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("transfer did not finish within 10s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The burst is read at once, the rest at 512k/s.
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected transfer to be throttled but it took %v", elapsed)
+	}
+}
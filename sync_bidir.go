@@ -0,0 +1,373 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/walk"
+	v1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// bidirListingFile returns the name of the object in the stateDir of the
+// source holding the listings of the source and target after the last
+// two-way pass to target.
+func bidirListingFile(target string) string {
+	return stateDir + "/listing-" + target + ".json"
+}
+
+// bidirFile is what a two-way pass compares of a file.
+type bidirFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// bidirListing is the content of a listing object: the files of both remotes
+// by path relative to the volume root.
+type bidirListing struct {
+	Source map[string]bidirFile `json:"source"`
+	Target map[string]bidirFile `json:"target"`
+}
+
+// bidirAction is what a two-way pass does with a file.
+type bidirAction int
+
+const (
+	bidirNone bidirAction = iota
+	bidirCopyToTarget
+	bidirCopyToSource
+	bidirDeleteFromTarget
+	bidirDeleteFromSource
+	// bidirKeepBoth renames the older version on its remote and copies both
+	// versions to the other remote.
+	bidirKeepBoth
+)
+
+// bidirSide is the state of a file on one remote in a two-way pass.
+type bidirSide struct {
+	// exists tells whether the file exists now, changed whether it has been
+	// created, modified or deleted since the last pass.
+	exists  bool
+	changed bool
+	modTime time.Time
+}
+
+// decideBidirectional decides what a two-way pass does with a file. same
+// tells whether the file exists on both remotes with the same size and
+// modification time.
+func decideBidirectional(policy ConflictPolicy, source, target bidirSide, same bool) bidirAction {
+	switch {
+	case same, !source.changed && !target.changed:
+		return bidirNone
+	case source.changed && !target.changed:
+		if source.exists {
+			return bidirCopyToTarget
+		}
+		if target.exists {
+			return bidirDeleteFromTarget
+		}
+		return bidirNone
+	case target.changed && !source.changed:
+		if target.exists {
+			return bidirCopyToSource
+		}
+		if source.exists {
+			return bidirDeleteFromSource
+		}
+		return bidirNone
+	}
+
+	// Changed on both remotes.
+	switch {
+	case !source.exists && !target.exists:
+		return bidirNone
+	case policy == ConflictPolicySourceWins:
+		if source.exists {
+			return bidirCopyToTarget
+		}
+		return bidirDeleteFromTarget
+	case policy == ConflictPolicyTargetWins:
+		if target.exists {
+			return bidirCopyToSource
+		}
+		return bidirDeleteFromSource
+	case !source.exists:
+		return bidirCopyToSource
+	case !target.exists:
+		return bidirCopyToTarget
+	case policy == ConflictPolicyKeepBoth:
+		return bidirKeepBoth
+	case target.modTime.After(source.modTime):
+		return bidirCopyToSource
+	default:
+		return bidirCopyToTarget
+	}
+}
+
+// conflictName returns the name the version of remote from side is kept
+// under when both versions are kept.
+func conflictName(remote, side string, t time.Time) string {
+	ext := path.Ext(remote)
+	return fmt.Sprintf("%s.conflict-%s-%s%s", strings.TrimSuffix(remote, ext), side, t.UTC().Format("20060102T150405Z"), ext)
+}
+
+// syncBidirectional propagates the changes made on either remote since the
+// last two-way pass to the other remote, resolving files changed on both by
+// the conflict policy of the job. ctx is the context of the pass.
+//
+// Without the listing of a previous pass, e.g. on the first pass or after
+// the source has been wiped, both remotes are merged: nothing is deleted.
+// Only files are compared, empty directories are not replicated.
+func (j *syncJob) syncBidirectional(ctx context.Context) error {
+	if j.listing == nil {
+		listing := &bidirListing{}
+		found, err := readStateFile(j.transferCtx, j.fsrc, bidirListingFile(j.spec.Target), listing)
+		if err != nil {
+			return err
+		}
+		if found {
+			j.listing = listing
+		}
+	}
+	sources, err := listFiles(ctx, j.fsrc)
+	if err != nil {
+		return err
+	}
+	targets, err := listFiles(ctx, j.fdst)
+	if err != nil {
+		return err
+	}
+
+	prior := j.listing
+	if prior != nil && len(targets) == 0 && len(prior.Target) > 0 {
+		state, err := readReplicationState(j.transferCtx, j.fdst)
+		if err != nil {
+			return err
+		}
+		if state == nil {
+			j.event(v1.EventTypeNormal, "RecoveryStarted", "Target %s is empty and has no replication state, restoring it from %s", j.fdst, j.fsrc)
+			prior = nil
+		}
+	}
+
+	remotes := make([]string, 0, len(sources)+len(targets))
+	for remote := range sources {
+		remotes = append(remotes, remote)
+	}
+	for remote := range targets {
+		if _, ok := sources[remote]; !ok {
+			remotes = append(remotes, remote)
+		}
+	}
+	sort.Strings(remotes)
+
+	type bidirStep struct {
+		remote                   string
+		action                   bidirAction
+		src, dst                 fs.Object
+		priorSource, priorTarget *bidirFile
+	}
+	window := fs.GetModifyWindow(ctx, j.fsrc, j.fdst)
+	steps := make([]bidirStep, 0, len(remotes))
+	var sourceDeletions, targetDeletions deletionCount
+	for _, remote := range remotes {
+		src, dst := sources[remote], targets[remote]
+		var priorSource, priorTarget *bidirFile
+		if prior != nil {
+			if f, ok := prior.Source[remote]; ok {
+				priorSource = &f
+			}
+			if f, ok := prior.Target[remote]; ok {
+				priorTarget = &f
+			}
+		}
+		source := bidirSide{exists: src != nil, changed: src != nil}
+		if src != nil {
+			source.modTime = src.ModTime(ctx)
+		}
+		target := bidirSide{exists: dst != nil, changed: dst != nil}
+		if dst != nil {
+			target.modTime = dst.ModTime(ctx)
+		}
+		if prior != nil {
+			source.changed = fileChanged(ctx, src, priorSource, window)
+			target.changed = fileChanged(ctx, dst, priorTarget, window)
+		}
+		same := src != nil && dst != nil && !fileChanged(ctx, dst, fileOf(ctx, src), window)
+
+		action := decideBidirectional(j.spec.ConflictPolicy, source, target, same)
+		if source.changed && target.changed && !same && (source.exists || target.exists) {
+			j.event(v1.EventTypeWarning, "ReplicationConflict", "%s changed on both %s and %s, resolving by %s", remote, j.fsrc, j.fdst, j.spec.ConflictPolicy)
+		}
+		if src != nil {
+			sourceDeletions.add(src, action == bidirDeleteFromSource)
+		}
+		if dst != nil {
+			targetDeletions.add(dst, action == bidirDeleteFromTarget)
+		}
+		steps = append(steps, bidirStep{remote, action, src, dst, priorSource, priorTarget})
+	}
+	if err := j.brake(j.fsrc, sourceDeletions); err != nil {
+		return err
+	}
+	if err := j.brake(j.fdst, targetDeletions); err != nil {
+		return err
+	}
+
+	next := &bidirListing{Source: map[string]bidirFile{}, Target: map[string]bidirFile{}}
+	actions, failed := 0, 0
+	for _, step := range steps {
+		remote, action, priorSource, priorTarget := step.remote, step.action, step.priorSource, step.priorTarget
+		if action != bidirNone {
+			actions++
+		}
+		if err := j.applyBidirectional(ctx, action, remote, step.src, step.dst, next); err != nil {
+			failed++
+			klog.Infof("Volume %q: failed to replicate %s: %v", j.spec.VolumeName, remote, err)
+			// Keep the previous state so that the change is seen again by
+			// the next pass.
+			delete(next.Source, remote)
+			delete(next.Target, remote)
+			if priorSource != nil {
+				next.Source[remote] = *priorSource
+			}
+			if priorTarget != nil {
+				next.Target[remote] = *priorTarget
+			}
+		}
+	}
+
+	if actions > 0 || j.listing == nil {
+		if err := writeStateFile(j.transferCtx, j.fsrc, bidirListingFile(j.spec.Target), next, time.Now()); err != nil {
+			return err
+		}
+	}
+	j.listing = next
+	if failed > 0 {
+		return fmt.Errorf("failed to replicate %d of %d files", failed, len(remotes))
+	}
+	return nil
+}
+
+// applyBidirectional carries out action for the file remote, present as src
+// on the source and dst on the target, and records the resulting files in
+// next.
+func (j *syncJob) applyBidirectional(ctx context.Context, action bidirAction, remote string, src, dst fs.Object, next *bidirListing) error {
+	record := func(listing map[string]bidirFile, obj fs.Object) {
+		if obj != nil {
+			listing[obj.Remote()] = *fileOf(ctx, obj)
+		}
+	}
+	var err error
+	switch action {
+	case bidirNone:
+		record(next.Source, src)
+		record(next.Target, dst)
+	case bidirCopyToTarget:
+		klog.V(4).Infof("Volume %q: copying %s to %s", j.spec.VolumeName, remote, j.fdst)
+		record(next.Source, src)
+		if dst != nil && j.versions != nil {
+			if err = operations.MoveBackupDir(ctx, j.versions, dst); err != nil {
+				return err
+			}
+			dst = nil
+		}
+		dst, err = operations.Copy(ctx, j.fdst, dst, remote, src)
+		record(next.Target, dst)
+	case bidirCopyToSource:
+		klog.V(4).Infof("Volume %q: copying %s to %s", j.spec.VolumeName, remote, j.fsrc)
+		record(next.Target, dst)
+		src, err = operations.Copy(ctx, j.fsrc, src, remote, dst)
+		record(next.Source, src)
+	case bidirDeleteFromTarget:
+		klog.V(4).Infof("Volume %q: deleting %s from %s", j.spec.VolumeName, remote, j.fdst)
+		err = operations.DeleteFileWithBackupDir(ctx, dst, j.versions)
+	case bidirDeleteFromSource:
+		klog.V(4).Infof("Volume %q: deleting %s from %s", j.spec.VolumeName, remote, j.fsrc)
+		err = operations.DeleteFile(ctx, src)
+	case bidirKeepBoth:
+		// The newer version keeps the name, the source wins a tie.
+		winnerFs, winner, winnerListing := j.fsrc, src, next.Source
+		loserFs, loser, loserListing, loserSide := j.fdst, dst, next.Target, "target"
+		if dst.ModTime(ctx).After(src.ModTime(ctx)) {
+			winnerFs, winner, winnerListing = j.fdst, dst, next.Target
+			loserFs, loser, loserListing, loserSide = j.fsrc, src, next.Source, "source"
+		}
+		renamed := conflictName(remote, loserSide, loser.ModTime(ctx))
+		klog.Infof("Volume %q: keeping the %s version of %s as %s", j.spec.VolumeName, loserSide, remote, renamed)
+		if loser, err = operations.Move(ctx, loserFs, nil, renamed, loser); err != nil {
+			return err
+		}
+		record(loserListing, loser)
+		var copied fs.Object
+		if copied, err = operations.Copy(ctx, winnerFs, nil, renamed, loser); err != nil {
+			return err
+		}
+		record(winnerListing, copied)
+		record(winnerListing, winner)
+		copied, err = operations.Copy(ctx, loserFs, nil, remote, winner)
+		record(loserListing, copied)
+	}
+	return err
+}
+
+// listFiles returns the files below the root of f by path. A directory that
+// does not exist yet is empty. The filter of ctx applies.
+func listFiles(ctx context.Context, f fs.Fs) (map[string]fs.Object, error) {
+	files := map[string]fs.Object{}
+	err := walk.ListR(ctx, f, "", true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		entries.ForObject(func(obj fs.Object) {
+			if !isStateFile(obj.Remote()) {
+				files[obj.Remote()] = obj
+			}
+		})
+		return nil
+	})
+	if err == fs.ErrorDirNotFound {
+		return files, nil
+	}
+	return files, err
+}
+
+func fileOf(ctx context.Context, obj fs.Object) *bidirFile {
+	return &bidirFile{Size: obj.Size(), ModTime: obj.ModTime(ctx)}
+}
+
+// fileChanged tells whether obj differs from the file previously seen,
+// comparing size and modification time within window. A nil obj or file
+// does not exist.
+func fileChanged(ctx context.Context, obj fs.Object, file *bidirFile, window time.Duration) bool {
+	if obj == nil || file == nil {
+		return obj != nil || file != nil
+	}
+	if obj.Size() != file.Size {
+		return true
+	}
+	if window == fs.ModTimeNotSupported {
+		return false
+	}
+	dt := obj.ModTime(ctx).Sub(file.ModTime)
+	return dt > window || dt < -window
+}
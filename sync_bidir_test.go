@@ -0,0 +1,137 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecideBidirectional(t *testing.T) {
+	older := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	unchanged := bidirSide{exists: true, modTime: older}
+	modifiedOlder := bidirSide{exists: true, changed: true, modTime: older}
+	modifiedNewer := bidirSide{exists: true, changed: true, modTime: newer}
+	deleted := bidirSide{changed: true}
+
+	tests := []struct {
+		name     string
+		policy   ConflictPolicy
+		source   bidirSide
+		target   bidirSide
+		same     bool
+		expected bidirAction
+	}{
+		{"unchanged", ConflictPolicyNewerWins, unchanged, unchanged, true, bidirNone},
+		{"modified on source", ConflictPolicyNewerWins, modifiedOlder, unchanged, false, bidirCopyToTarget},
+		{"modified on target", ConflictPolicyNewerWins, unchanged, modifiedOlder, false, bidirCopyToSource},
+		{"deleted on source", ConflictPolicyNewerWins, deleted, unchanged, false, bidirDeleteFromTarget},
+		{"deleted on target", ConflictPolicyNewerWins, unchanged, deleted, false, bidirDeleteFromSource},
+		{"deleted on both", ConflictPolicyNewerWins, deleted, deleted, false, bidirNone},
+		{"same change on both", ConflictPolicySourceWins, modifiedOlder, modifiedOlder, true, bidirNone},
+		{"newer wins target", ConflictPolicyNewerWins, modifiedOlder, modifiedNewer, false, bidirCopyToSource},
+		{"newer wins source", ConflictPolicyNewerWins, modifiedNewer, modifiedOlder, false, bidirCopyToTarget},
+		{"newer wins over deletion", ConflictPolicyNewerWins, deleted, modifiedOlder, false, bidirCopyToSource},
+		{"source wins", ConflictPolicySourceWins, modifiedOlder, modifiedNewer, false, bidirCopyToTarget},
+		{"source wins with deletion", ConflictPolicySourceWins, deleted, modifiedNewer, false, bidirDeleteFromTarget},
+		{"target wins", ConflictPolicyTargetWins, modifiedNewer, modifiedOlder, false, bidirCopyToSource},
+		{"target wins with deletion", ConflictPolicyTargetWins, modifiedNewer, deleted, false, bidirDeleteFromSource},
+		{"keep both", ConflictPolicyKeepBoth, modifiedNewer, modifiedOlder, false, bidirKeepBoth},
+		{"keep both with deletion", ConflictPolicyKeepBoth, modifiedNewer, deleted, false, bidirCopyToTarget},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if action := decideBidirectional(test.policy, test.source, test.target, test.same); action != test.expected {
+				t.Errorf("expected action %d but got %d", test.expected, action)
+			}
+		})
+	}
+}
+
+func TestSyncBidirectional(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	sourceDir := filepath.Join(sourceRoot, "vol-1")
+	targetDir := filepath.Join(targetRoot, "vol-1")
+	writeFile(t, filepath.Join(sourceDir, "a"), "a", time.Now())
+	writeFile(t, filepath.Join(targetDir, "b"), "b", time.Now())
+
+	job := newTestSyncJob(t, SyncJobSpec{
+		VolumeName:     "pv-1",
+		Direction:      SyncDirectionTwoWay,
+		ConflictPolicy: ConflictPolicyKeepBoth,
+	})
+	pass := func() {
+		job.syncPass()
+		if status := job.status(); status.LastError != "" {
+			t.Fatalf("unexpected error: %s", status.LastError)
+		}
+	}
+
+	// The first pass merges both remotes.
+	pass()
+	for _, path := range []string{filepath.Join(sourceDir, "b"), filepath.Join(targetDir, "a")} {
+		if !exists(path) {
+			t.Fatalf("expected %s after merge", path)
+		}
+	}
+
+	// Deletions are replicated in both directions.
+	removeAll(t, filepath.Join(sourceDir, "a"))
+	removeAll(t, filepath.Join(targetDir, "b"))
+	writeFile(t, filepath.Join(targetDir, "c"), "c", time.Now())
+	pass()
+	if exists(filepath.Join(targetDir, "a")) || exists(filepath.Join(sourceDir, "b")) {
+		t.Error("expected deletions to be replicated")
+	}
+	if !exists(filepath.Join(sourceDir, "c")) {
+		t.Error("expected c to be copied to the source")
+	}
+
+	// A conflict keeps both versions.
+	modTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeFile(t, filepath.Join(sourceDir, "c"), "source", modTime.Add(time.Hour))
+	writeFile(t, filepath.Join(targetDir, "c"), "target", modTime)
+	pass()
+	renamed := conflictName("c", "target", modTime)
+	for _, dir := range []string{sourceDir, targetDir} {
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, "c")); string(data) != "source" {
+			t.Errorf("expected newer version of c in %s but got %q", dir, data)
+		}
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, renamed)); string(data) != "target" {
+			t.Errorf("expected older version as %s in %s but got %q", renamed, dir, data)
+		}
+	}
+	if exists(filepath.Join(targetDir, bidirListingFile("target"))) {
+		t.Error("expected listing not to be replicated")
+	}
+}
+
+func writeFile(t *testing.T, path, content string, modTime time.Time) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	v1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// DeletionBrake bounds the files a replication pass may delete on either
+// remote. A pass that would delete more is not run and the replica is
+// frozen until the deletion is acknowledged, see SyncManager.AcknowledgeDeletion.
+type DeletionBrake struct {
+	// MaxFiles is the most files a pass may delete, 0 for no bound.
+	MaxFiles int
+	// MaxFilesPercent and MaxBytesPercent are the most files and bytes a
+	// pass may delete in percent of the files and bytes of the remote they
+	// are deleted from, 0 for no bound.
+	MaxFilesPercent float64
+	MaxBytesPercent float64
+}
+
+// enabled tells whether the brake bounds anything.
+func (b DeletionBrake) enabled() bool {
+	return b.MaxFiles > 0 || b.MaxFilesPercent > 0 || b.MaxBytesPercent > 0
+}
+
+// exceeded tells whether deleting files of bytes out of totalFiles of
+// totalBytes is more than the brake allows.
+func (b DeletionBrake) exceeded(files, totalFiles int, bytes, totalBytes int64) bool {
+	switch {
+	case files == 0:
+		return false
+	case b.MaxFiles > 0 && files > b.MaxFiles:
+		return true
+	case b.MaxFilesPercent > 0 && totalFiles > 0 && float64(files)*100/float64(totalFiles) > b.MaxFilesPercent:
+		return true
+	case b.MaxBytesPercent > 0 && totalBytes > 0 && float64(bytes)*100/float64(totalBytes) > b.MaxBytesPercent:
+		return true
+	}
+	return false
+}
+
+// DeletionHold is a replication pass held back by the deletion brake.
+type DeletionHold struct {
+	Time time.Time
+	// Remote is the file system the pass would have deleted files of.
+	Remote     string
+	Files      int
+	TotalFiles int
+	Bytes      int64
+	TotalBytes int64
+	// Token acknowledges the deletion when set as the value of the
+	// annDeletionAcknowledged annotation of the claim.
+	Token string
+	// Acknowledged tells whether the next pass may delete the files.
+	Acknowledged bool
+}
+
+// errDeletionHeld fails the passes of a replica frozen by the deletion brake.
+var errDeletionHeld = fmt.Errorf("replication frozen by the deletion brake")
+
+// deletionCount sums the files a pass would delete from one remote.
+type deletionCount struct {
+	files      int
+	totalFiles int
+	bytes      int64
+	totalBytes int64
+}
+
+func (c *deletionCount) add(obj fs.Object, deleted bool) {
+	c.totalFiles++
+	c.totalBytes += obj.Size()
+	if deleted {
+		c.files++
+		c.bytes += obj.Size()
+	}
+}
+
+// countMirrorDeletions counts the files of the target that a one-way pass
+// deletes: those missing on the source. The filter of ctx applies.
+func countMirrorDeletions(ctx context.Context, fsrc, fdst fs.Fs) (deletionCount, error) {
+	var count deletionCount
+	sources, err := listFiles(ctx, fsrc)
+	if err != nil {
+		return count, err
+	}
+	targets, err := listFiles(ctx, fdst)
+	if err != nil {
+		return count, err
+	}
+	for remote, obj := range targets {
+		_, ok := sources[remote]
+		count.add(obj, !ok)
+	}
+	return count, nil
+}
+
+// countDeletions counts the files of f that deleting the files remotes
+// deletes. The filter of ctx applies.
+func countDeletions(ctx context.Context, f fs.Fs, remotes []string) (deletionCount, error) {
+	var count deletionCount
+	files, err := listFiles(ctx, f)
+	if err != nil {
+		return count, err
+	}
+	deleted := map[string]bool{}
+	for _, remote := range remotes {
+		deleted[remote] = true
+	}
+	fi := filter.GetConfig(ctx)
+	for remote, obj := range files {
+		if includedEntry(ctx, fi, obj) {
+			count.add(obj, deleted[remote])
+		}
+	}
+	return count, nil
+}
+
+// deletionHeld tells whether the replica is frozen by the deletion brake.
+// An acknowledged hold is released. Only called by the job loop.
+func (j *syncJob) deletionHeld() bool {
+	j.acknowledged = false
+	j.lock.Lock()
+	hold := j.hold
+	if hold != nil && hold.Acknowledged {
+		j.hold = nil
+	}
+	j.lock.Unlock()
+	if hold == nil {
+		return false
+	}
+	if !hold.Acknowledged {
+		klog.V(4).Infof("Volume %q: replication to %s frozen by the deletion brake since %v", j.spec.VolumeName, j.spec.Target, hold.Time)
+		return true
+	}
+	SM.DeletionBrakeEngaged.WithLabelValues(j.metricLabels()...).Set(0)
+	j.event(v1.EventTypeNormal, "DeletionAcknowledged", "Deleting %d files of %s as acknowledged", hold.Files, hold.Remote)
+	j.acknowledged = true
+	return false
+}
+
+// brake engages the deletion brake if a pass would delete more files of f
+// than allowed. Returns errDeletionHeld if it did. A pass following an
+// acknowledgement is not braked.
+func (j *syncJob) brake(f fs.Fs, count deletionCount) error {
+	if j.acknowledged || !j.spec.DeletionBrake.exceeded(count.files, count.totalFiles, count.bytes, count.totalBytes) {
+		return nil
+	}
+	return j.holdDeletion(f, count)
+}
+
+// holdDeletion freezes the replica until deleting the files of count from f
+// is acknowledged. Returns errDeletionHeld.
+func (j *syncJob) holdDeletion(f fs.Fs, count deletionCount) error {
+	now := time.Now()
+	hold := &DeletionHold{
+		Time:       now,
+		Remote:     f.String(),
+		Files:      count.files,
+		TotalFiles: count.totalFiles,
+		Bytes:      count.bytes,
+		TotalBytes: count.totalBytes,
+		Token:      now.UTC().Format("20060102T150405Z"),
+	}
+	j.lock.Lock()
+	j.hold = hold
+	j.lock.Unlock()
+	SM.DeletionBrakeEngaged.WithLabelValues(j.metricLabels()...).Set(1)
+	SM.DeletionBrakeEngagementsTotal.WithLabelValues(j.metricLabels()...).Inc()
+	j.event(v1.EventTypeWarning, "DeletionBrakeEngaged",
+		"Replication would delete %d of %d files (%s of %s) of %s, replication to %s is frozen. Annotate the claim with %s=%s to proceed",
+		hold.Files, hold.TotalFiles, fs.SizeSuffix(hold.Bytes), fs.SizeSuffix(hold.TotalBytes), hold.Remote, j.spec.Target,
+		annDeletionAcknowledged, hold.Token)
+	return errDeletionHeld
+}
+
+// brakeMirror engages the deletion brake if a one-way pass would delete too
+// many files of the target.
+func (j *syncJob) brakeMirror(ctx context.Context) error {
+	if !j.spec.DeletionBrake.enabled() || j.acknowledged {
+		return nil
+	}
+	count, err := countMirrorDeletions(ctx, j.fsrc, j.fdst)
+	if err != nil {
+		return err
+	}
+	return j.brake(j.fdst, count)
+}
+
+// acknowledge releases the hold of the replica with the given token at the
+// next pass. Returns false if the replica has no such hold.
+func (j *syncJob) acknowledge(token string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.hold == nil || j.hold.Token != token || j.hold.Acknowledged {
+		return false
+	}
+	hold := *j.hold
+	hold.Acknowledged = true
+	j.hold = &hold
+	return true
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestDeletionBrakeExceeded(t *testing.T) {
+	tests := []struct {
+		name     string
+		brake    DeletionBrake
+		files    int
+		bytes    int64
+		expected bool
+	}{
+		{name: "off", files: 100, bytes: 1000},
+		{name: "nothing deleted", brake: DeletionBrake{MaxFiles: 1}},
+		{name: "count", brake: DeletionBrake{MaxFiles: 5}, files: 6, expected: true},
+		{name: "count within", brake: DeletionBrake{MaxFiles: 5}, files: 5},
+		{name: "files percent", brake: DeletionBrake{MaxFilesPercent: 50}, files: 51, expected: true},
+		{name: "bytes percent", brake: DeletionBrake{MaxBytesPercent: 10}, files: 1, bytes: 200, expected: true},
+		{name: "bytes percent within", brake: DeletionBrake{MaxBytesPercent: 10}, files: 1, bytes: 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if exceeded := test.brake.exceeded(test.files, 100, test.bytes, 1000); exceeded != test.expected {
+				t.Errorf("expected exceeded %t", test.expected)
+			}
+		})
+	}
+}
+
+func TestDeletionBrake(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	for i := 0; i < 10; i++ {
+		writeFile(t, filepath.Join(sourceRoot, "vol-1", fmt.Sprintf("f%d", i)), "data", time.Now())
+	}
+	recorder := record.NewFakeRecorder(10)
+	job := newTestSyncJob(t, SyncJobSpec{
+		VolumeName:    "pv-brake",
+		DeletionBrake: DeletionBrake{MaxFilesPercent: 50},
+	})
+	job.recorder = recorder
+	labels := job.metricLabels()
+	if job.syncPass() {
+		t.Fatal("unexpected stop")
+	}
+	for i := 0; i < 8; i++ {
+		removeAll(t, filepath.Join(sourceRoot, "vol-1", fmt.Sprintf("f%d", i)))
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		if job.syncPass() {
+			t.Fatal("unexpected stop")
+		}
+		if !exists(filepath.Join(targetRoot, "vol-1", "f0")) {
+			t.Fatal("expected deletion to be held back")
+		}
+	}
+	hold := job.status().DeletionHold
+	if hold == nil || hold.Files != 8 || hold.TotalFiles != 10 {
+		t.Fatalf("unexpected hold %+v", hold)
+	}
+	if engaged := testutil.ToFloat64(SM.DeletionBrakeEngaged.WithLabelValues(labels...)); engaged != 1 {
+		t.Errorf("expected brake engaged metric but got %v", engaged)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "DeletionBrakeEngaged") || !strings.Contains(event, hold.Token) {
+			t.Errorf("unexpected event %q", event)
+		}
+	default:
+		t.Error("expected DeletionBrakeEngaged event")
+	}
+
+	if job.acknowledge("wrong") {
+		t.Error("expected acknowledgement with another token to be ignored")
+	}
+	if !job.acknowledge(hold.Token) {
+		t.Fatal("expected acknowledgement to release the hold")
+	}
+	if job.syncPass() {
+		t.Fatal("unexpected stop")
+	}
+	if exists(filepath.Join(targetRoot, "vol-1", "f0")) || !exists(filepath.Join(targetRoot, "vol-1", "f9")) {
+		t.Error("expected acknowledged deletion to be replicated")
+	}
+	if job.status().DeletionHold != nil || job.status().LastError != "" {
+		t.Errorf("expected replica to be released but got %+v", job.status())
+	}
+	if engaged := testutil.ToFloat64(SM.DeletionBrakeEngaged.WithLabelValues(labels...)); engaged != 0 {
+		t.Errorf("expected brake released metric but got %v", engaged)
+	}
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/operations"
+	v1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// checkpointFile is the checkpoint of an initial sync in the stateDir of the
+// target.
+const checkpointFile = stateDir + "/checkpoint.json"
+
+// An initial sync writes its checkpoint after every checkpointFiles files
+// or checkpointBytes bytes copied, whichever comes first.
+var (
+	checkpointFiles       = 1000
+	checkpointBytes int64 = 1 << 30
+)
+
+// initialSyncCheckpoint is the content of the checkpoint object. The files
+// of the source are copied in the order of their paths, so the last file
+// copied tells which are done.
+type initialSyncCheckpoint struct {
+	// Volume is the name of the PersistentVolume.
+	Volume string `json:"volume"`
+	// Cursor is the path of the last file copied, relative to the volume
+	// root.
+	Cursor string `json:"cursor"`
+	// StartTime is when the initial sync first started.
+	StartTime time.Time `json:"startTime"`
+	// Files and Bytes have been copied up to the cursor.
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// InitialSyncProgress is the progress of the first pass to a replica that
+// has never been synced. The pass copies the files of the source with
+// checkpoints and resumes after the last one when it is interrupted, e.g. by
+// a restart of the controller.
+type InitialSyncProgress struct {
+	// StartTime is when the initial sync first started, also if it has
+	// been resumed since.
+	StartTime time.Time
+	// Files and Bytes have been copied of TotalFiles and TotalBytes.
+	Files      int64
+	TotalFiles int64
+	Bytes      int64
+	TotalBytes int64
+	// ETA is the estimated time until the copy is complete at the rate of
+	// the current run, 0 until it can be estimated.
+	ETA time.Duration
+}
+
+// Percent returns the share of the volume that has been copied, by size.
+func (p *InitialSyncProgress) Percent() float64 {
+	var done float64
+	switch {
+	case p.TotalBytes > 0:
+		done = float64(p.Bytes) / float64(p.TotalBytes)
+	case p.TotalFiles > 0:
+		done = float64(p.Files) / float64(p.TotalFiles)
+	default:
+		return 100
+	}
+	if done > 1 {
+		done = 1
+	}
+	return 100 * done
+}
+
+// add returns the progress of p and q combined. The copies of both run in
+// parallel, so the combined ETA is the longer one.
+func (p *InitialSyncProgress) add(q *InitialSyncProgress) *InitialSyncProgress {
+	if p == nil {
+		return q
+	}
+	sum := *p
+	if q.StartTime.Before(sum.StartTime) {
+		sum.StartTime = q.StartTime
+	}
+	sum.Files += q.Files
+	sum.TotalFiles += q.TotalFiles
+	sum.Bytes += q.Bytes
+	sum.TotalBytes += q.TotalBytes
+	if q.ETA > sum.ETA {
+		sum.ETA = q.ETA
+	}
+	return &sum
+}
+
+// initialSyncPending tells whether the next pass of j may be an initial
+// sync: the target had no marker when it was last read, or the markers have
+// not been read since the job started or they were last written. Only
+// called by the job loop.
+func (j *syncJob) initialSyncPending() bool {
+	return !j.statesLoaded || j.targetState == nil
+}
+
+// initialSync copies the files of the source selected by the filter of ctx
+// to a target without marker, in the order of their paths, and writes a
+// checkpoint to the target after every batch. An interrupted initial sync
+// resumes after the last checkpoint. Files that already exist unchanged on
+// the target are not copied again. ctx is the context of the pass. It is a
+// no-op if the target has a marker: the pass replicates the changes only.
+//
+// A resumed initial sync skips the files up to the cursor by their paths
+// alone and counts them as the checkpoint recorded them: those changed or
+// deleted on the source since are reconciled by the sync of the pass that
+// follows.
+func (j *syncJob) initialSync(ctx context.Context) error {
+	if !j.loadReplicationStates() || j.targetState != nil {
+		return nil
+	}
+	checkpoint := &initialSyncCheckpoint{}
+	found, err := readStateFile(j.transferCtx, j.fdst, checkpointFile, checkpoint)
+	if err != nil {
+		return err
+	}
+	resumed := found && checkpoint.Volume == j.spec.VolumeName
+	if !resumed {
+		checkpoint = &initialSyncCheckpoint{Volume: j.spec.VolumeName, StartTime: time.Now()}
+	}
+
+	files, err := listFiles(ctx, j.fsrc)
+	if err != nil {
+		return err
+	}
+	fi := filter.GetConfig(ctx)
+	progress := &InitialSyncProgress{
+		StartTime:  checkpoint.StartTime,
+		Files:      checkpoint.Files,
+		TotalFiles: checkpoint.Files,
+		Bytes:      checkpoint.Bytes,
+		TotalBytes: checkpoint.Bytes,
+	}
+	var pending []string
+	for remote, obj := range files {
+		if !includedEntry(ctx, fi, obj) || resumed && remote <= checkpoint.Cursor {
+			continue
+		}
+		progress.TotalFiles++
+		progress.TotalBytes += obj.Size()
+		pending = append(pending, remote)
+	}
+	if len(pending) == 0 {
+		return j.removeCheckpoint()
+	}
+	sort.Strings(pending)
+	if resumed {
+		j.event(v1.EventTypeNormal, "InitialSyncResumed", "Resuming the initial sync to %s after %s, %d of %d files copied",
+			j.fdst, checkpoint.Cursor, progress.Files, progress.TotalFiles)
+	} else {
+		klog.Infof("Volume %q: initial sync copying %d files, %d bytes to %s", j.spec.VolumeName, progress.TotalFiles, progress.TotalBytes, j.fdst)
+	}
+	j.setInitialSync(progress)
+	defer j.setInitialSync(nil)
+
+	tracker := newProgressTracker(progress)
+	for start := 0; start < len(pending); {
+		end, size := start, int64(0)
+		for end < len(pending) && end-start < checkpointFiles && (end == start || size < checkpointBytes) {
+			size += files[pending[end]].Size()
+			end++
+		}
+		if err := j.copyFiles(ctx, files, pending[start:end], tracker); err != nil {
+			return err
+		}
+		copied := tracker.current()
+		checkpoint.Cursor, checkpoint.Files, checkpoint.Bytes = pending[end-1], copied.Files, copied.Bytes
+		if err := writeStateFile(j.transferCtx, j.fdst, checkpointFile, checkpoint, time.Now()); err != nil {
+			return err
+		}
+		klog.V(4).Infof("Volume %q: initial sync to %s checkpointed at %s", j.spec.VolumeName, j.fdst, checkpoint.Cursor)
+		j.replicas.reportStatus()
+		start = end
+	}
+	if err := j.removeCheckpoint(); err != nil {
+		return err
+	}
+	klog.Infof("Volume %q: initial sync copied %d files to %s in %v", j.spec.VolumeName, progress.TotalFiles, j.fdst,
+		time.Since(checkpoint.StartTime).Round(time.Second))
+	return nil
+}
+
+// copyFiles copies the given files of the source to the target, as many at
+// once as rclone transfers files.
+func (j *syncJob) copyFiles(ctx context.Context, files map[string]fs.Object, remotes []string, tracker *progressTracker) error {
+	work := make(chan string)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var firstErr error
+	for i := 0; i < fs.GetConfig(ctx).Transfers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for remote := range work {
+				err := operations.CopyFile(ctx, j.fdst, j.fsrc, remote, remote)
+				if err != nil {
+					lock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					lock.Unlock()
+					continue
+				}
+				j.setInitialSync(tracker.copied(files[remote].Size()))
+			}
+		}()
+	}
+	for _, remote := range remotes {
+		work <- remote
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+// removeCheckpoint removes the checkpoint of a complete initial sync.
+func (j *syncJob) removeCheckpoint() error {
+	obj, err := j.fdst.NewObject(j.transferCtx, checkpointFile)
+	if err == fs.ErrorObjectNotFound || err == fs.ErrorDirNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return obj.Remove(j.transferCtx)
+}
+
+// setInitialSync publishes the progress of the initial sync of the replica,
+// nil when none is running.
+func (j *syncJob) setInitialSync(progress *InitialSyncProgress) {
+	labels := j.metricLabels()
+	j.lock.Lock()
+	j.initialSyncProgress = progress
+	j.lock.Unlock()
+	if progress == nil {
+		SM.InitialSyncProgressRatio.DeleteLabelValues(labels...)
+		SM.InitialSyncETASeconds.DeleteLabelValues(labels...)
+		return
+	}
+	SM.InitialSyncProgressRatio.WithLabelValues(labels...).Set(progress.Percent() / 100)
+	SM.InitialSyncETASeconds.WithLabelValues(labels...).Set(progress.ETA.Seconds())
+}
+
+// progressTracker counts the files copied by an initial sync and estimates
+// the time until it is complete from the rate of the current run.
+type progressTracker struct {
+	lock     sync.Mutex
+	progress InitialSyncProgress
+	// start is when the current run began, startBytes how many bytes had
+	// been copied by then.
+	start      time.Time
+	startBytes int64
+}
+
+func newProgressTracker(progress *InitialSyncProgress) *progressTracker {
+	return &progressTracker{progress: *progress, start: time.Now(), startBytes: progress.Bytes}
+}
+
+// current returns the progress.
+func (t *progressTracker) current() InitialSyncProgress {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.progress
+}
+
+// copied counts a file of size bytes and returns the progress.
+func (t *progressTracker) copied(size int64) *InitialSyncProgress {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.progress.Files++
+	t.progress.Bytes += size
+	elapsed := time.Since(t.start)
+	if rate := float64(t.progress.Bytes-t.startBytes) / elapsed.Seconds(); rate > 0 && t.progress.TotalBytes > t.progress.Bytes {
+		t.progress.ETA = time.Duration(float64(t.progress.TotalBytes-t.progress.Bytes) / rate * float64(time.Second))
+	} else {
+		t.progress.ETA = 0
+	}
+	progress := t.progress
+	return &progress
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/record"
+)
+
+func TestInitialSyncProgressPercent(t *testing.T) {
+	tests := []struct {
+		name     string
+		progress InitialSyncProgress
+		expected float64
+	}{
+		{name: "by size", progress: InitialSyncProgress{Files: 1, TotalFiles: 4, Bytes: 30, TotalBytes: 40}, expected: 75},
+		{name: "empty files", progress: InitialSyncProgress{Files: 1, TotalFiles: 4}, expected: 25},
+		{name: "empty volume", expected: 100},
+		{name: "grown", progress: InitialSyncProgress{Bytes: 50, TotalBytes: 40}, expected: 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if percent := test.progress.Percent(); percent != test.expected {
+				t.Errorf("expected %v%% but got %v%%", test.expected, percent)
+			}
+		})
+	}
+}
+
+func TestInitialSyncCheckpoint(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		writeFile(t, filepath.Join(sourceRoot, "vol-1", name), name, time.Now())
+	}
+	// d cannot be copied over a directory: the second batch fails.
+	if err := os.MkdirAll(filepath.Join(targetRoot, "vol-1", "d", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(files int) { checkpointFiles = files }(checkpointFiles)
+	checkpointFiles = 2
+
+	job := newTestSyncJob(t, SyncJobSpec{
+		VolumeName: "pv-initial",
+	})
+	recorder := record.NewFakeRecorder(10)
+	job.recorder = recorder
+	ctx := context.Background()
+	if err := job.initialSync(ctx); err == nil {
+		t.Fatal("expected initial sync to fail")
+	}
+	checkpoint := &initialSyncCheckpoint{}
+	if found, err := readStateFile(ctx, job.fdst, checkpointFile, checkpoint); !found || err != nil {
+		t.Fatalf("expected checkpoint but got %v", err)
+	}
+	if checkpoint.Cursor != "b" || checkpoint.Volume != "pv-initial" || checkpoint.Files != 2 || checkpoint.Bytes != 2 {
+		t.Errorf("expected checkpoint after b but got %+v", checkpoint)
+	}
+	if job.status().InitialSync != nil {
+		t.Error("expected no progress after the initial sync stopped")
+	}
+
+	// The restarted initial sync skips the checkpointed files and counts
+	// them as checkpointed, also if they changed since.
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "changed", time.Now())
+	removeAll(t, filepath.Join(targetRoot, "vol-1", "d"))
+	removeAll(t, filepath.Join(targetRoot, "vol-1", "a"))
+	job.statesLoaded = false
+	if err := job.initialSync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(targetRoot, "vol-1", "a")) {
+		t.Error("expected checkpointed file not to be copied again")
+	}
+	for _, name := range []string{"b", "c", "d", "e"} {
+		if !exists(filepath.Join(targetRoot, "vol-1", name)) {
+			t.Errorf("expected %s to be copied", name)
+		}
+	}
+	if exists(filepath.Join(targetRoot, "vol-1", checkpointFile)) {
+		t.Error("expected checkpoint to be removed")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "InitialSyncResumed") || !strings.Contains(event, "2 of 5 files") {
+			t.Errorf("unexpected event %q", event)
+		}
+	default:
+		t.Error("expected InitialSyncResumed event")
+	}
+
+	// The pass replicates what the checkpoint skipped and ends the initial
+	// sync with the marker.
+	if job.syncPass() || job.status().LastError != "" {
+		t.Fatalf("pass failed: %+v", job.status())
+	}
+	if !exists(filepath.Join(targetRoot, "vol-1", "a")) || job.initialSyncPending() {
+		t.Error("expected the pass to complete the replica")
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/backend/compress"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+	klog "k8s.io/klog/v2"
+)
+
+// CompressionSpec stores the replicas of a volume compressed with the rclone
+// compress backend, e.g. on archive targets where storage is expensive. The
+// files are compressed with gzip on their way to the target and decompressed
+// when they are read back by recovery and scrubs, the source stays
+// uncompressed. Files that hardly compress are stored as they are.
+type CompressionSpec struct {
+	// Enabled compresses the replicas.
+	Enabled bool
+	// Level is the gzip level, 1 for the fastest to 9 for the best
+	// compression. 0 for the default of rclone.
+	Level int
+}
+
+// compressionCheckInterval is how often the compression ratio of a
+// compressed replica is measured.
+var compressionCheckInterval = time.Hour
+
+// compressTarget replaces the target of j with its compressed file system.
+// Its name differs from the one of the target, so that no object is ever
+// copied to it server side, uncompressed.
+func (j *syncJob) compressTarget(ctx context.Context) error {
+	plain := j.fdst
+	m := configmap.Simple{
+		"remote": fs.ConfigString(plain),
+		"mode":   "gzip",
+	}
+	if j.spec.Compression.Level != 0 {
+		m["level"] = strconv.Itoa(j.spec.Compression.Level)
+	}
+	// The options not set get the defaults of the backend, the level in
+	// particular would be 0 otherwise: stored uncompressed.
+	name := plain.Name() + "-compress"
+	info, err := fs.Find("compress")
+	if err != nil {
+		return err
+	}
+	f, err := compress.NewFs(ctx, name, "", fs.ConfigMap(info, name, m))
+	if err != nil {
+		return fmt.Errorf("volume %q: %v", j.spec.VolumeName, err)
+	}
+	j.plainTarget, j.fdst = plain, f
+	return nil
+}
+
+// compressionCheckDue tells whether the compression ratio of the replica is
+// to be measured after the current pass.
+func (j *syncJob) compressionCheckDue() bool {
+	return j.spec.Compression.Enabled && j.plainTarget != nil && time.Since(j.lastCompressionCheck) >= compressionCheckInterval
+}
+
+// measureCompression sets the compression ratio of the replica, the size of
+// its files divided by the size they take up on the target, including the
+// metadata the compress backend stores along. Only called by the job loop.
+func (j *syncJob) measureCompression() {
+	j.lastCompressionCheck = time.Now()
+	size, err := filesSize(j.transferCtx, j.fdst)
+	var stored int64
+	if err == nil {
+		stored, err = filesSize(j.transferCtx, j.plainTarget)
+	}
+	if err != nil {
+		klog.Infof("Volume %q: failed to measure the compression of %s: %v", j.spec.VolumeName, j.spec.Target, err)
+		return
+	}
+	if stored == 0 {
+		SM.CompressionRatio.DeleteLabelValues(j.metricLabels()...)
+		return
+	}
+	ratio := float64(size) / float64(stored)
+	klog.V(4).Infof("Volume %q: %d bytes stored in %d bytes on %s, ratio %.2f", j.spec.VolumeName, size, stored, j.spec.Target, ratio)
+	SM.CompressionRatio.WithLabelValues(j.metricLabels()...).Set(ratio)
+}
+
+// filesSize returns the total size of the files of f.
+func filesSize(ctx context.Context, f fs.Fs) (int64, error) {
+	files, err := listFiles(ctx, f)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, obj := range files {
+		size += obj.Size()
+	}
+	return size, nil
+}
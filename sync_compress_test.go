@@ -0,0 +1,91 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestApplyCompressionParameters(t *testing.T) {
+	spec := SyncJobSpec{}
+	if err := applySyncParameters(&spec, map[string]string{paramCompression: "true", paramCompressionLevel: "9"}); err != nil {
+		t.Fatal(err)
+	}
+	if !spec.Compression.Enabled || spec.Compression.Level != 9 {
+		t.Errorf("unexpected compression %+v", spec.Compression)
+	}
+	if err := applySyncParameters(&spec, map[string]string{paramCompressionLevel: "0"}); err == nil {
+		t.Error("expected level 0 to be rejected")
+	}
+	spec = SyncJobSpec{VolumeName: "pv-1", Source: "source", Target: "target", Compression: CompressionSpec{Enabled: true},
+		Encryption: EncryptionSpec{SecretName: "keys"}}
+	spec.setDefaults()
+	if err := spec.validate(); err == nil {
+		t.Error("expected compression of an encrypted volume to be rejected")
+	}
+}
+
+func TestCompressedReplica(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	content := strings.Repeat("compressible ", 10000)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "dir", "a"), content, time.Now())
+	job := newTestSyncJob(t, SyncJobSpec{
+		VolumeName:  "pv-compress",
+		Compression: CompressionSpec{Enabled: true},
+	})
+	if err := job.compressTarget(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	labels := job.metricLabels()
+	if job.syncPass() || job.status().LastError != "" {
+		t.Fatalf("pass failed: %+v", job.status())
+	}
+	if exists(filepath.Join(targetRoot, "vol-1", "dir", "a")) {
+		t.Error("expected replica to be compressed")
+	}
+	matches, err := filepath.Glob(filepath.Join(targetRoot, "vol-1", "dir", "a.*.gz"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("expected compressed file but got %v: %v", matches, err)
+	}
+
+	// The ratio covers the markers and the metadata of the compressed files.
+	ratio := testutil.ToFloat64(SM.CompressionRatio.WithLabelValues(labels...))
+	if ratio < 10 {
+		t.Errorf("expected the ratio of a highly compressible file but got %v", ratio)
+	}
+
+	// Scrubs compare the decompressed files.
+	if result := job.scrub(); result.diverged() || result.Error != "" {
+		t.Errorf("unexpected scrub result %+v", result)
+	}
+
+	// Recovery decompresses the replica.
+	removeAll(t, filepath.Join(sourceRoot, "vol-1"))
+	if job.syncPass() {
+		t.Fatal("unexpected stop")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(sourceRoot, "vol-1", "dir", "a")); err != nil || string(data) != content {
+		t.Fatalf("expected source to be restored uncompressed: %v", err)
+	}
+}
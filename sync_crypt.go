@@ -0,0 +1,366 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/backend/crypt"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/sync"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// EncryptionSpec encrypts the replicas of a volume with the rclone crypt
+// backend before they leave the cluster. File contents and names are
+// encrypted inside the volume directory on the targets, the source stays
+// unencrypted.
+type EncryptionSpec struct {
+	// SecretNamespace and SecretName reference the Secret holding the keys,
+	// see secretKeyPassword. The namespace defaults to the one of the claim.
+	SecretNamespace string
+	SecretName      string
+}
+
+// enabled tells whether the replicas are encrypted.
+func (spec EncryptionSpec) enabled() bool {
+	return spec.SecretName != ""
+}
+
+// Keys of the encryption Secret. The password is required, the salt is
+// optional. To rotate the keys, the former ones are moved to the previous
+// keys and new ones set: the replicas are re-encrypted in the background,
+// and a controller restarted in the meantime reads those not re-encrypted
+// yet with the previous keys and starts their re-encryption over. They can be removed once the rotation is
+// reported finished.
+const (
+	secretKeyPassword         = "password"
+	secretKeySalt             = "salt"
+	secretKeyPreviousPassword = "previousPassword"
+	secretKeyPreviousSalt     = "previousSalt"
+)
+
+// keyFile is the object in the volume directory on the target, outside of
+// the encrypted file system, recording the key the replica is encrypted
+// with.
+const keyFile = ".csiraid-key.json"
+
+// keyCheckInterval is how often the Secret of an encrypted volume is read
+// for rotated keys.
+var keyCheckInterval = 5 * time.Minute
+
+// keyRecord is the content of the key object.
+type keyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+}
+
+// secretReader returns the data of the Secret namespace/name.
+type secretReader func(ctx context.Context, namespace, name string) (map[string][]byte, error)
+
+// readSecret returns the data of the Secret namespace/name. It is the
+// Secret reader of the sync manager.
+func (ctrl *ProvisionController) readSecret(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	secret, err := ctrl.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// cryptKey is the password and salt a replica is encrypted with.
+type cryptKey struct {
+	password string
+	salt     string
+}
+
+// fingerprint identifies the key without revealing it.
+func (k cryptKey) fingerprint() string {
+	sum := sha256.Sum256([]byte(k.password + "\x00" + k.salt))
+	return hex.EncodeToString(sum[:8])
+}
+
+// String keeps the key out of logs.
+func (k cryptKey) String() string {
+	return "key " + k.fingerprint()
+}
+
+// encrypt returns the file system encrypting the files stored in f with the
+// key. The file systems of different keys have different names, so that no
+// object is ever copied between them server side, undecrypted.
+func (k cryptKey) encrypt(ctx context.Context, f fs.Fs) (fs.Fs, error) {
+	m := configmap.Simple{
+		"remote":                    fs.ConfigString(f),
+		"password":                  obscure.MustObscure(k.password),
+		"filename_encryption":       "standard",
+		"directory_name_encryption": "true",
+	}
+	if k.salt != "" {
+		m["password2"] = obscure.MustObscure(k.salt)
+	}
+	return crypt.NewFs(ctx, f.Name()+"-crypt-"+k.fingerprint(), "", m)
+}
+
+// readKeys returns the current key and the previous one, empty unless a
+// rotation is in progress, from the Secret of spec.
+func readKeys(ctx context.Context, read secretReader, spec SyncJobSpec) (cryptKey, cryptKey, error) {
+	namespace := spec.Encryption.SecretNamespace
+	if namespace == "" {
+		namespace = spec.ClaimNamespace
+	}
+	if read == nil {
+		return cryptKey{}, cryptKey{}, fmt.Errorf("volume %q: Secret %s/%s cannot be read", spec.VolumeName, namespace, spec.Encryption.SecretName)
+	}
+	data, err := read(ctx, namespace, spec.Encryption.SecretName)
+	if err != nil {
+		return cryptKey{}, cryptKey{}, fmt.Errorf("volume %q: encryption keys: %v", spec.VolumeName, err)
+	}
+	current := cryptKey{password: string(data[secretKeyPassword]), salt: string(data[secretKeySalt])}
+	if current.password == "" {
+		return cryptKey{}, cryptKey{}, fmt.Errorf("volume %q: Secret %s/%s has no %s", spec.VolumeName, namespace, spec.Encryption.SecretName, secretKeyPassword)
+	}
+	previous := cryptKey{password: string(data[secretKeyPreviousPassword]), salt: string(data[secretKeyPreviousSalt])}
+	return current, previous, nil
+}
+
+// encryptTarget replaces the target of j with its encrypted file system, of
+// the key recorded on the target or, for a replica without one, the current
+// key. A replica whose rotation was interrupted is read with the previous
+// key until the rotation resumes at the first key check.
+func (j *syncJob) encryptTarget(ctx context.Context, read secretReader) error {
+	current, previous, err := readKeys(ctx, read, j.spec)
+	if err != nil {
+		return err
+	}
+	plain := j.fdst
+	record := keyRecord{}
+	found, err := readStateFile(ctx, plain, keyFile, &record)
+	if err != nil {
+		return fmt.Errorf("volume %q: %v", j.spec.VolumeName, err)
+	}
+	key := current
+	switch {
+	case !found:
+		record.Fingerprint = current.fingerprint()
+		if err := writeStateFile(ctx, plain, keyFile, record, time.Now()); err != nil {
+			return fmt.Errorf("volume %q: %v", j.spec.VolumeName, err)
+		}
+	case record.Fingerprint == current.fingerprint():
+		if previous.password != "" && previous != current {
+			// The previous key may have left files behind.
+			j.staleKey = &previous
+		}
+	case previous.password != "" && record.Fingerprint == previous.fingerprint():
+		key = previous
+	default:
+		return fmt.Errorf("volume %q: replica on %s is encrypted with %s, which Secret %s does not hold",
+			j.spec.VolumeName, j.spec.Target, record.Fingerprint, j.spec.Encryption.SecretName)
+	}
+	f, err := key.encrypt(ctx, plain)
+	if err != nil {
+		return fmt.Errorf("volume %q: %v", j.spec.VolumeName, err)
+	}
+	j.plainTarget, j.key, j.fdst = plain, key, f
+	return nil
+}
+
+// KeyRotation is the progress of the re-encryption of a replica with a new
+// key. It runs in the background, the passes keep replicating with the
+// former key until it is finished.
+type KeyRotation struct {
+	StartTime time.Time
+	// Fingerprint identifies the new key.
+	Fingerprint string
+	// Files and Bytes have been re-encrypted so far.
+	Files int64
+	Bytes int64
+}
+
+// keyRotation is a re-encryption of the replica running in the background.
+// err is set before done is closed.
+type keyRotation struct {
+	start time.Time
+	key   cryptKey
+	to    fs.Fs
+	stats *accounting.StatsInfo
+	done  chan struct{}
+	err   error
+}
+
+// progress returns the progress of r, nil if r is.
+func (r *keyRotation) progress() *KeyRotation {
+	if r == nil {
+		return nil
+	}
+	return &KeyRotation{
+		StartTime:   r.start,
+		Fingerprint: r.key.fingerprint(),
+		Files:       r.stats.GetTransfers(),
+		Bytes:       r.stats.GetBytes(),
+	}
+}
+
+// keyCheckDue tells whether the Secret of an encrypted volume is to be read
+// for rotated keys, or a rotation is running, after the current pass.
+func (j *syncJob) keyCheckDue() bool {
+	return j.spec.Encryption.enabled() && j.plainTarget != nil &&
+		(j.rotation != nil || time.Since(j.lastKeyCheck) >= keyCheckInterval)
+}
+
+// checkKey starts re-encrypting the replica when the Secret holds a new key,
+// switches the replica to the new key once the re-encryption has finished,
+// and removes the files left behind by an interrupted rotation. Only called
+// by the job loop.
+func (j *syncJob) checkKey() {
+	if r := j.rotation; r != nil {
+		select {
+		case <-r.done:
+		default:
+			return
+		}
+		j.setRotation(nil)
+		if r.err == nil {
+			r.err = j.finishRotation(r)
+		}
+		if r.err != nil {
+			j.event(v1.EventTypeWarning, "KeyRotationFailed", "Failed to re-encrypt the replica on %s: %v", j.spec.Target, r.err)
+		}
+		return
+	}
+	j.lastKeyCheck = time.Now()
+	var read secretReader
+	if j.replicas != nil {
+		read = j.replicas.secretReader
+	}
+	current, _, err := readKeys(j.transferCtx, read, j.spec)
+	if err != nil {
+		klog.Infof("Volume %q: %v", j.spec.VolumeName, err)
+		return
+	}
+	if current != j.key {
+		if err := j.startRotation(current); err != nil {
+			j.event(v1.EventTypeWarning, "KeyRotationFailed", "Failed to re-encrypt the replica on %s: %v", j.spec.Target, err)
+		}
+		return
+	}
+	if j.staleKey != nil {
+		if err := j.removeEncrypted(*j.staleKey); err != nil {
+			klog.Infof("Volume %q: failed to remove the files encrypted with the previous key from %s: %v", j.spec.VolumeName, j.spec.Target, err)
+			return
+		}
+		j.staleKey = nil
+	}
+}
+
+// startRotation starts re-encrypting the replica with key in the
+// background: the files are copied from the file system of the current key
+// to the one of key, both stored in the same directory under different
+// encrypted names. The copy is accounted in a stats group of its own.
+func (j *syncJob) startRotation(key cryptKey) error {
+	to, err := key.encrypt(j.transferCtx, j.plainTarget)
+	if err != nil {
+		return err
+	}
+	r := &keyRotation{
+		start: time.Now(),
+		key:   key,
+		to:    newThrottledFs(to, j.bandwidth),
+		done:  make(chan struct{}),
+	}
+	ctx := accounting.WithStatsGroup(j.transferCtx, "csiraid-rotate-"+j.spec.VolumeName+"-"+j.spec.Target)
+	r.stats = accounting.Stats(ctx)
+	r.stats.ResetCounters()
+	from := j.fdst
+	run := j.goBackground
+	if run == nil {
+		run = func(f func(context.Context)) bool {
+			go f(ctx)
+			return true
+		}
+	}
+	// The markers are copied along: the replica stays as current as it
+	// was, the passes replicate what changes in the meantime after the
+	// switch.
+	started := run(func(context.Context) {
+		defer close(r.done)
+		r.err = sync.CopyDir(ctx, r.to, from, false)
+	})
+	if !started {
+		return fmt.Errorf("volume %q: replication is shut down", j.spec.VolumeName)
+	}
+	j.setRotation(r)
+	j.event(v1.EventTypeNormal, "KeyRotationStarted", "Re-encrypting the replica on %s with the current key of Secret %s",
+		j.spec.Target, j.spec.Encryption.SecretName)
+	return nil
+}
+
+// finishRotation switches the replica to the key of the finished rotation
+// r and removes the files encrypted with the former key.
+func (j *syncJob) finishRotation(r *keyRotation) error {
+	ctx := j.transferCtx
+	// The replica is read with the new key from here on, also after a
+	// restart.
+	if err := writeStateFile(ctx, j.plainTarget, keyFile, keyRecord{Fingerprint: r.key.fingerprint()}, time.Now()); err != nil {
+		return err
+	}
+	former := j.key
+	unlock := j.lockSource()
+	j.lock.Lock()
+	j.fdst, j.key = r.to, r.key
+	j.lock.Unlock()
+	unlock()
+	j.statesLoaded = false
+
+	if err := j.removeEncrypted(former); err != nil {
+		j.staleKey = &former
+		return fmt.Errorf("failed to remove the files encrypted with the previous key: %v", err)
+	}
+	j.event(v1.EventTypeNormal, "KeyRotationFinished", "Re-encrypted %d files of the replica on %s, the previous key can be removed from Secret %s once all replicas are",
+		r.stats.GetTransfers(), j.spec.Target, j.spec.Encryption.SecretName)
+	return nil
+}
+
+// setRotation publishes the rotation running in the background, nil when
+// it is over.
+func (j *syncJob) setRotation(r *keyRotation) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.rotation = r
+}
+
+// removeEncrypted removes the files of the replica encrypted with key, the
+// only ones whose names it decrypts.
+func (j *syncJob) removeEncrypted(key cryptKey) error {
+	ctx := j.transferCtx
+	f, err := key.encrypt(ctx, j.plainTarget)
+	if err != nil {
+		return err
+	}
+	if err := operations.Delete(ctx, f); err != nil {
+		return err
+	}
+	return operations.Rmdirs(ctx, f, "", true)
+}
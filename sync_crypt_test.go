@@ -0,0 +1,142 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApplyEncryptionParameters(t *testing.T) {
+	spec := SyncJobSpec{}
+	if err := applySyncParameters(&spec, map[string]string{paramEncryptionSecretName: "keys"}); err != nil {
+		t.Fatal(err)
+	}
+	if !spec.Encryption.enabled() || spec.Encryption.SecretNamespace != "" {
+		t.Errorf("unexpected encryption %+v", spec.Encryption)
+	}
+	if err := applySyncParameters(&spec, map[string]string{paramEncryptionSecretNamespace: "kube-system"}); err == nil {
+		t.Error("expected namespace without name to be rejected")
+	}
+	spec = SyncJobSpec{VolumeName: "pv-1", Source: "source", Target: "target", Encryption: EncryptionSpec{SecretName: "keys"},
+		Versioning: VersioningSpec{Enabled: true}}
+	spec.setDefaults()
+	if err := spec.validate(); err == nil {
+		t.Error("expected versioning of an encrypted volume to be rejected")
+	}
+}
+
+// testSecret returns a Secret reader returning the data of *secret for
+// default/keys.
+func testSecret(secret *map[string][]byte) secretReader {
+	return func(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+		if namespace != "default" || name != "keys" {
+			return nil, fmt.Errorf("secret %s/%s not found", namespace, name)
+		}
+		return *secret, nil
+	}
+}
+
+func TestEncryptedReplica(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "dir", "a"), "secret data", time.Now())
+	secret := map[string][]byte{secretKeyPassword: []byte("first"), secretKeySalt: []byte("salt")}
+	spec := SyncJobSpec{VolumeName: "pv-crypt", Encryption: EncryptionSpec{SecretName: "keys"}}
+	newJob := func() *syncJob {
+		job := newTestSyncJob(t, spec)
+		if err := job.encryptTarget(context.Background(), testSecret(&secret)); err != nil {
+			t.Fatal(err)
+		}
+		job.replicas = &replicaSet{spec: job.spec, jobs: []*syncJob{job}, secretReader: testSecret(&secret)}
+		job.lastKeyCheck = time.Now()
+		return job
+	}
+	job := newJob()
+	if job.syncPass() || job.status().LastError != "" {
+		t.Fatalf("pass failed: %+v", job.status())
+	}
+	if exists(filepath.Join(targetRoot, "vol-1", "dir", "a")) || !exists(filepath.Join(targetRoot, "vol-1", keyFile)) {
+		t.Fatal("expected replica to be encrypted")
+	}
+
+	// Recovery decrypts the replica.
+	removeAll(t, filepath.Join(sourceRoot, "vol-1"))
+	if job.syncPass() {
+		t.Fatal("unexpected stop")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(sourceRoot, "vol-1", "dir", "a")); err != nil || string(data) != "secret data" {
+		t.Fatalf("expected source to be restored in plain text but got %q: %v", data, err)
+	}
+
+	// Rotate the key.
+	first := job.key
+	secret = map[string][]byte{
+		secretKeyPassword: []byte("second"), secretKeyPreviousPassword: []byte("first"), secretKeyPreviousSalt: []byte("salt"),
+	}
+	job.lastKeyCheck = time.Time{}
+	if job.syncPass() || job.status().LastError != "" {
+		t.Fatalf("pass failed: %+v", job.status())
+	}
+	// The re-encryption runs in the background, the passes keep the
+	// former key until it is finished.
+	if job.key != first || job.status().KeyRotation == nil {
+		t.Fatalf("expected rotation in the background but got %+v", job.status().KeyRotation)
+	}
+	<-job.rotation.done
+	if rotation := job.status().KeyRotation; rotation == nil || rotation.Files == 0 {
+		t.Errorf("expected progress of the rotation but got %+v", rotation)
+	}
+	// Replicated with the former key, before the switch.
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "b"), "written during the rotation", time.Now())
+	if job.syncPass() || job.status().LastError != "" {
+		t.Fatalf("pass failed: %+v", job.status())
+	}
+	if job.key == first || job.status().KeyRotation != nil {
+		t.Fatal("expected key to be rotated")
+	}
+	if job.syncPass() || job.status().LastError != "" {
+		t.Fatalf("pass failed: %+v", job.status())
+	}
+	old, err := first.encrypt(context.Background(), job.plainTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, err := listFiles(context.Background(), old); err != nil || len(files) != 0 {
+		t.Errorf("expected no files left with the previous key but got %v: %v", files, err)
+	}
+
+	// A restarted controller reads the replica with the new key.
+	job = newJob()
+	files, err := listFiles(context.Background(), job.fdst)
+	if err != nil || files["dir/a"] == nil || files["b"] == nil {
+		t.Fatalf("expected re-encrypted replica but got %v: %v", files, err)
+	}
+	if state, err := readReplicationState(context.Background(), job.fdst); err != nil || state == nil {
+		t.Errorf("expected replication state to be re-encrypted, got %v", err)
+	}
+
+	// A key that is not in the Secret any more cannot be read.
+	secret = map[string][]byte{secretKeyPassword: []byte("third")}
+	job = newTestSyncJob(t, spec)
+	if err := job.encryptTarget(context.Background(), testSecret(&secret)); err == nil {
+		t.Error("expected replica of an unknown key to be rejected")
+	}
+}
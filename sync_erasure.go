@@ -0,0 +1,881 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	gohash "hash"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/fs/walk"
+	klog "k8s.io/klog/v2"
+)
+
+// erasureIndexFile is the object in the root of the volume directory on
+// every shard remote listing the files of an erasure coded volume.
+const erasureIndexFile = ".csiraid-erasure.json"
+
+// erasureRepairInterval is how often the shards of an erasure coded volume
+// are checked for completeness.
+const erasureRepairInterval = 10 * time.Minute
+
+// erasureBlockSize is the largest amount of a file encoded at once per data
+// shard. Smaller files use smaller blocks so that their shards are not
+// padded.
+const erasureBlockSize = 1024 * 1024
+
+// erasureEntry is a file in the erasure index.
+type erasureEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// BlockSize is the size of the blocks the file was encoded in per shard.
+	BlockSize int64 `json:"blockSize"`
+	// Version is appended to the path of the file to name its shards. An
+	// update writes its shards under a new version, the index points to them
+	// once enough have been written and the former ones are removed once the
+	// index has been flushed. Empty for shards named after the file only.
+	Version string `json:"version,omitempty"`
+	// Hashes are the SHA-256 sums of the shards, by remote. A shard that
+	// does not match is not used to reconstruct the file.
+	Hashes []string `json:"hashes,omitempty"`
+}
+
+// shardPath returns the path of the shards of the file remote.
+func (e erasureEntry) shardPath(remote string) string {
+	if e.Version == "" {
+		return remote
+	}
+	return remote + "." + e.Version
+}
+
+// erasureIndex is the content of erasureIndexFile.
+type erasureIndex struct {
+	// Generation is increased whenever the index is written, the index with
+	// the highest generation of all remotes is current.
+	Generation   int64                   `json:"generation"`
+	DataShards   int                     `json:"dataShards"`
+	ParityShards int                     `json:"parityShards"`
+	Files        map[string]erasureEntry `json:"files"`
+}
+
+// erasureFs is an rclone file system storing every file as K data and M
+// parity shards, one shard per remote, so that the files can be read as long
+// as any K remotes are available. Shards have the path of their file on
+// their remote. Only files are stored, empty directories are not.
+//
+// Replication treats it as a single target: it is written by sync.Sync and
+// read back when the source is recovered. The index of the files is kept in
+// memory and written to all remotes by flush, at the end of every pass. A
+// write succeeds with the data shards and one parity shard written, the
+// remotes that are down get their shards from repair.
+type erasureFs struct {
+	name     string
+	root     string
+	remotes  []fs.Fs
+	data     int
+	parity   int
+	enc      reedsolomon.Encoder
+	features *fs.Features
+
+	lock  sync.Mutex
+	index *erasureIndex
+	dirty bool
+	// obsolete are the shard paths and obsoleteDirs the directories the
+	// index no longer refers to, removed by the next flush.
+	obsolete     []string
+	obsoleteDirs []string
+	// corrupt are the shards found not to match their hash, by shard path
+	// and remote. They are not used until repair rewrote them.
+	corrupt map[string]map[int]bool
+}
+
+// newErasureFs returns an erasure coded file system over remotes, of which
+// the last parityShards hold parity. The index is read from the remotes.
+func newErasureFs(ctx context.Context, name string, remotes []fs.Fs, parityShards int) (*erasureFs, error) {
+	data := len(remotes) - parityShards
+	if parityShards < 1 || data < 1 {
+		return nil, fmt.Errorf("%d parity shards with %d remotes", parityShards, len(remotes))
+	}
+	enc, err := reedsolomon.New(data, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	f := &erasureFs{
+		name:    name,
+		remotes: remotes,
+		data:    data,
+		parity:  parityShards,
+		enc:     enc,
+		index: &erasureIndex{
+			DataShards:   data,
+			ParityShards: parityShards,
+			Files:        map[string]erasureEntry{},
+		},
+		corrupt: map[string]map[int]bool{},
+	}
+	f.features = (&fs.Features{}).Fill(ctx, f)
+
+	read := 0
+	for _, remote := range remotes {
+		index := &erasureIndex{}
+		found, err := readStateFile(ctx, remote, erasureIndexFile, index)
+		if err != nil {
+			klog.Warningf("Failed to read erasure index of %s: %v", remote, err)
+			continue
+		}
+		read++
+		if found && index.Generation > f.index.Generation {
+			f.index = index
+		}
+	}
+	if read < data {
+		return nil, fmt.Errorf("erasure index readable on %d of %d remotes, %d needed", read, len(remotes), data)
+	}
+	if f.index.DataShards != data || f.index.ParityShards != parityShards {
+		return nil, fmt.Errorf("volume is encoded in %d+%d shards, not %d+%d", f.index.DataShards, f.index.ParityShards, data, parityShards)
+	}
+	if f.index.Files == nil {
+		f.index.Files = map[string]erasureEntry{}
+	}
+	return f, nil
+}
+
+// Name of the remote
+func (f *erasureFs) Name() string { return f.name }
+
+// Root of the remote
+func (f *erasureFs) Root() string { return f.root }
+
+// String returns a description of the FS
+func (f *erasureFs) String() string {
+	names := make([]string, len(f.remotes))
+	for i, remote := range f.remotes {
+		names[i] = remote.String()
+	}
+	return fmt.Sprintf("erasure %d+%d [%s]", f.data, f.parity, strings.Join(names, ", "))
+}
+
+// Precision of the ModTimes, they are kept in the index.
+func (f *erasureFs) Precision() time.Duration { return time.Nanosecond }
+
+// Hashes returns the supported hash types, none.
+func (f *erasureFs) Hashes() hash.Set { return hash.Set(hash.None) }
+
+// Features returns the optional features of this Fs
+func (f *erasureFs) Features() *fs.Features { return f.features }
+
+// List the objects and directories in dir.
+func (f *erasureFs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var entries fs.DirEntries
+	dirs := map[string]bool{}
+	for remote, entry := range f.index.Files {
+		parent := path.Dir(remote)
+		if parent == "." {
+			parent = ""
+		}
+		switch {
+		case parent == dir:
+			entries = append(entries, &erasureObject{f: f, remote: remote, entry: entry})
+		case dir == "" || strings.HasPrefix(parent, dir+"/"):
+			sub := strings.TrimPrefix(parent, dir)
+			sub = strings.TrimPrefix(sub, "/")
+			sub = strings.SplitN(sub, "/", 2)[0]
+			dirs[path.Join(dir, sub)] = true
+		}
+	}
+	if len(entries) == 0 && len(dirs) == 0 && dir != "" {
+		return nil, fs.ErrorDirNotFound
+	}
+	for d := range dirs {
+		entries = append(entries, fs.NewDir(d, time.Time{}))
+	}
+	sort.Sort(entries)
+	return entries, nil
+}
+
+// NewObject finds the Object at remote.
+func (f *erasureFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entry, ok := f.index.Files[remote]
+	if !ok {
+		return nil, fs.ErrorObjectNotFound
+	}
+	return &erasureObject{f: f, remote: remote, entry: entry}, nil
+}
+
+// Put encodes in to the shards of src.Remote().
+func (f *erasureFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	o := &erasureObject{f: f, remote: src.Remote()}
+	if err := o.Update(ctx, in, src, options...); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Mkdir does nothing, directories exist as long as they contain files.
+func (f *erasureFs) Mkdir(ctx context.Context, dir string) error { return nil }
+
+// Rmdir removes the empty directories of the shards once the shards of
+// their files are removed, see flush.
+func (f *erasureFs) Rmdir(ctx context.Context, dir string) error {
+	if entries, err := f.List(ctx, dir); err == nil && len(entries) > 0 {
+		return fs.ErrorDirectoryNotEmpty
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.obsoleteDirs = append(f.obsoleteDirs, dir)
+	return nil
+}
+
+// flush writes the index to all remotes if it has changed, then removes the
+// shards it no longer refers to. Fails only if fewer than the data shards
+// could be written.
+func (f *erasureFs) flush(ctx context.Context) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.dirty {
+		f.index.Generation++
+		written := 0
+		for _, remote := range f.remotes {
+			if err := writeStateFile(ctx, remote, erasureIndexFile, f.index, time.Now()); err != nil {
+				klog.Warningf("Failed to write erasure index to %s: %v", remote, err)
+				continue
+			}
+			written++
+		}
+		if written < f.data {
+			return fmt.Errorf("erasure index written to %d of %d remotes", written, len(f.remotes))
+		}
+		f.dirty = false
+	}
+	f.removeObsolete(ctx)
+	return nil
+}
+
+// removeObsolete removes the obsolete shards and directories from all
+// remotes. Those that cannot be removed, e.g. from a remote that is down,
+// are removed by repair. Called with the lock held.
+func (f *erasureFs) removeObsolete(ctx context.Context) {
+	for _, shard := range f.obsolete {
+		for _, remote := range f.remotes {
+			obj, err := remote.NewObject(ctx, shard)
+			if err == nil {
+				err = obj.Remove(ctx)
+			}
+			if err != nil && err != fs.ErrorObjectNotFound {
+				klog.V(2).Infof("Failed to remove shard %s from %s: %v", shard, remote, err)
+			}
+		}
+	}
+	// Subdirectories first.
+	sort.Sort(sort.Reverse(sort.StringSlice(f.obsoleteDirs)))
+	for _, dir := range f.obsoleteDirs {
+		for _, remote := range f.remotes {
+			if err := remote.Rmdir(ctx, dir); err != nil && err != fs.ErrorDirNotFound {
+				klog.V(4).Infof("Failed to remove directory %s of %s: %v", dir, remote, err)
+			}
+		}
+	}
+	f.obsolete, f.obsoleteDirs = nil, nil
+}
+
+// setEntry sets the index entry of remote, nil to remove it. The shards of
+// the entry it replaces become obsolete.
+func (f *erasureFs) setEntry(remote string, entry *erasureEntry) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if old, ok := f.index.Files[remote]; ok && (entry == nil || entry.Version != old.Version) {
+		f.obsolete = append(f.obsolete, old.shardPath(remote))
+	}
+	if entry == nil {
+		delete(f.index.Files, remote)
+	} else {
+		f.index.Files[remote] = *entry
+	}
+	f.dirty = true
+}
+
+// writeQuorum is the fewest shards of a file that must be written for the
+// write to succeed: the data shards and one parity shard, so that a written
+// file survives the loss of one more remote while writes go on with all but
+// one of the parity remotes down.
+func (f *erasureFs) writeQuorum() int {
+	if f.parity == 0 {
+		return f.data
+	}
+	return f.data + 1
+}
+
+// corruptShards returns the remotes whose shard at path was found not to
+// match its hash.
+func (f *erasureFs) corruptShards(path string) map[int]bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	corrupt := make(map[int]bool, len(f.corrupt[path]))
+	for i := range f.corrupt[path] {
+		corrupt[i] = true
+	}
+	return corrupt
+}
+
+// setCorrupt records whether the shard at path on remote i matches its
+// hash.
+func (f *erasureFs) setCorrupt(path string, i int, corrupt bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !corrupt {
+		delete(f.corrupt[path], i)
+		if len(f.corrupt[path]) == 0 {
+			delete(f.corrupt, path)
+		}
+		return
+	}
+	if f.corrupt[path] == nil {
+		f.corrupt[path] = map[int]bool{}
+	}
+	f.corrupt[path][i] = true
+}
+
+// shardLayout returns the block size for a file of size and the size of each
+// of its shards.
+func (f *erasureFs) shardLayout(size int64) (blockSize, shardSize int64) {
+	blockSize = erasureBlockSize
+	if perShard := (size + int64(f.data) - 1) / int64(f.data); perShard < blockSize {
+		blockSize = perShard
+	}
+	return blockSize, f.shardSize(size, blockSize)
+}
+
+// shardSize returns the size of each shard of a file of size encoded in
+// blocks of blockSize.
+func (f *erasureFs) shardSize(size, blockSize int64) int64 {
+	if blockSize == 0 {
+		return 0
+	}
+	stripe := blockSize * int64(f.data)
+	return (size + stripe - 1) / stripe * blockSize
+}
+
+// erasureObject is a file of an erasureFs.
+type erasureObject struct {
+	f      *erasureFs
+	remote string
+	entry  erasureEntry
+}
+
+// String returns a description of the Object
+func (o *erasureObject) String() string { return o.remote }
+
+// Remote returns the remote path
+func (o *erasureObject) Remote() string { return o.remote }
+
+// ModTime returns the modification date of the file
+func (o *erasureObject) ModTime(ctx context.Context) time.Time { return o.entry.ModTime }
+
+// Size returns the size of the file
+func (o *erasureObject) Size() int64 { return o.entry.Size }
+
+// Fs returns the Fs of the object
+func (o *erasureObject) Fs() fs.Info { return o.f }
+
+// Hash is not supported
+func (o *erasureObject) Hash(ctx context.Context, ty hash.Type) (string, error) {
+	return "", hash.ErrUnsupported
+}
+
+// Storable says whether this object can be stored
+func (o *erasureObject) Storable() bool { return true }
+
+// SetModTime sets the modification time in the index.
+func (o *erasureObject) SetModTime(ctx context.Context, t time.Time) error {
+	o.entry.ModTime = t
+	o.f.setEntry(o.remote, &o.entry)
+	return nil
+}
+
+// Update encodes in to new shards of the object, which replace the former
+// ones once a write quorum has been written. The shards that were written by
+// a failed update are removed by repair.
+func (o *erasureObject) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
+	f := o.f
+	size := src.Size()
+	if size < 0 {
+		return errors.New("erasure coding needs the size of the file")
+	}
+	blockSize, _ := f.shardLayout(size)
+	modTime := src.ModTime(ctx)
+
+	entry := erasureEntry{Size: size, ModTime: modTime, BlockSize: blockSize, Version: strconv.FormatInt(time.Now().UnixNano(), 36)}
+	hashes, err := f.writeShards(ctx, in, entry.shardPath(o.remote), entry, nil, f.writeQuorum())
+	if err != nil {
+		return err
+	}
+	entry.Hashes = hashes
+	o.entry = entry
+	f.setEntry(o.remote, &o.entry)
+	return nil
+}
+
+// writeShards encodes the file read from in and writes its shards to path,
+// only those of the given remotes if only is not nil. Fails if fewer than
+// quorum shards are written. Returns the hashes of all shards.
+func (f *erasureFs) writeShards(ctx context.Context, in io.Reader, path string, entry erasureEntry, only []int, quorum int) ([]string, error) {
+	if only == nil {
+		for i := range f.remotes {
+			only = append(only, i)
+		}
+	}
+	shardSize := f.shardSize(entry.Size, entry.BlockSize)
+
+	// Every shard is uploaded through a pipe while the file is encoded.
+	writers := make([]io.Writer, len(f.remotes))
+	pipes := make([]*io.PipeWriter, 0, len(only))
+	errs := make([]error, len(f.remotes))
+	var wg sync.WaitGroup
+	for _, i := range only {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		pipes = append(pipes, pw)
+		wg.Add(1)
+		go func(i int, f fs.Fs) {
+			defer wg.Done()
+			info := object.NewStaticObjectInfo(path, entry.ModTime, shardSize, true, nil, f)
+			dst, err := f.NewObject(ctx, path)
+			if err == nil {
+				err = dst.Update(ctx, pr, info)
+			} else {
+				_, err = f.Put(ctx, pr, info)
+			}
+			errs[i] = err
+			pr.CloseWithError(err)
+		}(i, f.remotes[i])
+	}
+	hashes, err := f.encode(in, entry.Size, entry.BlockSize, writers, quorum)
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	written := 0
+	for _, i := range only {
+		if errs[i] != nil {
+			klog.Warningf("Failed to write shard %d of %s to %s: %v", i, path, f.remotes[i], errs[i])
+			continue
+		}
+		written++
+	}
+	if written < quorum {
+		return nil, fmt.Errorf("%d of %d shards of %s written, %d needed", written, len(only), path, quorum)
+	}
+	return hashes, nil
+}
+
+// encode reads size bytes from in and writes their shards to writers, block
+// by block. Shards without writer are dropped, so are those whose writer
+// fails as long as quorum writers are left. Returns the hashes of all
+// shards.
+func (f *erasureFs) encode(in io.Reader, size, blockSize int64, writers []io.Writer, quorum int) ([]string, error) {
+	hashers := make([]gohash.Hash, len(writers))
+	live := 0
+	for i, w := range writers {
+		hashers[i] = sha256.New()
+		if w != nil {
+			live++
+		}
+	}
+	sums := func() []string {
+		hashes := make([]string, len(hashers))
+		for i, h := range hashers {
+			hashes[i] = hex.EncodeToString(h.Sum(nil))
+		}
+		return hashes
+	}
+	if size == 0 {
+		return sums(), nil
+	}
+	stripe := make([]byte, blockSize*int64(len(writers)))
+	shards := make([][]byte, len(writers))
+	for i := range shards {
+		shards[i] = stripe[int64(i)*blockSize : int64(i+1)*blockSize]
+	}
+	data := stripe[:blockSize*int64(f.data)]
+	for read := int64(0); read < size; {
+		n, err := io.ReadFull(in, data[:min64(int64(len(data)), size-read)])
+		if err != nil {
+			return nil, err
+		}
+		read += int64(n)
+		for i := n; i < len(data); i++ {
+			data[i] = 0
+		}
+		if err := f.enc.Encode(shards); err != nil {
+			return nil, err
+		}
+		for i, w := range writers {
+			hashers[i].Write(shards[i])
+			if w == nil {
+				continue
+			}
+			if _, err := w.Write(shards[i]); err != nil {
+				writers[i] = nil
+				if live--; live < quorum {
+					return nil, fmt.Errorf("failed to write shard %d: %v", i, err)
+				}
+				klog.V(2).Infof("Dropping shard %d: %v", i, err)
+			}
+		}
+	}
+	return sums(), nil
+}
+
+// Open reconstructs the file from any K of its shards.
+func (o *erasureObject) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
+	return o.open(ctx, nil, options...)
+}
+
+// open reconstructs the file from any K of its shards, not using the shards
+// of the remotes in skip, which may be nil, nor those known to be corrupt.
+// When the whole file is read the shards are checked against their hashes
+// as they are decoded: those that do not match are recorded as corrupt and
+// the read fails if the file was reconstructed from them.
+func (o *erasureObject) open(ctx context.Context, skip map[int]bool, options ...fs.OpenOption) (io.ReadCloser, error) {
+	f := o.f
+	size, blockSize := o.entry.Size, o.entry.BlockSize
+	offset, limit := int64(0), int64(-1)
+	fs.FixRangeOption(options, size)
+	for _, option := range options {
+		switch x := option.(type) {
+		case *fs.SeekOption:
+			offset = x.Offset
+		case *fs.RangeOption:
+			offset, limit = x.Decode(size)
+		default:
+			if option.Mandatory() {
+				fs.Logf(o, "Unsupported mandatory option: %v", option)
+			}
+		}
+	}
+	if limit < 0 || offset+limit > size {
+		limit = size - offset
+	}
+	if size == 0 || limit <= 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+
+	shard := o.entry.shardPath(o.remote)
+	corrupt := f.corruptShards(shard)
+
+	// Start reading the shards at the block holding offset.
+	stripe := blockSize * int64(f.data)
+	firstBlock := offset / stripe
+	readers := make([]io.ReadCloser, len(f.remotes))
+	available := 0
+	for i, remote := range f.remotes {
+		if skip[i] || corrupt[i] {
+			continue
+		}
+		obj, err := remote.NewObject(ctx, shard)
+		if err == nil {
+			readers[i], err = obj.Open(ctx, &fs.SeekOption{Offset: firstBlock * blockSize})
+		}
+		if err != nil {
+			klog.V(2).Infof("Shard %d of %s on %s unavailable: %v", i, o.remote, remote, err)
+			continue
+		}
+		available++
+	}
+	closeAll := func() {
+		for _, r := range readers {
+			if r != nil {
+				r.Close()
+			}
+		}
+	}
+	if available < f.data {
+		closeAll()
+		return nil, fmt.Errorf("%s: %d of %d shards available, %d needed", o.remote, available, len(f.remotes), f.data)
+	}
+	if available < len(f.remotes) {
+		klog.Infof("Reconstructing %s from %d of %d shards", o.remote, available, len(f.remotes))
+	}
+
+	// Shards are only read in full from the first block to the end.
+	var hashes []string
+	if firstBlock == 0 && offset+limit == size && len(o.entry.Hashes) == len(f.remotes) {
+		hashes = o.entry.Hashes
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer closeAll()
+		mismatched, err := f.decode(readers, blockSize, firstBlock*stripe, offset, offset+limit, pw, hashes)
+		for _, i := range mismatched {
+			klog.Warningf("Shard %d of %s on %s does not match its hash, not using it", i, o.remote, f.remotes[i])
+			f.setCorrupt(shard, i, true)
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// decode reads the blocks of the file from start on from readers, nil for
+// unavailable shards, and writes the bytes from offset to end to w. If
+// hashes is not nil, the shards read in full are checked against them and
+// those that do not match are returned. Decoding fails if the file was
+// reconstructed from any of them.
+func (f *erasureFs) decode(readers []io.ReadCloser, blockSize, start, offset, end int64, w io.Writer, hashes []string) ([]int, error) {
+	buffers := make([][]byte, len(readers))
+	hashers := make([]gohash.Hash, len(readers))
+	for i := range buffers {
+		buffers[i] = make([]byte, blockSize)
+		hashers[i] = sha256.New()
+	}
+	// used are the shards the file was reconstructed from: ReconstructData
+	// uses the first data shards available.
+	used := make([]bool, len(readers))
+	shards := make([][]byte, len(readers))
+	for pos := start; pos < end; pos += blockSize * int64(f.data) {
+		available := 0
+		for i, r := range readers {
+			shards[i] = nil
+			if r == nil {
+				continue
+			}
+			if _, err := io.ReadFull(r, buffers[i]); err != nil {
+				klog.V(2).Infof("Shard %d unavailable: %v", i, err)
+				r.Close()
+				readers[i] = nil
+				continue
+			}
+			if hashes != nil {
+				hashers[i].Write(buffers[i])
+			}
+			shards[i] = buffers[i]
+			if available < f.data {
+				used[i] = true
+			}
+			available++
+		}
+		if available < f.data {
+			return nil, fmt.Errorf("%d of %d shards available, %d needed", available, len(readers), f.data)
+		}
+		if err := f.enc.ReconstructData(shards); err != nil {
+			return nil, err
+		}
+		for i := 0; i < f.data; i++ {
+			from, to := pos+int64(i)*blockSize, pos+int64(i+1)*blockSize
+			if to <= offset || from >= end {
+				continue
+			}
+			block := shards[i]
+			if from < offset {
+				block = block[offset-from:]
+			}
+			if to > end {
+				block = block[:int64(len(block))-(to-end)]
+			}
+			if _, err := w.Write(block); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if hashes == nil {
+		return nil, nil
+	}
+	var mismatched []int
+	var err error
+	for i, r := range readers {
+		if r == nil || hex.EncodeToString(hashers[i].Sum(nil)) == hashes[i] {
+			continue
+		}
+		mismatched = append(mismatched, i)
+		if used[i] {
+			err = fmt.Errorf("reconstructed from shard %d, which does not match its hash", i)
+		}
+	}
+	return mismatched, err
+}
+
+// Remove removes the object from the index, its shards are removed by the
+// next flush.
+func (o *erasureObject) Remove(ctx context.Context) error {
+	o.f.setEntry(o.remote, nil)
+	return nil
+}
+
+// repair removes the shards the index does not refer to, left behind by
+// failed writes or removals, and rewrites the shards that are missing, have
+// the wrong size or do not match their hash on some remotes, reconstructed
+// from the others. Returns the number of files repaired.
+func (f *erasureFs) repair(ctx context.Context) (int, error) {
+	f.lock.Lock()
+	files := make(map[string]erasureEntry, len(f.index.Files))
+	referenced := map[string]bool{erasureIndexFile: true}
+	for remote, entry := range f.index.Files {
+		files[remote] = entry
+		referenced[entry.shardPath(remote)] = true
+	}
+	for _, shard := range f.obsolete {
+		referenced[shard] = true
+	}
+	generation := f.index.Generation
+	f.lock.Unlock()
+	// The shards of a newer index, written while this one was read, are
+	// not left behind.
+	current := true
+	for _, remote := range f.remotes {
+		index := &erasureIndex{}
+		if found, err := readStateFile(ctx, remote, erasureIndexFile, index); err != nil || found && index.Generation > generation {
+			current = false
+		}
+	}
+
+	shards := make([]map[string]int64, len(f.remotes))
+	for i, remote := range f.remotes {
+		shards[i] = map[string]int64{}
+		err := walk.ListR(ctx, remote, "", true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+			entries.ForObject(func(obj fs.Object) {
+				shards[i][obj.Remote()] = obj.Size()
+			})
+			return nil
+		})
+		if err != nil && err != fs.ErrorDirNotFound {
+			return 0, fmt.Errorf("failed to list %s: %v", remote, err)
+		}
+		for shard := range shards[i] {
+			if !current || referenced[shard] {
+				continue
+			}
+			if obj, err := remote.NewObject(ctx, shard); err == nil {
+				err = obj.Remove(ctx)
+				klog.V(2).Infof("Removed shard %s of %s the index does not refer to: %v", shard, remote, err)
+			}
+		}
+	}
+
+	repaired := 0
+	for remote, entry := range files {
+		shard := entry.shardPath(remote)
+		shardSize := f.shardSize(entry.Size, entry.BlockSize)
+		skip := map[int]bool{}
+		for i := range f.remotes {
+			if size, ok := shards[i][shard]; !ok || size != shardSize {
+				skip[i] = true
+			}
+		}
+		for i := range f.corruptShards(shard) {
+			skip[i] = true
+		}
+		if len(skip) == 0 {
+			continue
+		}
+		if len(skip) > f.parity {
+			klog.Warningf("%s lost: %d of %d shards missing", remote, len(skip), len(f.remotes))
+			continue
+		}
+		if err := f.repairFile(ctx, remote, entry, skip); err != nil {
+			return repaired, err
+		}
+		repaired++
+	}
+	return repaired, nil
+}
+
+// repairFile rewrites the shards of the file remote described by entry on
+// the remotes in skip from the others. The shards found not to match their
+// hash while doing so are rewritten as well.
+func (f *erasureFs) repairFile(ctx context.Context, remote string, entry erasureEntry, skip map[int]bool) error {
+	shard := entry.shardPath(remote)
+	o := &erasureObject{f: f, remote: remote, entry: entry}
+	// Every round finds at least one more corrupt shard or ends.
+	for round := 0; round < len(f.remotes); round++ {
+		missing := make([]int, 0, len(skip))
+		for i := range skip {
+			missing = append(missing, i)
+		}
+		sort.Ints(missing)
+		in, err := o.open(ctx, skip)
+		if err != nil {
+			return err
+		}
+		_, err = f.writeShards(ctx, in, shard, entry, missing, len(missing))
+		if err == nil {
+			// The shards read are checked at the end of the file.
+			_, err = ioutil.ReadAll(in)
+		}
+		in.Close()
+		if err == nil {
+			for _, i := range missing {
+				f.setCorrupt(shard, i, false)
+			}
+			// The shards found corrupt while reading are left.
+			skip = f.corruptShards(shard)
+			if len(skip) == 0 {
+				return nil
+			}
+		} else {
+			// The write may have failed for a shard the file was
+			// reconstructed from.
+			grown := false
+			for i := range f.corruptShards(shard) {
+				if !skip[i] {
+					skip[i] = true
+					grown = true
+				}
+			}
+			if !grown {
+				return err
+			}
+		}
+		if len(skip) > f.parity {
+			return fmt.Errorf("%s lost: %d of %d shards missing or corrupt", remote, len(skip), len(f.remotes))
+		}
+	}
+	return fmt.Errorf("%s: shards keep failing to match their hash", remote)
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.Fs     = (*erasureFs)(nil)
+	_ fs.Object = (*erasureObject)(nil)
+)
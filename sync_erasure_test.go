@@ -0,0 +1,201 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+func TestErasureLayout(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	sourceDir := filepath.Join(sourceRoot, "vol-1")
+	// Several stripes of 2 data shards and a partial one.
+	large := make([]byte, 5*erasureBlockSize+12345)
+	rand.New(rand.NewSource(1)).Read(large)
+	writeFile(t, filepath.Join(sourceDir, "large"), string(large), time.Now())
+	writeFile(t, filepath.Join(sourceDir, "dir", "small"), "small", time.Now())
+	writeFile(t, filepath.Join(sourceDir, "empty"), "", time.Now())
+
+	spec := SyncJobSpec{
+		VolumeName:   "pv-1",
+		Source:       "source",
+		Targets:      []string{"target", "target2", "target3"},
+		Directory:    "/export/vol-1",
+		Layout:       LayoutErasure,
+		ParityShards: 1,
+	}
+	spec.setDefaults()
+	if err := spec.validate(); err != nil {
+		t.Fatal(err)
+	}
+	spec.Target = "erasure"
+	job, err := newSyncJob(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.syncPass()
+	if status := job.status(); status.LastError != "" {
+		t.Fatalf("unexpected error: %s", status.LastError)
+	}
+	shard, err := ioutil.ReadFile(shardFile(job, targetRoot, "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shard) >= len(large) {
+		t.Errorf("expected shard smaller than the file, got %d bytes for %d", len(shard), len(large))
+	}
+
+	// Ranges are decoded from the stripe holding their start.
+	obj, err := job.fdst.NewObject(context.Background(), "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, end := int64(3*erasureBlockSize-10), int64(4*erasureBlockSize+10)
+	in, err := obj.Open(context.Background(), &fs.RangeOption{Start: start, End: end})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(in)
+	in.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, large[start:end+1]) {
+		t.Errorf("range %d-%d decoded wrongly", start, end)
+	}
+
+	// Lose a remote and the source, then recover the source from the others.
+	removeAll(t, filepath.Join(targetRoot, "vol-1"))
+	removeAll(t, sourceDir)
+	job, err = newSyncJob(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.syncPass()
+	for name, expected := range map[string][]byte{"large": large, "dir/small": []byte("small"), "empty": {}} {
+		data, err := ioutil.ReadFile(filepath.Join(sourceDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("expected %s to be recovered: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("%s recovered wrongly", name)
+		}
+	}
+	// The lost shards are written again.
+	waitForFile(t, shardFile(job, targetRoot, "large"), 10*time.Second)
+}
+
+// shardFile returns the path of the shard of the file remote of the erasure
+// coded target of job on the remote at root.
+func shardFile(job *syncJob, root, remote string) string {
+	job.erasure.lock.Lock()
+	defer job.erasure.lock.Unlock()
+	entry := job.erasure.index.Files[remote]
+	return filepath.Join(root, "vol-1", filepath.FromSlash(entry.shardPath(remote)))
+}
+
+func TestErasureWrites(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	target3Root := filepath.Join(filepath.Dir(targetRoot), "target3")
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "first content", time.Now().Add(-time.Hour))
+	spec := SyncJobSpec{
+		VolumeName:   "pv-1",
+		Source:       "source",
+		Targets:      []string{"target", "target2", "target3"},
+		Directory:    "/export/vol-1",
+		Layout:       LayoutErasure,
+		ParityShards: 2,
+	}
+	spec.setDefaults()
+	spec.Target = "erasure"
+	job, err := newSyncJob(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.syncPass() || job.status().LastError != "" {
+		t.Fatalf("pass failed: %+v", job.status())
+	}
+	former := shardFile(job, targetRoot, "a")
+
+	// An update goes on with one remote down, leaving the data shard and a
+	// parity shard, and replaces the former shards once the index refers to
+	// the new ones.
+	removeAll(t, filepath.Join(target3Root, "vol-1"))
+	writeFile(t, filepath.Join(target3Root, "vol-1"), "not a directory", time.Now())
+	content := "second content"
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), content, time.Now())
+	if job.syncPass() || job.status().LastError != "" {
+		t.Fatalf("pass with a remote down failed: %+v", job.status())
+	}
+	if current := shardFile(job, targetRoot, "a"); current == former || !exists(current) || exists(former) {
+		t.Errorf("expected shards of the update to replace %s, got %s", former, current)
+	}
+
+	// The remote is back: its shard is rewritten, leftovers are removed.
+	removeAll(t, filepath.Join(target3Root, "vol-1"))
+	stray := filepath.Join(targetRoot, "vol-1", "a.leftover")
+	writeFile(t, stray, "leftover", time.Now())
+	if repaired, err := job.erasure.repair(context.Background()); err != nil || repaired == 0 {
+		t.Fatalf("expected files to be repaired but got %d: %v", repaired, err)
+	}
+	if !exists(shardFile(job, target3Root, "a")) || exists(stray) {
+		t.Error("expected missing shard to be rewritten and leftover shard to be removed")
+	}
+
+	// A shard that does not match its hash fails the read it is found by,
+	// is not used afterwards and is rewritten by repair.
+	shard := shardFile(job, targetRoot, "a")
+	data, err := ioutil.ReadFile(shard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, shard, string(bytes.Repeat([]byte{'x'}, len(data))), time.Now())
+	read := func() (string, error) {
+		obj, err := job.fdst.NewObject(context.Background(), "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, err := obj.Open(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+		data, err := ioutil.ReadAll(in)
+		return string(data), err
+	}
+	if _, err := read(); err == nil {
+		t.Error("expected read from a corrupt shard to fail")
+	}
+	if data, err := read(); err != nil || data != content {
+		t.Errorf("expected %q but got %q: %v", content, data, err)
+	}
+	if repaired, err := job.erasure.repair(context.Background()); err != nil || repaired == 0 {
+		t.Fatalf("expected corrupt shard to be repaired but got %d: %v", repaired, err)
+	}
+	if repaired, err := ioutil.ReadFile(shard); err != nil || !bytes.Equal(repaired, data) {
+		t.Errorf("expected corrupt shard to be rewritten: %v", err)
+	}
+}
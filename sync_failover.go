@@ -0,0 +1,203 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+)
+
+// FailoverSpec configures the promotion of a replica of a volume whose
+// source has become unreachable.
+type FailoverSpec struct {
+	// Threshold is the number of passes in a row failing to list the source
+	// after which the freshest reachable replica is promoted. 0 disables
+	// failover.
+	Threshold int
+	// DeletePods deletes the pods using the claim of the volume after the
+	// promotion, so that they mount the new primary copy.
+	DeletePods bool
+}
+
+// enabled tells whether the volume fails over.
+func (spec FailoverSpec) enabled() bool {
+	return spec.Threshold > 0
+}
+
+// sourceFailed counts a pass of j that failed to list the source and
+// requests a failover once Threshold passes failed in a row.
+func (j *syncJob) sourceFailed(err error) {
+	j.lock.Lock()
+	j.sourceFailures++
+	failures := j.sourceFailures
+	j.lock.Unlock()
+	threshold := j.spec.Failover.Threshold
+	if threshold == 0 || failures != threshold {
+		return
+	}
+	j.event(v1.EventTypeWarning, "SourceUnreachable", "%s failed %d passes in a row: %v", j.spec.Source, failures, err)
+	j.replicas.requestFailover(j)
+}
+
+// sourceReached resets the failed passes of j after it listed the source.
+func (j *syncJob) sourceReached() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.sourceFailures = 0
+}
+
+// requestFailover passes the freshest reachable replica of the volume to
+// the failover handler, once per replica set. reporter is the job that
+// found the source unreachable.
+func (r *replicaSet) requestFailover(reporter *syncJob) {
+	if r == nil || r.failoverHandler == nil {
+		return
+	}
+	r.healthLock.Lock()
+	if r.failingOver {
+		r.healthLock.Unlock()
+		return
+	}
+	r.failingOver = true
+	r.healthLock.Unlock()
+
+	target := r.failoverTarget(reporter.transferCtx)
+	if target == "" {
+		reporter.event(v1.EventTypeWarning, "FailoverFailed", "No replica of the volume is reachable")
+		r.healthLock.Lock()
+		r.failingOver = false
+		r.healthLock.Unlock()
+		return
+	}
+	reporter.event(v1.EventTypeWarning, "FailoverStarted", "Promoting the replica on %s", target)
+	r.failoverHandler(r.status(), target)
+}
+
+// failoverTarget returns the target of the replica synced last that can be
+// listed, "" if none can.
+func (r *replicaSet) failoverTarget(ctx context.Context) string {
+	candidates := make([]*syncJob, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		if status := job.status(); status.State != SyncJobStopped && status.DeletionHold == nil {
+			candidates = append(candidates, job)
+		}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return candidates[a].status().LastSyncTime.After(candidates[b].status().LastSyncTime)
+	})
+	for _, job := range candidates {
+		if _, err := listVolume(ctx, job.fdst); err != nil {
+			klog.Infof("Volume %q: replica on %s is unreachable: %v", r.spec.VolumeName, job.spec.Target, err)
+			continue
+		}
+		return job.spec.Target
+	}
+	return ""
+}
+
+// failover promotes the replica on target of a volume whose source is
+// unreachable. It is the failover handler of the sync manager. The former
+// source is a target of the promoted volume, usually still unreachable: the
+// replication starts without it, degraded, and is retried every
+// failoverRetryInterval until it replicates to all targets.
+func (ctrl *ProvisionController) failover(status SyncJobStatus, target string) {
+	ctrl.syncManager.goBackground(func(ctx context.Context) {
+		volumeName := status.VolumeName
+		klog.Warningf("Volume %q: %s is unreachable, failing over to %s", volumeName, status.Source, target)
+		err := ctrl.promote(ctx, volumeName, target, false)
+		replicationErr, promoted := err.(*replicationError)
+		if err != nil && !promoted {
+			klog.Errorf("Failover of volume %q to %s failed: %v", volumeName, target, err)
+			if volume, err1 := ctrl.client.CoreV1().PersistentVolumes().Get(ctx, volumeName, metav1.GetOptions{}); err1 == nil {
+				ctrl.eventRecorder.Eventf(volume, v1.EventTypeWarning, "FailoverFailed", "Failed to promote the replica on %s: %v", target, err)
+			}
+			return
+		}
+		if promoted {
+			ctrl.eventRecorder.Eventf(replicationErr.volume, v1.EventTypeWarning, "FailoverReplicationFailed",
+				"Failed to start replication from %s, retrying: %v", target, replicationErr.err)
+		}
+		if status.Failover.DeletePods && status.ClaimName != "" {
+			ctrl.deleteClaimPods(ctx, status.ClaimNamespace, status.ClaimName)
+		}
+		if promoted {
+			ctrl.retryReplication(ctx, replicationErr.volume)
+		}
+	})
+}
+
+// failoverRetryInterval is how often the replication of a failed over
+// volume is retried until it replicates to all of its targets.
+var failoverRetryInterval = 30 * time.Second
+
+// retryReplication starts the replication of volume, or the replicas left
+// out by its start, every failoverRetryInterval until it replicates to all
+// of its targets or the sync manager is shut down.
+func (ctrl *ProvisionController) retryReplication(ctx context.Context, volume *v1.PersistentVolume) {
+	err := wait.PollUntil(failoverRetryInterval, func() (bool, error) {
+		err := ctrl.syncManager.RetryUnavailable(volume.Name)
+		if err == ErrSyncJobNotFound {
+			err = ctrl.startVolumeSync(ctx, volume)
+		}
+		if err != nil {
+			klog.Infof("Volume %q: replication not fully started yet: %v", volume.Name, err)
+			return false, nil
+		}
+		klog.Infof("Volume %q: replicating to all targets", volume.Name)
+		return true, nil
+	}, ctrl.syncManager.done())
+	if err != nil {
+		klog.Infof("Volume %q: stopped retrying its replication: %v", volume.Name, err)
+	}
+}
+
+// deleteClaimPods deletes the pods using the given claim.
+func (ctrl *ProvisionController) deleteClaimPods(ctx context.Context, namespace, claimName string) {
+	pods, err := ctrl.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Failed to list the pods using claim %s/%s: %v", namespace, claimName, err)
+		return
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !podUsesClaim(pod, claimName) {
+			continue
+		}
+		if err := ctrl.client.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
+			klog.Errorf("Failed to delete pod %s/%s using a failed over volume: %v", namespace, pod.Name, err)
+			continue
+		}
+		klog.Infof("Deleted pod %s/%s to remount claim %q", namespace, pod.Name, claimName)
+		ctrl.eventRecorder.Eventf(pod, v1.EventTypeNormal, "VolumeFailedOver", "Deleted to remount the promoted volume of claim %q", claimName)
+	}
+}
+
+// podUsesClaim tells whether pod mounts the given claim.
+func podUsesClaim(pod *v1.Pod, claimName string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if claim := volume.PersistentVolumeClaim; claim != nil && claim.ClaimName == claimName {
+			return true
+		}
+	}
+	return false
+}
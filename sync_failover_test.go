@@ -0,0 +1,197 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestApplyFailoverParameters(t *testing.T) {
+	spec := SyncJobSpec{}
+	if err := applySyncParameters(&spec, map[string]string{paramFailoverThreshold: "3", paramFailoverDeletePods: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Failover != (FailoverSpec{Threshold: 3, DeletePods: true}) {
+		t.Errorf("unexpected failover %+v", spec.Failover)
+	}
+	for _, parameters := range []map[string]string{
+		{paramFailoverThreshold: "-1"},
+		{paramFailoverThreshold: "often"},
+		{paramFailoverDeletePods: "maybe"},
+	} {
+		if err := applySyncParameters(&SyncJobSpec{}, parameters); err == nil {
+			t.Errorf("expected %v to be rejected", parameters)
+		}
+	}
+	spec = SyncJobSpec{Source: "s", Targets: []string{"t1", "t2"}, Layout: LayoutErasure, Failover: FailoverSpec{Threshold: 1}}
+	spec.setDefaults()
+	if err := spec.validate(); err == nil {
+		t.Error("expected failover of an erasure coded volume to be rejected")
+	}
+}
+
+func podUsing(name, claimName string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec: v1.PodSpec{Volumes: []v1.Volume{{
+			Name: "data",
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+			},
+		}}},
+	}
+}
+
+func TestFailover(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "data", time.Now())
+	defer func(source string, active bool) { Source, Active = source, active }(Source, Active)
+	Source, Active = "source", true
+	defer func(interval time.Duration) { failoverRetryInterval = interval }(failoverRetryInterval)
+	failoverRetryInterval = 50 * time.Millisecond
+
+	volume := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pv-1",
+			Annotations: map[string]string{annDynamicallyProvisioned: "csiraid.io/test"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Server: "source.example.com", Path: "/export/vol-1"}},
+			ClaimRef:               &v1.ObjectReference{Namespace: "default", Name: "claim-1", UID: "uid-1"},
+			StorageClassName:       "class-1",
+		},
+	}
+	class := &storage.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "class-1"},
+		Provisioner: "csiraid.io/test",
+		Parameters: map[string]string{
+			paramSyncInterval:       "50ms",
+			paramFailoverThreshold:  "2",
+			paramFailoverDeletePods: "true",
+		},
+	}
+	ctrl := &ProvisionController{
+		client:          fake.NewSimpleClientset(volume, class, boundClaim("claim-1", "uid-1"), podUsing("pod-1", "claim-1"), podUsing("pod-2", "claim-2")),
+		provisioner:     &testExportProvisioner{newTestProvisioner()},
+		provisionerName: "csiraid.io/test",
+		syncManager:     NewSyncManager("test", nil),
+		eventRecorder:   record.NewFakeRecorder(100),
+	}
+	defer ctrl.syncManager.Shutdown(time.Second)
+	ctrl.syncManager.SetFailoverHandler(ctrl.failover)
+	ctx := context.Background()
+	ctrl.startVolumeSync(ctx, volume)
+	waitForFile(t, filepath.Join(targetRoot, "vol-1", "a"), 5*time.Second)
+
+	// The source cannot be listed any longer.
+	if err := os.RemoveAll(filepath.Join(sourceRoot, "vol-1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sourceRoot, "vol-1"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		promoted, err := ctrl.client.CoreV1().PersistentVolumes().Get(ctx, "pv-1", metav1.GetOptions{})
+		if err == nil && promoted.Annotations[annSource] == "target" {
+			if promoted.Spec.NFS.Server != "target.example.com" {
+				t.Errorf("expected volume to be exported by target.example.com, got %s", promoted.Spec.NFS.Server)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("volume was not failed over")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		_, err := ctrl.client.CoreV1().Pods("default").Get(ctx, "pod-1", metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pod using the volume was not deleted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := ctrl.client.CoreV1().Pods("default").Get(ctx, "pod-2", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected pod using another claim to be kept: %v", err)
+	}
+	// The former source is still unreachable, the promoted volume is
+	// degraded until it can be replicated to.
+	status, err := ctrl.syncManager.Status("pv-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Source != "target" {
+		t.Errorf("expected replication from target, got %s", status.Source)
+	}
+	if !status.Degraded || len(status.UnhealthyRemotes) != 1 || status.UnhealthyRemotes[0] != "source" {
+		t.Errorf("expected volume degraded by the unavailable source: %+v", status)
+	}
+	expectEvent(t, ctrl.eventRecorder.(*record.FakeRecorder), "FailoverReplicationFailed")
+
+	if err := os.Remove(filepath.Join(sourceRoot, "vol-1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(sourceRoot, "vol-1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitForFile(t, filepath.Join(sourceRoot, "vol-1", "a"), 5*time.Second)
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		status, err := ctrl.syncManager.Status("pv-1")
+		if err == nil && !status.Degraded && len(status.Replicas) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected replication to the former source: %+v, %v", status, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// expectEvent fails t unless recorder has recorded an event with reason.
+func expectEvent(t *testing.T, recorder *record.FakeRecorder, reason string) {
+	t.Helper()
+	for {
+		select {
+		case event := <-recorder.Events:
+			if strings.Contains(event, reason) {
+				return
+			}
+		default:
+			t.Errorf("expected %s event", reason)
+			return
+		}
+	}
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/sync"
+	v1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// SplitBrain is a replica fenced because both the source and the target
+// have been written to since the generation they last had in common,
+// typically a former primary copy written to after the source had been
+// promoted. The replica is not synced until an operator chooses the
+// copy to keep, see SyncManager.ResolveSplitBrain.
+type SplitBrain struct {
+	Time time.Time
+	// SourceEpoch and TargetEpoch are the promotion epochs of both copies,
+	// Generation the last generation they had in common.
+	SourceEpoch int64
+	TargetEpoch int64
+	Generation  int64
+	// Token resolves the split brain when set after the remote to keep and
+	// a colon as the value of the annSplitBrainWinner annotation of the
+	// claim.
+	Token string
+	// Winner is the remote whose copy is kept, empty until it is chosen.
+	Winner string
+}
+
+// errFenced fails the passes of a replica fenced after a split brain.
+var errFenced = fmt.Errorf("replication fenced after a split brain")
+
+// promoteReplicationState raises the epoch and generation of the marker of
+// the copy of volume on target, which becomes its primary copy. A former
+// primary copy that was written to afterwards is then told apart from a
+// replica that is merely behind.
+func (ctrl *ProvisionController) promoteReplicationState(ctx context.Context, volume *v1.PersistentVolume, target string) error {
+	f, err := newFsDirFromVolume(ctx, target, volume.Spec.NFS.Path)
+	if err != nil {
+		return err
+	}
+	state, err := readReplicationState(ctx, f)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &replicationState{Volume: volume.Name, LastSyncTime: time.Now()}
+	}
+	state.Epoch++
+	state.Generation++
+	state.ControllerID = ctrl.id
+	return writeReplicationState(ctx, f, state)
+}
+
+// commonGeneration returns the last generation the copies on the remotes
+// source and target had in common, as recorded by the marker of either.
+// Returns false if neither records it.
+func commonGeneration(sourceState, targetState *replicationState, source, target string) (int64, bool) {
+	if sourceState == nil || targetState == nil {
+		return 0, false
+	}
+	if generation, ok := sourceState.Synced[target]; ok {
+		return generation, true
+	}
+	generation, ok := targetState.Synced[source]
+	return generation, ok
+}
+
+// movedPast tells whether the copy on f, whose marker is state, has been
+// written to since generation: its generation is later or its files do not
+// match the digest of its marker any more. A copy without digest has not
+// been written to outside of the replication as far as can be told.
+func movedPast(ctx context.Context, f fs.Fs, state *replicationState, generation int64) (bool, error) {
+	if state.Generation > generation {
+		return true, nil
+	}
+	if state.Digest == "" {
+		return false, nil
+	}
+	digest, err := listingDigest(ctx, f)
+	if err != nil {
+		return false, err
+	}
+	return digest != state.Digest, nil
+}
+
+// getSplitBrain returns the split brain the replica is fenced by, nil if it
+// is not fenced.
+func (j *syncJob) getSplitBrain() *SplitBrain {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.splitBrain
+}
+
+// splitBrainUnchecked tells whether the next pass of j must be a full pass
+// checking for a split brain: the replica is fenced, or its markers have not
+// been compared since the job started or they were last written, or the
+// target has not been synced since the source was promoted. Only called by
+// the job loop.
+func (j *syncJob) splitBrainUnchecked() bool {
+	if j.getSplitBrain() != nil || !j.statesLoaded {
+		return true
+	}
+	return j.sourceState != nil && j.targetState != nil && j.targetState.Epoch < j.sourceState.Epoch
+}
+
+// checkSplitBrain fences the replica if the source and the target have
+// diverged, and resolves the split brain once the copy to keep has been
+// chosen. ctx is the context of the pass. Returns true if the source is to
+// be replicated to the target. Only called by the job loop.
+func (j *syncJob) checkSplitBrain(ctx context.Context) bool {
+	if split := j.getSplitBrain(); split != nil {
+		if split.Winner == "" {
+			klog.V(4).Infof("Volume %q: replication to %s fenced since %v", j.spec.VolumeName, j.spec.Target, split.Time)
+			j.recordSync(errFenced)
+			return false
+		}
+		return j.resolveSplitBrain(ctx, split)
+	}
+	if !j.loadReplicationStates() {
+		return false
+	}
+	source, target := j.sourceState, j.targetState
+	common, ok := commonGeneration(source, target, j.spec.Source, j.spec.Target)
+	if !ok {
+		return true
+	}
+	// A target written to only is replaced by the pass, the source is not
+	// listed then.
+	targetMoved, err := movedPast(ctx, j.fdst, target, common)
+	if err != nil {
+		j.recordSync(err)
+		return false
+	}
+	if !targetMoved {
+		return true
+	}
+	sourceMoved, err := movedPast(ctx, j.fsrc, source, common)
+	if err != nil {
+		j.recordSync(err)
+		return false
+	}
+	if !sourceMoved {
+		return true
+	}
+
+	now := time.Now()
+	split := &SplitBrain{
+		Time:        now,
+		SourceEpoch: source.Epoch,
+		TargetEpoch: target.Epoch,
+		Generation:  common,
+		Token:       now.UTC().Format("20060102T150405Z"),
+	}
+	j.lock.Lock()
+	j.splitBrain = split
+	j.lock.Unlock()
+	j.recordSync(errFenced)
+	SM.SplitBrainFenced.WithLabelValues(j.metricLabels()...).Set(1)
+	j.event(v1.EventTypeWarning, "SplitBrain",
+		"Both %s and %s have been written to since generation %d, replication to %s is fenced. Annotate the claim with %s=%s:%s or %s=%s:%s to keep the copy of either",
+		j.spec.Source, j.spec.Target, split.Generation, j.spec.Target,
+		annSplitBrainWinner, j.spec.Source, split.Token, annSplitBrainWinner, j.spec.Target, split.Token)
+	return false
+}
+
+// resolveSplitBrain keeps the copy of the winner of split: a winning target
+// replaces the source, which replicates it to the other targets, a winning
+// source replaces the target with the pass. Returns true if the source is
+// to be replicated to the target.
+func (j *syncJob) resolveSplitBrain(ctx context.Context, split *SplitBrain) bool {
+	if !j.loadReplicationStates() || j.sourceState == nil || j.targetState == nil {
+		j.recordSync(errFenced)
+		return false
+	}
+	unlock := j.lockSource()
+	if split.Winner == j.spec.Target {
+		if err := sync.Sync(ctx, j.fsrc, j.fdst, false); err != nil {
+			unlock()
+			j.recordSync(err)
+			j.event(v1.EventTypeWarning, "SplitBrainResolutionFailed", "Failed to replace %s with the copy of %s: %v", j.fsrc, j.fdst, err)
+			return false
+		}
+	}
+	err := j.adoptSourceGeneration(split.Winner == j.spec.Target)
+	unlock()
+	if err != nil {
+		j.recordSync(err)
+		return false
+	}
+	j.lock.Lock()
+	j.splitBrain = nil
+	j.lock.Unlock()
+	SM.SplitBrainFenced.WithLabelValues(j.metricLabels()...).Set(0)
+	j.event(v1.EventTypeNormal, "SplitBrainResolved", "Keeping the copy of %s, replication to %s resumed", split.Winner, j.spec.Target)
+	return true
+}
+
+// adoptSourceGeneration records in the markers of both remotes that the
+// target is synced with the current generation of the source, which is
+// increased first if the source has been written to. The writes to the
+// target the split brain was resolved for are forgotten with its digest.
+// Called with the source locked.
+func (j *syncJob) adoptSourceGeneration(sourceWritten bool) error {
+	ctx := j.transferCtx
+	source, err := readReplicationState(ctx, j.fsrc)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		source = &replicationState{Volume: j.spec.VolumeName, LastSyncTime: time.Now()}
+	}
+	synced := map[string]int64{}
+	for remote, generation := range source.Synced {
+		synced[remote] = generation
+	}
+	source.Synced = synced
+	if sourceWritten {
+		source.Generation++
+		source.Digest = ""
+	}
+	source.Synced[j.spec.Target] = source.Generation
+	target := *j.targetState
+	if source.Epoch > target.Epoch {
+		target.Epoch = source.Epoch
+	}
+	target.Generation = source.Generation
+	target.Synced = map[string]int64{j.spec.Source: source.Generation}
+	target.Digest = ""
+	if err := writeReplicationState(ctx, j.fdst, &target); err != nil {
+		return err
+	}
+	j.targetState = &target
+	if err := writeReplicationState(ctx, j.fsrc, source); err != nil {
+		j.statesLoaded = false
+		return err
+	}
+	j.sourceState = source
+	return nil
+}
+
+// chooseWinner sets the remote whose copy is kept on the split brain of the
+// replica with the given token, resolved at the next pass. A target of
+// another replica of the volume wins through the source. Returns false if
+// the replica has no such split brain or winner is not a remote of the
+// volume.
+func (j *syncJob) chooseWinner(winner, token string) bool {
+	switch {
+	case winner == j.spec.Target:
+	case winner == j.spec.Source:
+	case j.replicas != nil && j.replicas.uses(winner):
+		winner = j.spec.Source
+	default:
+		return false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.splitBrain == nil || j.splitBrain.Token != token || j.splitBrain.Winner != "" {
+		return false
+	}
+	split := *j.splitBrain
+	split.Winner = winner
+	j.splitBrain = &split
+	return true
+}
+
+// parseSplitBrainWinner splits the value of the annSplitBrainWinner
+// annotation into the remote to keep and the token of the split brain.
+func parseSplitBrainWinner(value string) (winner, token string) {
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return value, ""
+	}
+	return value[:i], value[i+1:]
+}
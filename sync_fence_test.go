@@ -0,0 +1,185 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSplitBrain(t *testing.T) {
+	// The writes follow the passes at once.
+	defer func(interval time.Duration) { replicationDigestInterval = interval }(replicationDigestInterval)
+	replicationDigestInterval = 0
+	tests := []struct {
+		name string
+		// writeOld writes to the former primary copy after the promotion.
+		writeOld bool
+		fenced   bool
+	}{
+		{name: "promoted copy written to"},
+		{name: "both copies written to", writeOld: true, fenced: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sourceRoot, targetRoot := testRemotes(t)
+			writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "a", time.Now().Add(-time.Hour))
+			spec := SyncJobSpec{VolumeName: "pv-split"}
+			job := newTestSyncJob(t, spec)
+			if job.syncPass() || job.status().LastError != "" {
+				t.Fatalf("first pass failed: %+v", job.status())
+			}
+
+			// Promote the replica on target and replicate it back.
+			state, err := readReplicationState(context.Background(), job.fdst)
+			if err != nil || state == nil {
+				t.Fatalf("expected replication state but got %v", err)
+			}
+			state.Epoch++
+			state.Generation++
+			if err := writeReplicationState(context.Background(), job.fdst, state); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, filepath.Join(targetRoot, "vol-1", "new"), "new", time.Now().Add(time.Minute))
+			if test.writeOld {
+				writeFile(t, filepath.Join(sourceRoot, "vol-1", "old"), "old", time.Now().Add(time.Minute))
+			}
+			spec.Source, spec.Target = "target", "source"
+			promoted := newTestSyncJob(t, spec)
+			recorder := record.NewFakeRecorder(10)
+			promoted.recorder = recorder
+			labels := promoted.metricLabels()
+			if promoted.syncPass() {
+				t.Fatal("unexpected stop")
+			}
+
+			split := promoted.status().SplitBrain
+			if !test.fenced {
+				if split != nil || promoted.status().LastError != "" {
+					t.Fatalf("unexpected fence %+v: %s", split, promoted.status().LastError)
+				}
+				if !exists(filepath.Join(sourceRoot, "vol-1", "new")) {
+					t.Error("expected promoted copy to be replicated")
+				}
+				if state, _ := readReplicationState(context.Background(), promoted.fdst); state == nil || state.Epoch != 1 {
+					t.Errorf("expected epoch 1 on the former primary copy but got %+v", state)
+				}
+				return
+			}
+			if split == nil || split.SourceEpoch != 1 || split.TargetEpoch != 0 {
+				t.Fatalf("expected split brain but got %+v", split)
+			}
+			if exists(filepath.Join(sourceRoot, "vol-1", "new")) || !exists(filepath.Join(sourceRoot, "vol-1", "old")) {
+				t.Error("expected fenced replica to be left alone")
+			}
+			if fenced := testutil.ToFloat64(SM.SplitBrainFenced.WithLabelValues(labels...)); fenced != 1 {
+				t.Errorf("expected fenced metric but got %v", fenced)
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.Contains(event, "SplitBrain") || !strings.Contains(event, annSplitBrainWinner+"=source:"+split.Token) {
+					t.Errorf("unexpected event %q", event)
+				}
+			default:
+				t.Error("expected SplitBrain event")
+			}
+			// Further passes stay fenced until a winner is chosen.
+			promoted.syncPass()
+			if exists(filepath.Join(sourceRoot, "vol-1", "new")) || promoted.status().LastError != errFenced.Error() {
+				t.Errorf("expected replica to stay fenced but got %+v", promoted.status())
+			}
+
+			if promoted.chooseWinner("unknown", split.Token) {
+				t.Error("expected unknown remote to be rejected")
+			}
+			if winner, token := parseSplitBrainWinner("source:20210101T000000Z"); promoted.chooseWinner(winner, token) {
+				t.Error("expected token of another split brain to be rejected")
+			}
+			// The former primary copy wins.
+			if !promoted.chooseWinner(parseSplitBrainWinner("source:" + split.Token)) {
+				t.Fatal("expected winner to be chosen")
+			}
+			if promoted.syncPass() {
+				t.Fatal("unexpected stop")
+			}
+			if status := promoted.status(); status.SplitBrain != nil || status.LastError != "" {
+				t.Fatalf("expected split brain to be resolved but got %+v", status)
+			}
+			if !exists(filepath.Join(targetRoot, "vol-1", "old")) || exists(filepath.Join(targetRoot, "vol-1", "new")) {
+				t.Error("expected copy of the winner to be kept")
+			}
+			if fenced := testutil.ToFloat64(SM.SplitBrainFenced.WithLabelValues(labels...)); fenced != 0 {
+				t.Errorf("expected fenced metric to be reset but got %v", fenced)
+			}
+			if promoted.splitBrainUnchecked() {
+				t.Error("expected resolved replica to be checked")
+			}
+		})
+	}
+}
+
+func TestSplitBrainGenerations(t *testing.T) {
+	defer func(interval time.Duration) { replicationDigestInterval = interval }(replicationDigestInterval)
+	replicationDigestInterval = 0
+	sourceRoot, _ := testRemotes(t)
+	replica2 := filepath.Join(filepath.Dir(sourceRoot), "target2", "vol-1")
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "a", time.Now().Add(-time.Hour))
+	job := newTestSyncJob(t, SyncJobSpec{VolumeName: "pv-generations"})
+	job2 := newTestSyncJob(t, SyncJobSpec{VolumeName: "pv-generations", Target: "target2"})
+	for _, j := range []*syncJob{job, job2} {
+		if j.syncPass() || j.status().LastError != "" {
+			t.Fatalf("pass failed: %+v", j.status())
+		}
+	}
+	// Each replica keeps its own generation in the marker of the source.
+	state, err := readReplicationState(context.Background(), job.fsrc)
+	if err != nil || state == nil || state.Synced["target"] != state.Generation || state.Synced["target2"] != state.Generation {
+		t.Fatalf("expected generations of both targets but got %+v: %v", state, err)
+	}
+
+	// A replica written to alone is replaced.
+	writeFile(t, filepath.Join(replica2, "stray"), "stray", time.Now())
+	if job2.syncPass() || job2.status().SplitBrain != nil || exists(filepath.Join(replica2, "stray")) {
+		t.Fatalf("expected replica to be replaced but got %+v", job2.status())
+	}
+	if after, _ := readReplicationState(context.Background(), job.fsrc); after == nil || after.Generation != state.Generation {
+		t.Errorf("expected generation %d of the unchanged source but got %+v", state.Generation, after)
+	}
+
+	// A replica written to after missing a generation of the source has
+	// diverged, without any promotion.
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "b"), "b", time.Now())
+	if job.syncPass() || job.status().LastError != "" {
+		t.Fatalf("pass failed: %+v", job.status())
+	}
+	writeFile(t, filepath.Join(replica2, "stray"), "stray", time.Now())
+	if job2.syncPass() {
+		t.Fatal("unexpected stop")
+	}
+	if split := job2.status().SplitBrain; split == nil || split.Generation != state.Generation {
+		t.Fatalf("expected split brain since generation %d but got %+v", state.Generation, split)
+	}
+	if !exists(filepath.Join(replica2, "stray")) || job.status().SplitBrain != nil {
+		t.Error("expected only the diverged replica to be fenced")
+	}
+}
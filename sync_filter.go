@@ -0,0 +1,206 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// FilterSpec selects the files of a volume that are replicated, with the
+// rclone filter syntax. Files that are not selected are neither copied nor
+// deleted, on either remote. The rules apply in the order Rules, FilterFrom,
+// Exclude, Include; the first matching rule decides. If there are Include
+// patterns, files matching no rule are not selected.
+type FilterSpec struct {
+	// Rules are filter rules, "+ pattern" to include or "- pattern" to
+	// exclude matching files.
+	Rules []string
+	// FilterFrom are paths of files on the controller with more rules, one
+	// per line. They are read before every pass.
+	FilterFrom []string
+	// Exclude and Include are patterns of files to exclude and include.
+	Exclude []string
+	Include []string
+	// MinSize and MaxSize select files by size, 0 for no bound.
+	MinSize fs.SizeSuffix
+	MaxSize fs.SizeSuffix
+	// MaxAge selects files modified within MaxAge before each pass, 0 for
+	// no bound.
+	MaxAge time.Duration
+}
+
+// rooted tells whether the patterns of the filter may be anchored to the
+// volume root, so that the filter cannot be applied to a directory of the
+// volume on its own. Rules read from files are assumed to be.
+func (s FilterSpec) rooted() bool {
+	if len(s.FilterFrom) > 0 {
+		return true
+	}
+	for _, rule := range s.Rules {
+		pattern := strings.TrimPrefix(strings.TrimPrefix(rule, "+ "), "- ")
+		if strings.HasPrefix(pattern, "/") {
+			return true
+		}
+	}
+	for _, pattern := range append(append([]string{}, s.Exclude...), s.Include...) {
+		if strings.HasPrefix(pattern, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// newFilter returns the filter of a pass. stateFiles excludes the stateDir
+// in the root of the remotes, a filter for a directory of the volume does not
+// need to.
+func (s FilterSpec) newFilter(stateFiles bool) (*filter.Filter, error) {
+	opt := filter.DefaultOpt
+	if s.MinSize > 0 {
+		opt.MinSize = s.MinSize
+	}
+	if s.MaxSize > 0 {
+		opt.MaxSize = s.MaxSize
+	}
+	if s.MaxAge > 0 {
+		opt.MaxAge = fs.Duration(s.MaxAge)
+	}
+	f, err := filter.NewFilter(&opt)
+	if err != nil {
+		return nil, err
+	}
+	if stateFiles {
+		if err := f.Add(false, stateDirRule); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range s.Rules {
+		if err := addFilterRule(f, rule); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range s.FilterFrom {
+		if err := addFilterRules(f, path); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range s.Exclude {
+		if err := f.Add(false, pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range s.Include {
+		if err := f.Add(true, pattern); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.Include) > 0 {
+		if err := f.Add(false, "**"); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// addFilterRule adds a "+ pattern" or "- pattern" rule to f. The "!" rule of
+// rclone, which clears the rules added before, is rejected as it would
+// clear the exclusion of the state files.
+func addFilterRule(f *filter.Filter, rule string) error {
+	if rule == "!" {
+		return fmt.Errorf("filter rule %q is not supported", rule)
+	}
+	return f.AddRule(rule)
+}
+
+// addFilterRules adds the rules of the file at path to f. Empty lines and
+// lines starting with # or ; are ignored.
+func addFilterRules(f *filter.Filter, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if err := addFilterRule(f, line); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseFilterRules splits the value of paramFilter into rules, one per line.
+// Empty lines and lines starting with # or ; are ignored.
+func parseFilterRules(value string) []string {
+	var rules []string
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	return rules
+}
+
+// parsePatterns splits the value of paramInclude or paramExclude into
+// patterns separated by newlines or commas. Commas within braces belong to
+// the pattern, as in "*.{tmp,swp}".
+func parsePatterns(value string) []string {
+	var patterns []string
+	add := func(pattern string) {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	depth, start := 0, 0
+	for i, c := range value {
+		switch {
+		case c == '{':
+			depth++
+		case c == '}' && depth > 0:
+			depth--
+		case c == '\n' || c == ',' && depth == 0:
+			add(value[start:i])
+			start = i + 1
+		}
+	}
+	add(value[start:])
+	return patterns
+}
+
+// includedEntry tells whether the rules of f select an entry of a listing.
+// Sizes and ages are ignored: an old file still counts when telling whether
+// a volume is empty.
+func includedEntry(ctx context.Context, f *filter.Filter, entry fs.DirEntry) bool {
+	if _, ok := entry.(fs.Directory); ok {
+		include, err := f.IncludeDirectory(ctx, nil)(entry.Remote())
+		return err != nil || include
+	}
+	return f.IncludeRemote(entry.Remote())
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterSpec(t *testing.T) {
+	if patterns := parsePatterns("*.{tmp,swp}, cache/**\nlost+found/"); !reflect.DeepEqual(patterns, []string{"*.{tmp,swp}", "cache/**", "lost+found/"}) {
+		t.Errorf("unexpected patterns %q", patterns)
+	}
+
+	tests := []struct {
+		name     string
+		filter   FilterSpec
+		included map[string]bool
+		rooted   bool
+	}{
+		{
+			name:     "state files",
+			included: map[string]bool{"a": true, replicationStateFile: false, checkpointFile: false, bidirListingFile("target"): false, "dir/" + replicationStateFile: true},
+		},
+		{
+			name:     "exclude",
+			filter:   FilterSpec{Exclude: []string{"*.tmp", "lost+found/"}},
+			included: map[string]bool{"a": true, "dir/b.tmp": false, "lost+found/c": false},
+		},
+		{
+			name:     "exclude wins over include",
+			filter:   FilterSpec{Include: []string{"data/**"}, Exclude: []string{"*.lock"}},
+			included: map[string]bool{"data/a": true, "data/b.lock": false, "c": false, replicationStateFile: false},
+		},
+		{
+			name:     "rules first",
+			filter:   FilterSpec{Rules: []string{"+ keep.tmp", "- /cache/**"}, Exclude: []string{"*.tmp"}},
+			included: map[string]bool{"keep.tmp": true, "other.tmp": false, "cache/a": false, "dir/cache/a": true},
+			rooted:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := test.filter.newFilter(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for remote, expected := range test.included {
+				if included := f.Include(remote, 1, time.Now()); included != expected {
+					t.Errorf("expected %s to be included: %t", remote, expected)
+				}
+			}
+			if rooted := test.filter.rooted(); rooted != test.rooted {
+				t.Errorf("expected rooted %t", test.rooted)
+			}
+		})
+	}
+
+	if _, err := (FilterSpec{Rules: []string{"!"}}).newFilter(true); err == nil {
+		t.Error("expected rule clearing the filter to be rejected")
+	}
+}
+
+func TestApplyFilterParameters(t *testing.T) {
+	var spec SyncJobSpec
+	if err := applySyncParameters(&spec, map[string]string{
+		"exclude": "*.tmp",
+		"maxSize": "1G",
+		"maxAge":  "7d",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyClaimAnnotations(&spec, map[string]string{annExclude: "*.tmp,*.lock", annInclude: "data/**"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := FilterSpec{
+		Exclude: []string{"*.tmp", "*.lock"},
+		Include: []string{"data/**"},
+		MaxSize: 1 << 30,
+		MaxAge:  7 * 24 * time.Hour,
+	}
+	if !reflect.DeepEqual(spec.Filter, expected) {
+		t.Errorf("expected filter %+v but got %+v", expected, spec.Filter)
+	}
+	for _, parameters := range []map[string]string{
+		{"maxSize": "big"},
+		{"maxAge": "-1d"},
+		{"filter": "* pattern"},
+	} {
+		if err := applySyncParameters(&SyncJobSpec{}, parameters); err == nil {
+			t.Errorf("expected %v to be rejected", parameters)
+		}
+	}
+}
+
+func TestFilteredSync(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "a", time.Now())
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "b.tmp"), "b", time.Now())
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "cache", "c"), "c", time.Now())
+	writeFile(t, filepath.Join(targetRoot, "vol-1", "d.tmp"), "d", time.Now())
+
+	job := newTestSyncJob(t, SyncJobSpec{
+		VolumeName: "pv-1",
+		Filter:     FilterSpec{Exclude: []string{"*.tmp", "cache/"}},
+	})
+	if job.syncPass() {
+		t.Fatal("unexpected stop")
+	}
+	targetDir := filepath.Join(targetRoot, "vol-1")
+	if !exists(filepath.Join(targetDir, "a")) {
+		t.Error("expected included file to be replicated")
+	}
+	if exists(filepath.Join(targetDir, "b.tmp")) || exists(filepath.Join(targetDir, "cache", "c")) {
+		t.Error("expected excluded files not to be replicated")
+	}
+	if !exists(filepath.Join(targetDir, "d.tmp")) {
+		t.Error("expected excluded file on the target not to be deleted")
+	}
+}
@@ -0,0 +1,1254 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	klog "k8s.io/klog/v2"
+)
+
+// SyncJobState is the lifecycle state of a replication job.
+type SyncJobState string
+
+const (
+	// SyncJobRunning tells that the job replicates its volume on every tick.
+	SyncJobRunning SyncJobState = "Running"
+	// SyncJobPaused tells that the job is alive but skips replication until
+	// it is resumed.
+	SyncJobPaused SyncJobState = "Paused"
+	// SyncJobStopped tells that the job has exited and does not replicate its
+	// volume any longer.
+	SyncJobStopped SyncJobState = "Stopped"
+)
+
+// ReplicationPhase summarizes the replication of a volume.
+type ReplicationPhase string
+
+const (
+	// ReplicationSynced tells that the last pass of every replica found
+	// nothing to replicate.
+	ReplicationSynced ReplicationPhase = "Synced"
+	// ReplicationSyncing tells that a replica has not completed a pass yet
+	// or its last pass replicated changes.
+	ReplicationSyncing ReplicationPhase = "Syncing"
+	// ReplicationDegraded tells that fewer than MinReplicas replicas are
+	// healthy.
+	ReplicationDegraded ReplicationPhase = "Degraded"
+	// ReplicationRecovering tells that the source is being restored from a
+	// replica.
+	ReplicationRecovering ReplicationPhase = "Recovering"
+	// ReplicationNeedsAttention tells that a replica is frozen by the
+	// deletion brake until an operator acknowledges the deletion.
+	ReplicationNeedsAttention ReplicationPhase = "NeedsAttention"
+	// ReplicationFenced tells that a replica is fenced after a split brain
+	// until an operator chooses the copy to keep.
+	ReplicationFenced ReplicationPhase = "Fenced"
+)
+
+// ErrSyncJobNotFound is returned by SyncManager when no job is registered for
+// the given volume.
+var ErrSyncJobNotFound = errors.New("sync job not found")
+
+// SyncJobSpec describes the replication of a single PersistentVolume.
+type SyncJobSpec struct {
+	// VolumeName is the name of the PersistentVolume. It is the key of the job.
+	VolumeName string
+	// Source is the rclone remote holding the primary copy of the volume.
+	Source string
+	// Target is the rclone remote holding the replica of the volume. For a
+	// volume with several replicas it is the target of a single job.
+	Target string
+	// Targets are the rclone remotes holding a replica of the volume each.
+	// Defaults to Target.
+	Targets []string
+	// MinReplicas is the number of replicas that must be healthy for the
+	// volume not to be degraded. Defaults to the number of targets. An
+	// erasure coded volume is a single replica.
+	MinReplicas int
+	// Layout is how the volume is stored on the targets.
+	Layout Layout
+	// ParityShards is the number of targets holding parity in the erasure
+	// layout.
+	ParityShards int
+	// Directory is the volume directory on the remotes: the PV name for new
+	// volumes, the NFS path of the PV for existing ones.
+	Directory string
+	// ClaimNamespace and ClaimName identify the claim the volume is bound
+	// to. For new volumes they are part of the directory name on the remotes.
+	ClaimNamespace string
+	ClaimName      string
+	// ClaimUID is the UID of the claim, events about the replication are
+	// recorded on it.
+	ClaimUID types.UID
+	// StorageClass is the name of the StorageClass of the volume.
+	StorageClass string
+	// New is true for volumes that have just been provisioned and may still
+	// be empty on both remotes.
+	New bool
+
+	// Mode is how changes of the source are detected.
+	Mode SyncMode
+	// NotifyDebounce is how long the source must be quiet after a change
+	// notification before the changed directories are replicated, at most
+	// ten times as long after the first change.
+	NotifyDebounce time.Duration
+	// NotifyResyncInterval is how often a full pass runs in notify mode.
+	NotifyResyncInterval time.Duration
+	// MinSyncInterval and MaxSyncInterval bound the interval between passes
+	// in poll mode, which backs off while the volume does not change.
+	MinSyncInterval time.Duration
+	MaxSyncInterval time.Duration
+	// Direction is which way changes are replicated.
+	Direction SyncDirection
+	// ConflictPolicy resolves files changed on both remotes in two-way
+	// replication.
+	ConflictPolicy ConflictPolicy
+	// ScrubInterval is how often every file of the replicas is compared
+	// with the source, ScrubRepair whether divergences are repaired.
+	ScrubInterval time.Duration
+	ScrubRepair   bool
+	// Filter selects the files that are replicated.
+	Filter FilterSpec
+	// DeletionBrake bounds the files a pass may delete.
+	DeletionBrake DeletionBrake
+	// Versioning keeps the files replaced on the target.
+	Versioning VersioningSpec
+	// Failover promotes a replica when the source is unreachable.
+	Failover FailoverSpec
+	// Encryption encrypts the replicas.
+	Encryption EncryptionSpec
+	// Compression compresses the replicas.
+	Compression CompressionSpec
+	// BandwidthLimit caps the rate at which the volume is replicated, by
+	// time of day. Empty for no limit of its own.
+	BandwidthLimit fs.BwTimetable
+	// BandwidthPriority is the weight of the volume when the bandwidth of
+	// the controller is shared.
+	BandwidthPriority int
+}
+
+// setDefaults sets the fields controlling replication that are not set to
+// the defaults of the StorageClass parameters.
+func (spec *SyncJobSpec) setDefaults() {
+	if len(spec.Targets) == 0 && spec.Target != "" {
+		spec.Targets = []string{spec.Target}
+	}
+	if spec.Layout == "" {
+		spec.Layout = DefaultLayout
+	}
+	if spec.Layout == LayoutErasure {
+		if spec.ParityShards == 0 {
+			spec.ParityShards = DefaultParityShards
+		}
+		spec.MinReplicas = 1
+	}
+	if spec.MinReplicas == 0 {
+		spec.MinReplicas = len(spec.Targets)
+	}
+	if spec.Mode == "" {
+		spec.Mode = SyncModePoll
+	}
+	if spec.NotifyDebounce == 0 {
+		spec.NotifyDebounce = DefaultNotifyDebounce
+	}
+	if spec.NotifyResyncInterval == 0 {
+		spec.NotifyResyncInterval = DefaultNotifyResyncInterval
+	}
+	if spec.MinSyncInterval == 0 {
+		spec.MinSyncInterval = DefaultSyncInterval
+	}
+	if spec.MaxSyncInterval < spec.MinSyncInterval {
+		spec.MaxSyncInterval = spec.MinSyncInterval
+	}
+	if spec.Direction == "" {
+		spec.Direction = DefaultSyncDirection
+	}
+	if spec.ConflictPolicy == "" {
+		spec.ConflictPolicy = DefaultConflictPolicy
+	}
+	if spec.ScrubInterval == 0 {
+		spec.ScrubInterval = DefaultScrubInterval
+	}
+	if spec.BandwidthPriority == 0 {
+		spec.BandwidthPriority = DefaultBandwidthPriority
+	}
+}
+
+// validate checks the remotes of a spec with defaults set.
+func (spec *SyncJobSpec) validate() error {
+	if len(spec.Source) == 0 || len(spec.Targets) == 0 {
+		return fmt.Errorf("volume %q: source and target remote must be set", spec.VolumeName)
+	}
+	seen := map[string]bool{}
+	for _, target := range spec.Targets {
+		switch {
+		case target == "":
+			return fmt.Errorf("volume %q: empty target remote", spec.VolumeName)
+		case target == spec.Source:
+			return fmt.Errorf("volume %q: target remote %q is the source", spec.VolumeName, target)
+		case seen[target]:
+			return fmt.Errorf("volume %q: duplicate target remote %q", spec.VolumeName, target)
+		}
+		seen[target] = true
+	}
+	if spec.Layout == LayoutErasure && (spec.ParityShards < 1 || spec.ParityShards >= len(spec.Targets)) {
+		return fmt.Errorf("volume %q: %d parity shards with %d targets", spec.VolumeName, spec.ParityShards, len(spec.Targets))
+	}
+	if spec.Layout != LayoutErasure && (spec.MinReplicas < 1 || spec.MinReplicas > len(spec.Targets)) {
+		return fmt.Errorf("volume %q: minimum of %d replicas with %d targets", spec.VolumeName, spec.MinReplicas, len(spec.Targets))
+	}
+	if spec.Layout == LayoutErasure && spec.Versioning.Enabled {
+		return fmt.Errorf("volume %q: versioning is not supported with erasure coding", spec.VolumeName)
+	}
+	if spec.Layout == LayoutErasure && spec.Failover.enabled() {
+		return fmt.Errorf("volume %q: failover is not supported with erasure coding", spec.VolumeName)
+	}
+	if spec.Encryption.enabled() {
+		switch {
+		case spec.Layout == LayoutErasure:
+			return fmt.Errorf("volume %q: encryption is not supported with erasure coding", spec.VolumeName)
+		case spec.Versioning.Enabled:
+			return fmt.Errorf("volume %q: versioning is not supported with encryption", spec.VolumeName)
+		case spec.Failover.enabled():
+			// An encrypted replica cannot be exported.
+			return fmt.Errorf("volume %q: failover is not supported with encryption", spec.VolumeName)
+		}
+	}
+	if spec.Compression.Enabled {
+		switch {
+		case spec.Layout == LayoutErasure:
+			return fmt.Errorf("volume %q: compression is not supported with erasure coding", spec.VolumeName)
+		case spec.Versioning.Enabled:
+			return fmt.Errorf("volume %q: versioning is not supported with compression", spec.VolumeName)
+		case spec.Failover.enabled():
+			// A compressed replica cannot be exported.
+			return fmt.Errorf("volume %q: failover is not supported with compression", spec.VolumeName)
+		case spec.Encryption.enabled():
+			return fmt.Errorf("volume %q: compression is not supported with encryption", spec.VolumeName)
+		}
+	}
+	return nil
+}
+
+// SyncJobStatus is a point-in-time copy of the state of the replication of a
+// volume to all of its targets.
+type SyncJobStatus struct {
+	SyncJobSpec
+
+	// State is Running while any replica is running and Paused while all
+	// replicas that did not stop are paused.
+	State     SyncJobState
+	Phase     ReplicationPhase
+	StartTime time.Time
+	// LastSyncTime is the oldest last successful pass of the replicas: the
+	// volume is replicated to all targets as of then.
+	LastSyncTime time.Time
+	// LastError is the error of the last pass of the first failing replica.
+	LastError string
+	// SyncInterval is the current shortest interval between passes.
+	SyncInterval time.Duration
+	// BytesTransferred is the number of bytes copied between the source and
+	// the replicas since the replication started.
+	BytesTransferred int64
+
+	// Replicas is the status of the replication to each target.
+	Replicas []ReplicaStatus
+	// HealthyReplicas is the number of replicas whose last pass did not
+	// fail. The volume is degraded while it is below MinReplicas or the
+	// source is unreachable.
+	HealthyReplicas   int
+	Degraded          bool
+	SourceUnreachable bool
+	// UnhealthyRemotes are the source and targets found unhealthy by the
+	// health probes of the remotes and the targets the replication could
+	// not be started to.
+	UnhealthyRemotes []string
+	// InitialSync is the combined progress of the initial syncs of the
+	// replicas, nil if none is running.
+	InitialSync *InitialSyncProgress
+}
+
+// ReplicaStatus is a point-in-time copy of the state of the replication of a
+// volume to one target.
+type ReplicaStatus struct {
+	Target       string
+	State        SyncJobState
+	LastSyncTime time.Time
+	LastError    string
+	// SyncInterval is the current interval between passes.
+	SyncInterval time.Duration
+	// LastScrub is the result of the last scrub, nil if the replica has not
+	// been scrubbed yet.
+	LastScrub *ScrubResult
+	// Settled tells whether the last pass found nothing to replicate,
+	// Recovering whether the source is being restored from the replica.
+	Settled          bool
+	Recovering       bool
+	BytesTransferred int64
+	// DeletionHold is the pass held back by the deletion brake, nil if the
+	// replica is not frozen.
+	DeletionHold *DeletionHold
+	// SourceFailures is the number of passes in a row that failed to list
+	// the source.
+	SourceFailures int
+	// SplitBrain is the split brain the replica is fenced by, nil if it is
+	// not fenced.
+	SplitBrain *SplitBrain
+	// InitialSync is the progress of the initial sync of the replica, nil
+	// if none is running.
+	InitialSync *InitialSyncProgress
+	// KeyRotation is the progress of the re-encryption of the replica, nil
+	// if none is running.
+	KeyRotation *KeyRotation
+}
+
+// healthy tells whether the last pass of the replica did not fail. A
+// replica that has not completed a pass yet is healthy.
+func (status ReplicaStatus) healthy() bool {
+	return status.State != SyncJobStopped && status.LastError == ""
+}
+
+// syncJob is the replication job of one volume to one target, run by
+// csisync.
+type syncJob struct {
+	spec SyncJobSpec
+	fsrc fs.Fs
+	fdst fs.Fs
+	// replicas are the jobs of all targets of the volume, nil for a job run
+	// on its own.
+	replicas *replicaSet
+	// erasure is fdst unless it is throttled, nil if the volume is not
+	// erasure coded.
+	erasure *erasureFs
+	// bandwidth limits the reads of fsrc and fdst, nil if they are not
+	// limited.
+	bandwidth *volumeBandwidth
+	// scheduler bounds the passes running at once, nil for no bound.
+	scheduler *passScheduler
+	// goBackground runs work of the job outside of its passes, tracked by
+	// the sync manager. nil runs it in a plain goroutine.
+	goBackground func(f func(ctx context.Context)) bool
+
+	// transferCtx is used for all rclone calls of the job. It outlives the
+	// loop context passed to csisync so that a pass in flight can be
+	// drained when the job is asked to stop.
+	transferCtx context.Context
+	cancel      context.CancelFunc
+	done        chan struct{}
+
+	// identity is the controller ID written to the replication state,
+	// recorder records events on the claim. recorder may be nil.
+	identity string
+	recorder record.EventRecorder
+
+	// lastChanges is the number of files transferred or deleted by the
+	// last pass. Only used by the job loop.
+	lastChanges int64
+	// sourceState and targetState are the markers last read or written,
+	// statesLoaded tells whether they have been read yet. lastDecision is
+	// the recovery decision reported last, to report each decision once.
+	// Only used by the job loop.
+	sourceState  *replicationState
+	targetState  *replicationState
+	statesLoaded bool
+	lastDecision recoveryDecision
+	// digestsListed is when the digests of the copies were listed last,
+	// anchored tells whether the anchor of the source has been written.
+	// Only used by the job loop.
+	digestsListed time.Time
+	anchored      bool
+	// listing is the result of the last two-way pass, nil if there has been
+	// none. Only used by the job loop.
+	listing *bidirListing
+	// lastRepair is when the shards of an erasure coded target were checked
+	// last, lastScrub when the replica was scrubbed last. Only used by the
+	// job loop.
+	lastRepair time.Time
+	lastScrub  time.Time
+	// acknowledged tells whether the current pass follows the
+	// acknowledgement of a deletion. Only used by the job loop.
+	acknowledged bool
+	// versions holds the files the current pass replaces on the target,
+	// nil without versioning. lastPrune is when the retention rules were
+	// enforced last. Only used by the job loop.
+	versions  fs.Fs
+	lastPrune time.Time
+	// passLock serializes the passes of the job loop with those run for
+	// snapshots.
+	passLock sync.Mutex
+
+	lock         sync.Mutex
+	state        SyncJobState
+	startTime    time.Time
+	lastSyncTime time.Time
+	lastError    string
+	interval     time.Duration
+	// passStart is when the current pass began. Only used by the job loop.
+	passStart        time.Time
+	settled          bool
+	recovering       bool
+	bytesTransferred int64
+	// lastScrubResult is not changed once published.
+	lastScrubResult *ScrubResult
+	// hold is not changed once published.
+	hold           *DeletionHold
+	sourceFailures int
+	// splitBrain is not changed once published.
+	splitBrain *SplitBrain
+	// initialSyncProgress is not changed once published.
+	initialSyncProgress *InitialSyncProgress
+
+	// plainTarget is the target of an encrypted or compressed replica as
+	// stored, fdst its encrypted file system of key or its compressed file
+	// system. staleKey is a former key files may be left encrypted with.
+	// rotation is the re-encryption running in the background, nil if none
+	// is. Only used by the job loop, fdst and key are changed under lock
+	// and the source lock, rotation under lock.
+	plainTarget  fs.Fs
+	key          cryptKey
+	staleKey     *cryptKey
+	lastKeyCheck time.Time
+	rotation     *keyRotation
+	// lastCompressionCheck is when the compression ratio was last measured.
+	lastCompressionCheck time.Time
+}
+
+// newSyncJob resolves the remotes of spec to file systems.
+func newSyncJob(ctx context.Context, spec SyncJobSpec) (*syncJob, error) {
+	if len(spec.Source) == 0 || len(spec.Target) == 0 {
+		return nil, fmt.Errorf("volume %q: source and target remote must be set", spec.VolumeName)
+	}
+	spec.setDefaults()
+	loadRcloneConfig()
+
+	fsrc, err := spec.newFs(ctx, spec.Source)
+	if err != nil {
+		return nil, fmt.Errorf("volume %q: %v", spec.VolumeName, err)
+	}
+	var fdst fs.Fs
+	var erasure *erasureFs
+	if spec.Layout == LayoutErasure {
+		shards := make([]fs.Fs, len(spec.Targets))
+		for i, target := range spec.Targets {
+			if shards[i], err = spec.newFs(ctx, target); err != nil {
+				return nil, fmt.Errorf("volume %q: %v", spec.VolumeName, err)
+			}
+		}
+		f, err := newErasureFs(ctx, spec.Target, shards, spec.ParityShards)
+		if err != nil {
+			return nil, fmt.Errorf("volume %q: %v", spec.VolumeName, err)
+		}
+		fdst, erasure = f, f
+	} else if fdst, err = spec.newFs(ctx, spec.Target); err != nil {
+		return nil, fmt.Errorf("volume %q: %v", spec.VolumeName, err)
+	}
+	if _, err := spec.Filter.newFilter(true); err != nil {
+		return nil, fmt.Errorf("volume %q: invalid filter: %v", spec.VolumeName, err)
+	}
+
+	return &syncJob{
+		spec:        spec,
+		fsrc:        fsrc,
+		fdst:        fdst,
+		erasure:     erasure,
+		transferCtx: ctx,
+		done:        make(chan struct{}),
+		state:       SyncJobRunning,
+		// The first scrub runs one interval after the start.
+		lastScrub: time.Now(),
+	}, nil
+}
+
+// newFs returns the file system of the volume directory on remote, created
+// for a new volume.
+func (spec *SyncJobSpec) newFs(ctx context.Context, remote string) (fs.Fs, error) {
+	if spec.New {
+		return newFsDir(ctx, remote, spec.Directory, spec.ClaimNamespace, spec.ClaimName)
+	}
+	return newFsDirFromVolume(ctx, remote, spec.Directory)
+}
+
+// targetRemotes returns the remotes a pass of the job replicates to, by
+// which the scheduler bounds the passes per remote. The source is left out:
+// the volumes of a controller usually share one, whose passes are bounded by
+// the total only.
+func (j *syncJob) targetRemotes() []string {
+	targets := []string{j.spec.Target}
+	if j.spec.Layout == LayoutErasure {
+		targets = j.spec.Targets
+	}
+	var remotes []string
+	for _, target := range targets {
+		if target != j.spec.Source {
+			remotes = append(remotes, target)
+		}
+	}
+	return remotes
+}
+
+func (j *syncJob) status() ReplicaStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return ReplicaStatus{
+		Target:       j.spec.Target,
+		State:        j.state,
+		LastSyncTime: j.lastSyncTime,
+		LastError:    j.lastError,
+		SyncInterval: j.interval,
+		LastScrub:    j.lastScrubResult,
+
+		Settled:          j.settled,
+		Recovering:       j.recovering,
+		BytesTransferred: j.bytesTransferred,
+		DeletionHold:     j.hold,
+		SourceFailures:   j.sourceFailures,
+		SplitBrain:       j.splitBrain,
+		InitialSync:      j.initialSyncProgress,
+		KeyRotation:      j.rotation.progress(),
+	}
+}
+
+func (j *syncJob) setInterval(interval time.Duration) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.interval = interval
+}
+
+// beginPass returns the context for the rclone calls of a pass, accounting
+// them in the stats group of the job.
+func (j *syncJob) beginPass() context.Context {
+	j.passStart = time.Now()
+	ctx := accounting.WithStatsGroup(j.transferCtx, "csiraid-"+j.spec.VolumeName+"-"+j.spec.Target)
+	accounting.Stats(ctx).ResetCounters()
+	return ctx
+}
+
+// endPass records how many files the pass that used ctx changed and what it
+// transferred, and writes the index of an erasure coded target.
+func (j *syncJob) endPass(ctx context.Context) {
+	j.lastChanges = passChanges(ctx)
+	stats := accounting.Stats(ctx)
+	j.lock.Lock()
+	j.settled = j.lastError == "" && j.lastChanges == 0 && !j.lastSyncTime.IsZero()
+	j.bytesTransferred += stats.GetBytes()
+	j.lock.Unlock()
+	labels := j.metricLabels()
+	SM.BytesTransferredTotal.WithLabelValues(labels...).Add(float64(stats.GetBytes()))
+	SM.FilesTransferredTotal.WithLabelValues(labels...).Add(float64(stats.GetTransfers()))
+	if j.erasure != nil {
+		if err := j.erasure.flush(j.transferCtx); err != nil {
+			klog.Infof("Volume %q: %v", j.spec.VolumeName, err)
+		}
+	}
+}
+
+// passChanges returns how many files the pass that used ctx has changed so
+// far.
+func passChanges(ctx context.Context) int64 {
+	stats := accounting.Stats(ctx)
+	return stats.GetTransfers() + stats.Deletes(0) + stats.Renames(0)
+}
+
+// event logs an event about the replication of the volume and records it on
+// the claim if the volume is bound to one.
+func (j *syncJob) event(eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	if eventtype == v1.EventTypeWarning {
+		klog.Warningf("Volume %q: %s: %s", j.spec.VolumeName, reason, message)
+	} else {
+		klog.Infof("Volume %q: %s: %s", j.spec.VolumeName, reason, message)
+	}
+	if j.recorder == nil || j.spec.ClaimName == "" {
+		return
+	}
+	claim := &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  j.spec.ClaimNamespace,
+		Name:       j.spec.ClaimName,
+		UID:        j.spec.ClaimUID,
+	}
+	j.recorder.Event(claim, eventtype, reason, message)
+}
+
+func (j *syncJob) setRecovering(recovering bool) {
+	j.lock.Lock()
+	j.recovering = recovering
+	j.lock.Unlock()
+	j.replicas.reportStatus()
+}
+
+func (j *syncJob) getState() SyncJobState {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.state
+}
+
+func (j *syncJob) setState(state SyncJobState) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.state = state
+}
+
+func (j *syncJob) transition(from, to SyncJobState) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.state == to {
+		return nil
+	}
+	if j.state != from {
+		return fmt.Errorf("sync job for volume %q to %q is %s, not %s", j.spec.VolumeName, j.spec.Target, j.state, from)
+	}
+	klog.Infof("Sync job for volume %q to %q: %s -> %s", j.spec.VolumeName, j.spec.Target, from, to)
+	j.state = to
+	return nil
+}
+
+// recordSync stores the outcome of a single replication pass.
+func (j *syncJob) recordSync(err error) {
+	labels := j.metricLabels()
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err != nil {
+		j.lastError = err.Error()
+		SM.SyncErrorsTotal.WithLabelValues(labels...).Inc()
+		return
+	}
+	j.lastError = ""
+	j.lastSyncTime = time.Now()
+	SM.SyncDurationSeconds.WithLabelValues(labels...).Observe(j.lastSyncTime.Sub(j.passStart).Seconds())
+	SM.LastSuccessTimestampSeconds.WithLabelValues(labels...).Set(float64(j.lastSyncTime.Unix()))
+}
+
+// SyncManager owns the replication jobs of all volumes of a controller, keyed
+// by PV name, one job per target. Jobs live until they are stopped, their
+// volume turns out to be gone or the manager is shut down.
+type SyncManager struct {
+	// ctx is the parent of all rclone calls, loopCtx the parent of all job
+	// loops. Shutdown, called by Run once the context of the controller is
+	// done, cancels loopCtx first and ctx only after the drain timeout.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	loopCtx    context.Context
+	loopCancel context.CancelFunc
+
+	// identity is written to the replication state of the volumes, events
+	// about their replication are recorded with eventRecorder.
+	identity      string
+	eventRecorder record.EventRecorder
+	// statusHandler is called with the status of a volume after every pass
+	// of its replicas, nil if not set.
+	statusHandler func(SyncJobStatus)
+	// failoverHandler is called with the status of a volume whose source is
+	// unreachable and the target to promote, nil if not set.
+	failoverHandler func(SyncJobStatus, string)
+	// remoteHealthy tells whether a remote is healthy, nil if remotes are
+	// not probed.
+	remoteHealthy func(string) bool
+	// secretReader reads the Secrets holding encryption keys, nil if not
+	// set.
+	secretReader secretReader
+	// bandwidth shares the bandwidth of the controller between the volumes.
+	bandwidth *bandwidthScheduler
+	// scheduler bounds the replication passes running at once.
+	scheduler *passScheduler
+
+	// wg tracks job loops and background operations such as purges.
+	wg           sync.WaitGroup
+	shutdownOnce sync.Once
+
+	lock    sync.Mutex
+	volumes map[string]*replicaSet
+}
+
+// NewSyncManager returns a SyncManager without any jobs. identity is the ID
+// of the controller, eventRecorder may be nil if events should only be
+// logged. Replication runs until the context passed to Run is done or
+// Shutdown is called.
+func NewSyncManager(identity string, eventRecorder record.EventRecorder) *SyncManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	loopCtx, loopCancel := context.WithCancel(ctx)
+	bandwidth := newBandwidthScheduler()
+	go bandwidth.run(loopCtx)
+	return &SyncManager{
+		ctx:           ctx,
+		cancel:        cancel,
+		loopCtx:       loopCtx,
+		loopCancel:    loopCancel,
+		identity:      identity,
+		eventRecorder: eventRecorder,
+		bandwidth:     bandwidth,
+		scheduler:     newPassScheduler(DefaultMaxConcurrentSyncs, DefaultMaxConcurrentSyncsPerRemote),
+		volumes:       map[string]*replicaSet{},
+	}
+}
+
+// SetConcurrency bounds the replication passes running at once to maxTotal
+// and those replicating to the same target remote to maxPerRemote. 0 means
+// no bound. Passes that are due wait in a queue in the order they became
+// due.
+func (m *SyncManager) SetConcurrency(maxTotal, maxPerRemote int) {
+	m.scheduler.setLimits(maxTotal, maxPerRemote)
+}
+
+// SetBandwidthLimit caps the rate at which all volumes together are
+// replicated, by time of day. The bandwidth is shared between the volumes
+// transferring data by their BandwidthPriority. An empty timetable removes
+// the limit of volumes started afterwards.
+func (m *SyncManager) SetBandwidthLimit(limit fs.BwTimetable) {
+	m.bandwidth.setLimit(limit)
+}
+
+// SetStatusHandler sets a function called with the status of the
+// replication of a volume after every pass of its replicas and whenever the
+// recovery of its source starts or ends. It is called from the job loops and
+// must not block. Applies to volumes started afterwards.
+func (m *SyncManager) SetStatusHandler(handler func(SyncJobStatus)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.statusHandler = handler
+}
+
+// SetFailoverHandler sets a function called with the status of the
+// replication of a volume and the target of its replica to promote once its
+// source failed FailoverSpec.Threshold passes in a row. It is called from the
+// job loops and must not block. Applies to volumes started afterwards.
+func (m *SyncManager) SetFailoverHandler(handler func(SyncJobStatus, string)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.failoverHandler = handler
+}
+
+// SetRemoteHealth sets a function telling whether a remote is healthy.
+// Volumes whose source or a target is unhealthy are degraded. Applies to
+// volumes started afterwards.
+func (m *SyncManager) SetRemoteHealth(healthy func(remote string) bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.remoteHealthy = healthy
+}
+
+// SetSecretReader sets a function returning the data of a Secret, used to
+// read the keys of encrypted volumes. Applies to volumes started afterwards.
+func (m *SyncManager) SetSecretReader(read func(ctx context.Context, namespace, name string) (map[string][]byte, error)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.secretReader = read
+}
+
+// remotes returns the sources and targets of the volumes of the manager.
+func (m *SyncManager) remotes() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var remotes []string
+	for _, r := range m.volumes {
+		remotes = append(remotes, r.spec.Source)
+		remotes = append(remotes, r.spec.Targets...)
+	}
+	return remotes
+}
+
+// remoteHealthChanged reports the volumes stored on remote, which turned
+// unhealthy or healthy again.
+func (m *SyncManager) remoteHealthChanged(remote string, healthy bool) {
+	m.lock.Lock()
+	var affected []*replicaSet
+	for _, r := range m.volumes {
+		if r.uses(remote) && (!r.stopped() || r.unavailableTarget(remote)) {
+			affected = append(affected, r)
+		}
+	}
+	m.lock.Unlock()
+	for _, r := range affected {
+		if healthy && r.unavailableTarget(remote) {
+			// The replica left out by Start is added now.
+			volumeName := r.spec.VolumeName
+			m.goBackground(func(ctx context.Context) {
+				if err := m.RetryUnavailable(volumeName); err != nil && err != ErrSyncJobNotFound {
+					klog.Infof("Failed to restart replication of volume %q: %v", volumeName, err)
+				}
+			})
+		}
+		if len(r.jobs) == 0 {
+			continue
+		}
+		if healthy {
+			r.jobs[0].event(v1.EventTypeNormal, "RemoteHealthy", "Remote %s is healthy again", remote)
+		} else {
+			r.jobs[0].event(v1.EventTypeWarning, "RemoteUnhealthy", "Remote %s failed its health probes", remote)
+		}
+		r.reportStatus()
+	}
+}
+
+// Run binds the replication of the manager to ctx: once ctx is done the
+// manager is shut down, giving replication passes in flight drainTimeout to
+// finish. Returns when the manager is shut down, by Run or Shutdown.
+func (m *SyncManager) Run(ctx context.Context, drainTimeout time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-m.done():
+	}
+	m.Shutdown(drainTimeout)
+}
+
+// Shutdown stops every job. Jobs do not start new replication passes any
+// more, passes in flight get drainTimeout to finish before their transfers
+// are cancelled. Shutdown returns when all jobs and background operations
+// have exited. The manager does not accept new jobs afterwards. Further calls
+// wait for the first one to return.
+func (m *SyncManager) Shutdown(drainTimeout time.Duration) {
+	m.shutdownOnce.Do(func() { m.shutdown(drainTimeout) })
+}
+
+func (m *SyncManager) shutdown(drainTimeout time.Duration) {
+	m.lock.Lock()
+	m.loopCancel()
+	m.volumes = map[string]*replicaSet{}
+	m.lock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(drained)
+	}()
+	klog.Infof("Draining replication, waiting up to %v", drainTimeout)
+	timer := time.NewTimer(drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		klog.Infof("Replication drained")
+	case <-timer.C:
+		klog.Warningf("Replication not drained within %v, cancelling transfers", drainTimeout)
+	}
+	m.cancel()
+	<-drained
+}
+
+// done is closed when the manager is shut down.
+func (m *SyncManager) done() <-chan struct{} {
+	return m.loopCtx.Done()
+}
+
+// goBackground runs f in a goroutine that Shutdown waits for. The context
+// passed to f is cancelled when the drain timeout expires. Returns false
+// without running f when the manager is shut down.
+func (m *SyncManager) goBackground(f func(ctx context.Context)) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.loopCtx.Err() != nil {
+		return false
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		f(m.ctx)
+	}()
+	return true
+}
+
+// Start starts replicating the volume described by spec to each of its
+// targets. Starting a volume that already has running or paused jobs is a
+// no-op, a volume whose jobs have all stopped is started again. Targets
+// whose file systems cannot be created are left out and degrade the volume,
+// an *unavailableError names them.
+func (m *SyncManager) Start(spec SyncJobSpec) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.loopCtx.Err() != nil {
+		return fmt.Errorf("volume %q: sync manager is shut down", spec.VolumeName)
+	}
+	if r, ok := m.volumes[spec.VolumeName]; ok && !r.stopped() {
+		klog.V(4).Infof("Sync job for volume %q already exists", spec.VolumeName)
+		return nil
+	}
+	spec.setDefaults()
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	// Nothing is replicated without the source.
+	if _, err := spec.newFs(m.ctx, spec.Source); err != nil {
+		return fmt.Errorf("volume %q: %v", spec.VolumeName, err)
+	}
+	if _, err := spec.Filter.newFilter(true); err != nil {
+		return fmt.Errorf("volume %q: invalid filter: %v", spec.VolumeName, err)
+	}
+
+	r := &replicaSet{spec: spec, statusHandler: m.statusHandler, failoverHandler: m.failoverHandler, remoteHealthy: m.remoteHealthy,
+		secretReader: m.secretReader}
+	bandwidth := m.bandwidth.register(spec.VolumeName, spec.BandwidthLimit, spec.BandwidthPriority)
+	targets := spec.Targets
+	if spec.Layout == LayoutErasure {
+		// A single job writes the shards to all targets.
+		targets = []string{strings.Join(spec.Targets, "+")}
+	}
+	var loopCtxs []context.Context
+	var unavailableErr error
+	for _, target := range targets {
+		jobSpec := spec
+		jobSpec.Target = target
+		transferCtx, cancelTransfer := context.WithCancel(m.ctx)
+		job, err := newSyncJob(transferCtx, jobSpec)
+		if err != nil && spec.Layout != LayoutErasure {
+			cancelTransfer()
+			klog.Warningf("Volume %q: not replicating to unavailable target %s: %v", spec.VolumeName, target, err)
+			r.unavailable = append(r.unavailable, target)
+			if unavailableErr == nil {
+				unavailableErr = err
+			}
+			continue
+		}
+		if err == nil && spec.Encryption.enabled() {
+			err = job.encryptTarget(transferCtx, m.secretReader)
+		}
+		if err == nil && spec.Compression.Enabled {
+			err = job.compressTarget(transferCtx)
+		}
+		if err != nil {
+			cancelTransfer()
+			for _, job := range r.jobs {
+				job.cancel()
+			}
+			m.bandwidth.unregister(spec.VolumeName)
+			return err
+		}
+		job.bandwidth = bandwidth
+		job.scheduler = m.scheduler
+		job.goBackground = m.goBackground
+		job.fsrc = newThrottledFs(job.fsrc, bandwidth)
+		job.fdst = newThrottledFs(job.fdst, bandwidth)
+		loopCtx, cancelLoop := context.WithCancel(m.loopCtx)
+		job.cancel = func() {
+			cancelLoop()
+			cancelTransfer()
+		}
+		job.replicas = r
+		job.identity = m.identity
+		job.recorder = m.eventRecorder
+		job.startTime = time.Now()
+		r.jobs = append(r.jobs, job)
+		loopCtxs = append(loopCtxs, loopCtx)
+	}
+	m.volumes[spec.VolumeName] = r
+
+	for i, job := range r.jobs {
+		job, loopCtx := job, loopCtxs[i]
+		klog.Infof("Starting sync job for volume %q from %q to %q", spec.VolumeName, spec.Source, job.spec.Target)
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			defer close(job.done)
+			defer job.cancel()
+			defer job.setState(SyncJobStopped)
+			csisync(loopCtx, job)
+		}()
+	}
+	if len(r.unavailable) > 0 {
+		return &unavailableError{volumeName: spec.VolumeName, targets: r.unavailable, err: unavailableErr}
+	}
+	return nil
+}
+
+// unavailableError is returned by Start when the replication of a volume
+// started without the replicas on some of its targets.
+type unavailableError struct {
+	volumeName string
+	targets    []string
+	err        error
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("volume %q: replicas on %s unavailable: %v", e.volumeName, strings.Join(e.targets, ", "), e.err)
+}
+
+// RetryUnavailable restarts the replication of the given volume once the
+// file systems of all targets left out by Start can be created. Returns the
+// error of a target that is still unavailable.
+func (m *SyncManager) RetryUnavailable(volumeName string) error {
+	r, ok := m.get(volumeName)
+	if !ok {
+		return ErrSyncJobNotFound
+	}
+	if len(r.unavailable) == 0 {
+		return nil
+	}
+	for _, target := range r.unavailable {
+		if _, err := r.spec.newFs(m.ctx, target); err != nil {
+			return &unavailableError{volumeName: volumeName, targets: r.unavailable, err: err}
+		}
+	}
+	klog.Infof("Volume %q: restarting replication with the replicas on %s", volumeName, strings.Join(r.unavailable, ", "))
+	if err := m.Stop(volumeName); err != nil && err != ErrSyncJobNotFound {
+		return err
+	}
+	return m.Start(r.spec)
+}
+
+// Stop stops the jobs of the given volume, cancelling replication passes in
+// flight, waits until they have exited and removes them from the manager.
+func (m *SyncManager) Stop(volumeName string) error {
+	m.lock.Lock()
+	r, ok := m.volumes[volumeName]
+	delete(m.volumes, volumeName)
+	m.lock.Unlock()
+
+	if !ok {
+		return ErrSyncJobNotFound
+	}
+	klog.Infof("Stopping sync jobs for volume %q", volumeName)
+	for _, job := range r.jobs {
+		job.cancel()
+	}
+	for _, job := range r.jobs {
+		<-job.done
+		SM.deleteReplica(job.metricLabels()...)
+	}
+	m.bandwidth.unregister(volumeName)
+	return nil
+}
+
+// Pause suspends replication of the given volume until Resume is called.
+func (m *SyncManager) Pause(volumeName string) error {
+	return m.transition(volumeName, SyncJobRunning, SyncJobPaused)
+}
+
+// Resume continues replication of a paused volume.
+func (m *SyncManager) Resume(volumeName string) error {
+	return m.transition(volumeName, SyncJobPaused, SyncJobRunning)
+}
+
+func (m *SyncManager) transition(volumeName string, from, to SyncJobState) error {
+	r, ok := m.get(volumeName)
+	if !ok {
+		return ErrSyncJobNotFound
+	}
+	var firstErr error
+	for _, job := range r.jobs {
+		if err := job.transition(from, to); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// AcknowledgeDeletion lets the replicas of the given volume frozen by the
+// deletion brake with the given token delete the files at their next pass.
+// Returns whether a replica was released.
+func (m *SyncManager) AcknowledgeDeletion(volumeName, token string) (bool, error) {
+	r, ok := m.get(volumeName)
+	if !ok {
+		return false, ErrSyncJobNotFound
+	}
+	released := false
+	for _, job := range r.jobs {
+		if job.acknowledge(token) {
+			klog.Infof("Volume %q: deletion on %s acknowledged", volumeName, job.spec.Target)
+			released = true
+		}
+	}
+	return released, nil
+}
+
+// ResolveSplitBrain lets the replicas of the given volume fenced by the
+// split brain with the given token proceed at their next pass, keeping the
+// copy on winner. Returns whether a replica was released.
+func (m *SyncManager) ResolveSplitBrain(volumeName, winner, token string) (bool, error) {
+	r, ok := m.get(volumeName)
+	if !ok {
+		return false, ErrSyncJobNotFound
+	}
+	released := false
+	for _, job := range r.jobs {
+		if job.chooseWinner(winner, token) {
+			klog.Infof("Volume %q: split brain with %s resolved in favor of %s", volumeName, job.spec.Target, winner)
+			released = true
+		}
+	}
+	return released, nil
+}
+
+// ListVersions returns the previous versions of the file remote, relative to
+// the root of the given volume, kept on all targets. The newest come first.
+func (m *SyncManager) ListVersions(ctx context.Context, volumeName, remote string) ([]FileVersion, error) {
+	r, ok := m.get(volumeName)
+	if !ok {
+		return nil, ErrSyncJobNotFound
+	}
+	var versions []FileVersion
+	for _, job := range r.jobs {
+		if !job.spec.Versioning.Enabled {
+			continue
+		}
+		jobVersions, err := job.listVersions(ctx, remote)
+		if err != nil {
+			return nil, fmt.Errorf("volume %q: versions of %s on %s: %v", volumeName, remote, job.spec.Target, err)
+		}
+		versions = append(versions, jobVersions...)
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Time.After(versions[j].Time) })
+	return versions, nil
+}
+
+// RestoreVersion copies the version of the file remote of the given volume
+// replaced at t on target back to the source. The next passes replicate it
+// to the targets.
+func (m *SyncManager) RestoreVersion(ctx context.Context, volumeName, target, remote string, t time.Time) error {
+	r, ok := m.get(volumeName)
+	if !ok {
+		return ErrSyncJobNotFound
+	}
+	for _, job := range r.jobs {
+		if job.spec.Target != target {
+			continue
+		}
+		if !job.spec.Versioning.Enabled {
+			return fmt.Errorf("volume %q: versioning is not enabled", volumeName)
+		}
+		return job.restoreVersion(ctx, remote, t)
+	}
+	return fmt.Errorf("volume %q: no replica on %s", volumeName, target)
+}
+
+// replica returns the job replicating the given volume to target.
+func (m *SyncManager) replica(volumeName, target string) (*syncJob, error) {
+	r, ok := m.get(volumeName)
+	if !ok {
+		return nil, ErrSyncJobNotFound
+	}
+	for _, job := range r.jobs {
+		if job.spec.Target == target {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("volume %q: no replica on %s", volumeName, target)
+}
+
+// Flush runs a pass of the replica of the given volume on target right away,
+// also if it is paused, and returns its error.
+func (m *SyncManager) Flush(ctx context.Context, volumeName, target string) error {
+	job, err := m.replica(volumeName, target)
+	if err != nil {
+		return err
+	}
+	ran := false
+	job.scheduled(ctx, func() bool {
+		ran = true
+		job.syncPass()
+		if status := job.status(); status.LastError != "" {
+			err = fmt.Errorf("volume %q: pass of the replica on %s failed: %s", volumeName, target, status.LastError)
+		}
+		return false
+	})
+	if !ran {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Snapshot brings the replica of the given volume on target up to date and
+// calls take with the file system of the replica while no pass changes it.
+// Returns the time the copy taken is current as of.
+func (m *SyncManager) Snapshot(ctx context.Context, volumeName, target string, take func(replica fs.Fs) error) (time.Time, error) {
+	job, err := m.replica(volumeName, target)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if job.spec.Layout == LayoutErasure {
+		return time.Time{}, fmt.Errorf("volume %q: snapshots of erasure coded volumes are not supported", volumeName)
+	}
+	if job.spec.Encryption.enabled() {
+		return time.Time{}, fmt.Errorf("volume %q: snapshots of encrypted volumes are not supported", volumeName)
+	}
+	var taken time.Time
+	job.scheduled(ctx, func() bool {
+		if job.getState() == SyncJobPaused {
+			// A paused replica is copied as of its last pass.
+			taken = job.status().LastSyncTime
+			if taken.IsZero() {
+				err = fmt.Errorf("volume %q: paused replica on %s has never been synced", volumeName, target)
+				return false
+			}
+		} else {
+			job.syncPass()
+			if status := job.status(); status.LastError != "" {
+				err = fmt.Errorf("volume %q: replica on %s is not current: %s", volumeName, target, status.LastError)
+				return false
+			}
+			taken = job.passStart
+		}
+		replica := job.fdst
+		if t, ok := replica.(*throttledFs); ok {
+			// Server-side copies need the objects of the backend.
+			replica = t.Fs
+		}
+		err = take(replica)
+		return false
+	})
+	if taken.IsZero() && err == nil {
+		err = ctx.Err()
+	}
+	return taken, err
+}
+
+// Status returns the status of the replication of the given volume.
+func (m *SyncManager) Status(volumeName string) (SyncJobStatus, error) {
+	r, ok := m.get(volumeName)
+	if !ok {
+		return SyncJobStatus{}, ErrSyncJobNotFound
+	}
+	return r.status(), nil
+}
+
+// List returns the status of the replication of all volumes, sorted by
+// volume name.
+func (m *SyncManager) List() []SyncJobStatus {
+	m.lock.Lock()
+	volumes := make([]*replicaSet, 0, len(m.volumes))
+	for _, r := range m.volumes {
+		volumes = append(volumes, r)
+	}
+	m.lock.Unlock()
+
+	statuses := make([]SyncJobStatus, 0, len(volumes))
+	for _, r := range volumes {
+		statuses = append(statuses, r.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].VolumeName < statuses[j].VolumeName
+	})
+	return statuses
+}
+
+func (m *SyncManager) get(volumeName string) (*replicaSet, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	r, ok := m.volumes[volumeName]
+	return r, ok
+}
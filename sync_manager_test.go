@@ -0,0 +1,189 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs/config"
+)
+
+// testRemotes points the rclone config at a temporary file defining the
+// local remotes "source" and "target" and returns their root directories.
+// The local remotes "target2" and "target3" are defined next to "target".
+func testRemotes(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "csiraid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	sourceDir := filepath.Join(dir, "source")
+	targetDir := filepath.Join(dir, "target")
+	conf := fmt.Sprintf("[source]\ntype = local\npath = %s\n\n[target]\ntype = local\npath = %s\n\n[target2]\ntype = local\npath = %s\n\n[target3]\ntype = local\npath = %s\n",
+		sourceDir, targetDir, filepath.Join(dir, "target2"), filepath.Join(dir, "target3"))
+	configPath := filepath.Join(dir, "csiraid.config")
+	if err := ioutil.WriteFile(configPath, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rcloneConfigPath = configPath
+	loadRcloneConfig()
+	config.SetConfigPath(configPath)
+	if err := config.Data().Load(); err != nil {
+		t.Fatal(err)
+	}
+	return sourceDir, targetDir
+}
+
+// newTestSyncJob returns the job replicating the volume described by spec
+// between the remotes of testRemotes. The remotes, the directory and the claim
+// not set in spec default to "source", "target", "/export/vol-1" and
+// default/claim-1. The metrics of the replica are removed with the test.
+func newTestSyncJob(t *testing.T, spec SyncJobSpec) *syncJob {
+	t.Helper()
+	defaults := []struct {
+		field *string
+		value string
+	}{
+		{&spec.Source, "source"},
+		{&spec.Target, "target"},
+		{&spec.Directory, "/export/vol-1"},
+		{&spec.ClaimNamespace, "default"},
+		{&spec.ClaimName, "claim-1"},
+	}
+	for _, d := range defaults {
+		if *d.field == "" {
+			*d.field = d.value
+		}
+	}
+	job, err := newSyncJob(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SM.deleteReplica(job.metricLabels()...) })
+	return job
+}
+
+func waitForFile(t *testing.T, path string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("file %s did not appear within %v", path, timeout)
+}
+
+func TestSyncManager(t *testing.T) {
+	sourceDir, targetDir := testRemotes(t)
+	volumeDir := filepath.Join(sourceDir, "vol-1")
+	if err := os.MkdirAll(volumeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(volumeDir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewSyncManager("test", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+	go func() {
+		m.Run(ctx, time.Second)
+		close(runDone)
+	}()
+
+	spec := SyncJobSpec{VolumeName: "pv-1", Source: "source", Target: "target", Directory: "/export/vol-1"}
+	if err := m.Start(spec); err != nil {
+		t.Fatalf("unexpected error starting job: %v", err)
+	}
+	if err := m.Start(spec); err != nil {
+		t.Fatalf("unexpected error starting job twice: %v", err)
+	}
+	waitForFile(t, filepath.Join(targetDir, "vol-1", "a"), 10*time.Second)
+
+	if err := m.Pause("pv-1"); err != nil {
+		t.Fatalf("unexpected error pausing job: %v", err)
+	}
+	if status, _ := m.Status("pv-1"); status.State != SyncJobPaused {
+		t.Errorf("expected state %s but got %s", SyncJobPaused, status.State)
+	}
+	if err := m.Pause("pv-1"); err != nil {
+		t.Errorf("unexpected error pausing paused job: %v", err)
+	}
+	if err := m.Resume("pv-1"); err != nil {
+		t.Fatalf("unexpected error resuming job: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(volumeDir, "b"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForFile(t, filepath.Join(targetDir, "vol-1", "b"), 10*time.Second)
+
+	statuses := m.List()
+	if len(statuses) != 1 || statuses[0].VolumeName != "pv-1" || statuses[0].LastSyncTime.IsZero() {
+		t.Errorf("unexpected job list %+v", statuses)
+	}
+
+	if err := m.Stop("pv-1"); err != nil {
+		t.Fatalf("unexpected error stopping job: %v", err)
+	}
+	if _, err := m.Status("pv-1"); err != ErrSyncJobNotFound {
+		t.Errorf("expected %v after stop but got %v", ErrSyncJobNotFound, err)
+	}
+	if err := m.Resume("pv-1"); err != ErrSyncJobNotFound {
+		t.Errorf("expected %v resuming stopped job but got %v", ErrSyncJobNotFound, err)
+	}
+
+	if err := m.Start(spec); err != nil {
+		t.Fatalf("unexpected error restarting job: %v", err)
+	}
+	cancel()
+	select {
+	case <-runDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sync manager did not stop its jobs after the context was cancelled")
+	}
+	if len(m.List()) != 0 {
+		t.Errorf("expected no jobs after shutdown but got %+v", m.List())
+	}
+	if err := m.Start(spec); err == nil {
+		t.Error("expected error starting job after shutdown")
+	}
+}
+
+func TestSyncManagerShutdown(t *testing.T) {
+	m := NewSyncManager("test", nil)
+	runDone := make(chan struct{})
+	go func() {
+		m.Run(context.Background(), time.Second)
+		close(runDone)
+	}()
+	m.Shutdown(time.Second)
+	// Shutting down again is a no-op.
+	m.Shutdown(time.Second)
+	select {
+	case <-runDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after Shutdown")
+	}
+}
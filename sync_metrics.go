@@ -0,0 +1,406 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReplicationSubsystem is the prometheus subsystem of the replication metrics.
+const ReplicationSubsystem = "replication"
+
+// replicaLabels are the labels of the metrics of a replica: the PV, the
+// namespace of its claim, its StorageClass and the target remote.
+var replicaLabels = []string{"volume", "namespace", "class", "target"}
+
+// remoteLabels are the labels of the metrics of a remote.
+var remoteLabels = []string{"remote"}
+
+// SyncMetrics contains the metrics of the replication of the volumes.
+type SyncMetrics struct {
+	// BytesTransferredTotal is the number of bytes copied to or from a
+	// replica.
+	BytesTransferredTotal *prometheus.CounterVec
+	// FilesTransferredTotal is the number of files copied to or from a
+	// replica.
+	FilesTransferredTotal *prometheus.CounterVec
+	// SyncDurationSeconds is the duration of successful replication passes.
+	SyncDurationSeconds *prometheus.HistogramVec
+	// SyncErrorsTotal is the number of failed replication passes.
+	SyncErrorsTotal *prometheus.CounterVec
+	// RecoveriesTotal is the number of times the source has been restored
+	// from a replica.
+	RecoveriesTotal *prometheus.CounterVec
+	// LastSuccessTimestampSeconds is when the last successful replication
+	// pass finished.
+	LastSuccessTimestampSeconds *prometheus.GaugeVec
+	// ScrubMismatchedFiles is the number of files that differ between the
+	// source and a replica in the last scrub.
+	ScrubMismatchedFiles *prometheus.GaugeVec
+	// ScrubMissingFiles is the number of files of the source missing on a
+	// replica in the last scrub.
+	ScrubMissingFiles *prometheus.GaugeVec
+	// ScrubExtraFiles is the number of files of a replica missing on the
+	// source in the last scrub.
+	ScrubExtraFiles *prometheus.GaugeVec
+	// ScrubTimestampSeconds is when the last scrub of a replica finished.
+	ScrubTimestampSeconds *prometheus.GaugeVec
+	// ScrubRepairedFilesTotal is the number of files repaired by scrubs.
+	ScrubRepairedFilesTotal *prometheus.CounterVec
+	// DeletionBrakeEngaged is 1 while a replica is frozen by the deletion
+	// brake, 0 otherwise.
+	DeletionBrakeEngaged *prometheus.GaugeVec
+	// DeletionBrakeEngagementsTotal is the number of passes held back by the
+	// deletion brake.
+	DeletionBrakeEngagementsTotal *prometheus.CounterVec
+	// SplitBrainFenced is 1 while a replica is fenced after a split brain, 0
+	// otherwise.
+	SplitBrainFenced *prometheus.GaugeVec
+	// InitialSyncProgressRatio is the share of the volume copied by the
+	// running initial sync of a replica.
+	InitialSyncProgressRatio *prometheus.GaugeVec
+	// InitialSyncETASeconds is the estimated time until the running initial
+	// sync of a replica is complete, 0 until it can be estimated.
+	InitialSyncETASeconds *prometheus.GaugeVec
+	// CompressionRatio is the size of the files of a compressed replica
+	// divided by the size they take up on the target as of its last
+	// measurement.
+	CompressionRatio *prometheus.GaugeVec
+	// SchedulerQueueDepth is the number of replication passes that are due
+	// but wait for others to finish.
+	SchedulerQueueDepth prometheus.Gauge
+	// SchedulerRunningPasses is the number of replication passes running.
+	SchedulerRunningPasses prometheus.Gauge
+	// SchedulerWaitSeconds is how long due replication passes waited before
+	// they ran.
+	SchedulerWaitSeconds prometheus.Histogram
+	// RemoteHealthy is 1 while a remote is healthy, 0 otherwise.
+	RemoteHealthy *prometheus.GaugeVec
+	// RemoteProbeDurationSeconds is the duration of the health probes of a
+	// remote.
+	RemoteProbeDurationSeconds *prometheus.HistogramVec
+	// RemoteProbeFailuresTotal is the number of failed health probes of a
+	// remote.
+	RemoteProbeFailuresTotal *prometheus.CounterVec
+	// RemoteFreeBytes is the free space of a remote as of its last probe.
+	RemoteFreeBytes *prometheus.GaugeVec
+}
+
+// SM contains the replication metrics registered by the controller.
+var SM = NewSyncMetrics(ReplicationSubsystem)
+
+// NewSyncMetrics creates a new set of replication metrics with the given
+// subsystem name.
+func NewSyncMetrics(subsystem string) SyncMetrics {
+	return SyncMetrics{
+		BytesTransferredTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: subsystem,
+				Name:      "bytes_transferred_total",
+				Help:      "Total number of bytes copied between the source and the replica. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		FilesTransferredTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: subsystem,
+				Name:      "files_transferred_total",
+				Help:      "Total number of files copied between the source and the replica. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		SyncDurationSeconds: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Subsystem: subsystem,
+				Name:      "sync_duration_seconds",
+				Help:      "Duration in seconds of replication passes. Failed passes are ignored. Broken down by volume, claim namespace, storage class name and target.",
+				Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10),
+			},
+			replicaLabels,
+		),
+		SyncErrorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: subsystem,
+				Name:      "sync_errors_total",
+				Help:      "Total number of failed replication passes. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		RecoveriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: subsystem,
+				Name:      "recoveries_total",
+				Help:      "Total number of times the source has been restored from the replica. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		LastSuccessTimestampSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "last_success_timestamp_seconds",
+				Help:      "Unix time the last successful replication pass finished. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		ScrubMismatchedFiles: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "scrub_mismatched_files",
+				Help:      "Number of files differing between the source and the replica in the last scrub. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		ScrubMissingFiles: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "scrub_missing_files",
+				Help:      "Number of files of the source missing on the replica in the last scrub. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		ScrubExtraFiles: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "scrub_extra_files",
+				Help:      "Number of files of the replica missing on the source in the last scrub. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		ScrubTimestampSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "scrub_timestamp_seconds",
+				Help:      "Unix time the last scrub of the replica finished. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		ScrubRepairedFilesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: subsystem,
+				Name:      "scrub_repaired_files_total",
+				Help:      "Total number of files repaired by scrubs. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		DeletionBrakeEngaged: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "deletion_brake_engaged",
+				Help:      "1 while the replication to the replica is frozen by the deletion brake. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		DeletionBrakeEngagementsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: subsystem,
+				Name:      "deletion_brake_engagements_total",
+				Help:      "Total number of replication passes held back by the deletion brake. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		SplitBrainFenced: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "split_brain_fenced",
+				Help:      "1 while the replication to the replica is fenced after a split brain. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		InitialSyncProgressRatio: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "initial_sync_progress_ratio",
+				Help:      "Share of the volume copied by the running initial sync of the replica, by size. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		InitialSyncETASeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "initial_sync_eta_seconds",
+				Help:      "Estimated time until the running initial sync of the replica is complete, 0 until it can be estimated. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		CompressionRatio: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "compression_ratio",
+				Help:      "Size of the files of the compressed replica divided by the size stored on the target. Broken down by volume, claim namespace, storage class name and target.",
+			},
+			replicaLabels,
+		),
+		SchedulerQueueDepth: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "scheduler_queue_depth",
+				Help:      "Number of replication passes that are due but wait for a free slot.",
+			},
+		),
+		SchedulerRunningPasses: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "scheduler_running_passes",
+				Help:      "Number of replication passes running.",
+			},
+		),
+		SchedulerWaitSeconds: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Subsystem: subsystem,
+				Name:      "scheduler_wait_seconds",
+				Help:      "Time in seconds replication passes waited for a free slot after they became due.",
+				Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10),
+			},
+		),
+		RemoteHealthy: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "remote_healthy",
+				Help:      "1 while the remote is healthy, 0 after failed health probes. Broken down by remote.",
+			},
+			remoteLabels,
+		),
+		RemoteProbeDurationSeconds: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Subsystem: subsystem,
+				Name:      "remote_probe_duration_seconds",
+				Help:      "Duration in seconds of the health probes of the remote. Broken down by remote.",
+				Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+			},
+			remoteLabels,
+		),
+		RemoteProbeFailuresTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: subsystem,
+				Name:      "remote_probe_failures_total",
+				Help:      "Total number of failed health probes of the remote. Broken down by remote.",
+			},
+			remoteLabels,
+		),
+		RemoteFreeBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: subsystem,
+				Name:      "remote_free_bytes",
+				Help:      "Free space in bytes of the remote as of its last health probe, if its backend reports it. Broken down by remote.",
+			},
+			remoteLabels,
+		),
+	}
+}
+
+// Collectors returns all metrics to be registered.
+func (m SyncMetrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.BytesTransferredTotal,
+		m.FilesTransferredTotal,
+		m.SyncDurationSeconds,
+		m.SyncErrorsTotal,
+		m.RecoveriesTotal,
+		m.LastSuccessTimestampSeconds,
+		m.ScrubMismatchedFiles,
+		m.ScrubMissingFiles,
+		m.ScrubExtraFiles,
+		m.ScrubTimestampSeconds,
+		m.ScrubRepairedFilesTotal,
+		m.DeletionBrakeEngaged,
+		m.DeletionBrakeEngagementsTotal,
+		m.SplitBrainFenced,
+		m.InitialSyncProgressRatio,
+		m.InitialSyncETASeconds,
+		m.CompressionRatio,
+		m.SchedulerQueueDepth,
+		m.SchedulerRunningPasses,
+		m.SchedulerWaitSeconds,
+		m.RemoteHealthy,
+		m.RemoteProbeDurationSeconds,
+		m.RemoteProbeFailuresTotal,
+		m.RemoteFreeBytes,
+	}
+}
+
+// deleteReplica removes the metrics of a replica.
+func (m SyncMetrics) deleteReplica(labels ...string) {
+	for _, c := range []interface {
+		DeleteLabelValues(...string) bool
+	}{
+		m.BytesTransferredTotal,
+		m.FilesTransferredTotal,
+		m.SyncDurationSeconds,
+		m.SyncErrorsTotal,
+		m.RecoveriesTotal,
+		m.LastSuccessTimestampSeconds,
+		m.ScrubMismatchedFiles,
+		m.ScrubMissingFiles,
+		m.ScrubExtraFiles,
+		m.ScrubTimestampSeconds,
+		m.ScrubRepairedFilesTotal,
+		m.DeletionBrakeEngaged,
+		m.DeletionBrakeEngagementsTotal,
+		m.SplitBrainFenced,
+		m.InitialSyncProgressRatio,
+		m.InitialSyncETASeconds,
+		m.CompressionRatio,
+	} {
+		c.DeleteLabelValues(labels...)
+	}
+}
+
+// metricLabels returns the values of replicaLabels for the replica of j.
+func (j *syncJob) metricLabels() []string {
+	return []string{j.spec.VolumeName, j.spec.ClaimNamespace, j.spec.StorageClass, j.spec.Target}
+}
+
+// lagCollector reports the replication lag of the replicas of the volumes of
+// a SyncManager, computed when the metrics are collected.
+type lagCollector struct {
+	manager *SyncManager
+	desc    *prometheus.Desc
+}
+
+// LagCollector returns a collector of the replication lag of the replicas of
+// the volumes of m: the seconds since their last successful pass, or since
+// their replication started if they have not completed one yet.
+func (m *SyncManager) LagCollector() prometheus.Collector {
+	return &lagCollector{
+		manager: m,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName("", ReplicationSubsystem, "lag_seconds"),
+			"Seconds since the last successful replication pass. Broken down by volume, claim namespace, storage class name and target.",
+			replicaLabels, nil,
+		),
+	}
+}
+
+func (c *lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *lagCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, status := range c.manager.List() {
+		for _, replica := range status.Replicas {
+			last := replica.LastSyncTime
+			if last.IsZero() {
+				last = status.StartTime
+			}
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, now.Sub(last).Seconds(),
+				status.VolumeName, status.ClaimNamespace, status.StorageClass, replica.Target)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSyncMetrics(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "abc", time.Now())
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "b"), "de", time.Now())
+
+	m := NewSyncManager("test", nil)
+	defer m.Shutdown(time.Second)
+	spec := SyncJobSpec{
+		VolumeName:      "pv-metrics",
+		Source:          "source",
+		Target:          "target",
+		Directory:       "/export/vol-1",
+		ClaimNamespace:  "default",
+		StorageClass:    "csi-raid",
+		MinSyncInterval: 10 * time.Millisecond,
+	}
+	if err := m.Start(spec); err != nil {
+		t.Fatal(err)
+	}
+	waitForFile(t, filepath.Join(targetRoot, "vol-1", "b"), 10*time.Second)
+	labels := []string{"pv-metrics", "default", "csi-raid", "target"}
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(SM.LastSuccessTimestampSeconds.WithLabelValues(labels...)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no successful pass recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if files := testutil.ToFloat64(SM.FilesTransferredTotal.WithLabelValues(labels...)); files != 2 {
+		t.Errorf("expected 2 files transferred but got %v", files)
+	}
+	if bytes := testutil.ToFloat64(SM.BytesTransferredTotal.WithLabelValues(labels...)); bytes != 5 {
+		t.Errorf("expected 5 bytes transferred but got %v", bytes)
+	}
+	if n := testutil.CollectAndCount(m.LagCollector()); n != 1 {
+		t.Errorf("expected lag of 1 replica but got %d", n)
+	}
+
+	if err := m.Stop("pv-metrics"); err != nil {
+		t.Fatal(err)
+	}
+	if SM.FilesTransferredTotal.DeleteLabelValues(labels...) {
+		t.Error("expected metrics of stopped volume to be removed")
+	}
+}
@@ -0,0 +1,547 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// StorageClass parameters controlling the replication of its volumes.
+const (
+	// paramSyncMode selects how changes are detected, see SyncMode.
+	paramSyncMode = "syncMode"
+	// paramNotifyDebounce is how long the source must be quiet after a change
+	// notification before the changed directories are replicated, at most
+	// ten times as long after the first change.
+	paramNotifyDebounce = "notifyDebounce"
+	// paramNotifyResyncInterval is how often a full pass runs in notify mode
+	// to catch changes no notification was received for.
+	paramNotifyResyncInterval = "notifyResyncInterval"
+	// paramSyncInterval is the interval between passes in poll mode. It sets
+	// both paramMinSyncInterval and paramMaxSyncInterval unless they are
+	// given explicitly.
+	paramSyncInterval = "syncInterval"
+	// paramMinSyncInterval is the interval between passes in poll mode after
+	// a pass that replicated changes.
+	paramMinSyncInterval = "minSyncInterval"
+	// paramMaxSyncInterval is the longest interval between passes in poll
+	// mode. The interval doubles with every pass that replicated nothing
+	// until it reaches this value.
+	paramMaxSyncInterval = "maxSyncInterval"
+	// paramSyncDirection selects one-way or two-way replication, see
+	// SyncDirection.
+	paramSyncDirection = "syncDirection"
+	// paramConflictPolicy selects how two-way replication resolves files
+	// changed on both remotes, see ConflictPolicy.
+	paramConflictPolicy = "conflictPolicy"
+	// paramTargets is a comma separated list of the rclone remotes holding a
+	// replica of each volume. It overrides the targets of the provisioner.
+	paramTargets = "targets"
+	// paramMinReplicas is the number of replicas that must be healthy for a
+	// volume not to be degraded. Defaults to the number of targets.
+	paramMinReplicas = "minReplicas"
+	// paramLayout selects how volumes are stored on the targets, see Layout.
+	paramLayout = "layout"
+	// paramParityShards is the number of targets holding parity in the
+	// erasure layout, the other targets hold data.
+	paramParityShards = "parityShards"
+	// paramScrubInterval is how often every file of the replicas is compared
+	// with the source by size and hash.
+	paramScrubInterval = "scrubInterval"
+	// paramScrubRepair is "true" if scrubbing repairs the files that diverged
+	// from the authoritative side.
+	paramScrubRepair = "scrubRepair"
+	// paramBandwidthLimit caps the rate at which each volume is replicated,
+	// see parseBandwidth.
+	paramBandwidthLimit = "bandwidthLimit"
+	// paramBandwidthPriority is the weight of each volume when the bandwidth
+	// of the controller is shared between the volumes.
+	paramBandwidthPriority = "bandwidthPriority"
+	// paramInclude and paramExclude are patterns of the files that are
+	// replicated or not, separated by commas or newlines, see FilterSpec.
+	paramInclude = "include"
+	paramExclude = "exclude"
+	// paramFilter are filter rules, "+ pattern" or "- pattern", one per line.
+	paramFilter = "filter"
+	// paramFilterFrom is a comma separated list of paths of files with
+	// filter rules on the controller, e.g. of a mounted ConfigMap.
+	paramFilterFrom = "filterFrom"
+	// paramMinSize and paramMaxSize select the replicated files by size,
+	// e.g. "10M".
+	paramMinSize = "minSize"
+	paramMaxSize = "maxSize"
+	// paramMaxAge selects the files modified within the given duration, e.g.
+	// "7d".
+	paramMaxAge = "maxAge"
+	// paramMaxDelete is the most files a pass may delete on either remote,
+	// paramMaxDeletePercent and paramMaxDeleteBytesPercent the most files
+	// and bytes in percent of the remote. A pass deleting more freezes the
+	// replica until the deletion is acknowledged with annDeletionAcknowledged.
+	paramMaxDelete             = "maxDelete"
+	paramMaxDeletePercent      = "maxDeletePercent"
+	paramMaxDeleteBytesPercent = "maxDeleteBytesPercent"
+	// paramVersioning is "true" if the files overwritten or deleted on the
+	// targets are kept as versions, see VersioningSpec.
+	paramVersioning = "versioning"
+	// paramKeepVersions is the most versions kept of each file.
+	paramKeepVersions = "keepVersions"
+	// paramKeepVersionsFor is how long versions are kept, e.g. "30d".
+	paramKeepVersionsFor = "keepVersionsFor"
+	// paramFailoverThreshold is the number of passes in a row failing to
+	// reach the source after which a replica is promoted, see FailoverSpec.
+	paramFailoverThreshold = "failoverThreshold"
+	// paramFailoverDeletePods is "true" if the pods using a failed over
+	// volume are deleted to mount the promoted replica.
+	paramFailoverDeletePods = "failoverDeletePods"
+	// paramEncryptionSecretName and paramEncryptionSecretNamespace reference
+	// the Secret holding the keys the replicas are encrypted with, see
+	// EncryptionSpec. The namespace defaults to the one of the claim.
+	paramEncryptionSecretName      = "encryptionSecretName"
+	paramEncryptionSecretNamespace = "encryptionSecretNamespace"
+	// paramCompression is "true" if the replicas are stored compressed with
+	// gzip, see CompressionSpec.
+	paramCompression = "compression"
+	// paramCompressionLevel is the gzip level of compressed replicas, 1 for
+	// the fastest to 9 for the best compression.
+	paramCompressionLevel = "compressionLevel"
+)
+
+// annDeletionAcknowledged on a claim lets the replicas of its volume frozen
+// by the deletion brake proceed. Its value is the token of the
+// DeletionBrakeEngaged event.
+const annDeletionAcknowledged = "csiraid.io/deletion-acknowledged"
+
+// annSplitBrainWinner on a claim resolves the split brain of its volume. Its
+// value is the remote whose copy is kept, the source or a target, and the
+// token of the SplitBrain event separated by a colon. It is removed once
+// applied.
+const annSplitBrainWinner = "csiraid.io/split-brain-winner"
+
+// PersistentVolumeClaim annotations overriding the StorageClass parameters of
+// the same name for the volume of the claim.
+const (
+	annBandwidthLimit    = "csiraid.io/bandwidth-limit"
+	annBandwidthPriority = "csiraid.io/bandwidth-priority"
+	annInclude           = "csiraid.io/include"
+	annExclude           = "csiraid.io/exclude"
+	annFilter            = "csiraid.io/filter"
+	annMinSize           = "csiraid.io/min-size"
+	annMaxSize           = "csiraid.io/max-size"
+	annMaxAge            = "csiraid.io/max-age"
+)
+
+// claimFilterAnnotations maps the filter annotations of a claim to their
+// parameters. paramFilterFrom has none, claims must not make the controller
+// read arbitrary files.
+var claimFilterAnnotations = map[string]string{
+	annInclude: paramInclude,
+	annExclude: paramExclude,
+	annFilter:  paramFilter,
+	annMinSize: paramMinSize,
+	annMaxSize: paramMaxSize,
+	annMaxAge:  paramMaxAge,
+}
+
+// SyncMode is how a replication job detects changes of the source.
+type SyncMode string
+
+const (
+	// SyncModePoll compares both remotes on every tick.
+	SyncModePoll SyncMode = "poll"
+	// SyncModeNotify replicates changed directories when the source reports
+	// changes and falls back to polling for remotes that cannot report them.
+	SyncModeNotify SyncMode = "notify"
+)
+
+// SyncDirection is which way a replication job propagates changes.
+type SyncDirection string
+
+const (
+	// SyncDirectionOneWay makes the target a mirror of the source.
+	SyncDirectionOneWay SyncDirection = "one-way"
+	// SyncDirectionTwoWay propagates creations, updates and deletions made
+	// on either remote to the other one.
+	SyncDirectionTwoWay SyncDirection = "two-way"
+)
+
+// ConflictPolicy is how two-way replication resolves a file that changed on
+// both remotes since the last pass.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyNewerWins keeps the version modified last. A modification
+	// wins over a deletion.
+	ConflictPolicyNewerWins ConflictPolicy = "newer-wins"
+	// ConflictPolicySourceWins keeps the version of the source, including its
+	// deletion.
+	ConflictPolicySourceWins ConflictPolicy = "source-wins"
+	// ConflictPolicyTargetWins keeps the version of the target, including its
+	// deletion.
+	ConflictPolicyTargetWins ConflictPolicy = "target-wins"
+	// ConflictPolicyKeepBoth keeps the version modified last under the name
+	// of the file and the other one under a name with a conflict suffix on
+	// both remotes. A modification wins over a deletion.
+	ConflictPolicyKeepBoth ConflictPolicy = "keep-both"
+)
+
+// Layout is how a volume is stored on its targets.
+type Layout string
+
+const (
+	// LayoutMirror stores a full copy of the volume on every target.
+	LayoutMirror Layout = "mirror"
+	// LayoutErasure stripes every file of the volume over all targets in
+	// data and parity shards. Any ParityShards targets can be lost.
+	LayoutErasure Layout = "erasure"
+)
+
+const (
+	// DefaultNotifyDebounce is used when paramNotifyDebounce is omitted
+	DefaultNotifyDebounce = 2 * time.Second
+	// DefaultNotifyResyncInterval is used when paramNotifyResyncInterval is omitted
+	DefaultNotifyResyncInterval = 10 * time.Minute
+	// DefaultSyncInterval is used when paramSyncInterval is omitted
+	DefaultSyncInterval = 1 * time.Second
+	// DefaultSyncDirection is used when paramSyncDirection is omitted
+	DefaultSyncDirection = SyncDirectionOneWay
+	// DefaultConflictPolicy is used when paramConflictPolicy is omitted
+	DefaultConflictPolicy = ConflictPolicyNewerWins
+	// DefaultLayout is used when paramLayout is omitted
+	DefaultLayout = LayoutMirror
+	// DefaultParityShards is used when paramParityShards is omitted
+	DefaultParityShards = 1
+	// DefaultScrubInterval is used when paramScrubInterval is omitted
+	DefaultScrubInterval = 24 * time.Hour
+	// DefaultBandwidthPriority is used when paramBandwidthPriority is omitted
+	DefaultBandwidthPriority = 1
+)
+
+// applySyncParameters sets the fields of spec that are configured by
+// StorageClass parameters. Omitted parameters get their defaults.
+func applySyncParameters(spec *SyncJobSpec, parameters map[string]string) error {
+	spec.Mode = SyncModePoll
+	spec.NotifyDebounce = DefaultNotifyDebounce
+	spec.NotifyResyncInterval = DefaultNotifyResyncInterval
+	spec.Direction = DefaultSyncDirection
+	spec.ConflictPolicy = DefaultConflictPolicy
+	spec.Layout = DefaultLayout
+
+	if mode, ok := parameters[paramSyncMode]; ok {
+		switch SyncMode(mode) {
+		case SyncModePoll, SyncModeNotify:
+			spec.Mode = SyncMode(mode)
+		default:
+			return fmt.Errorf("invalid %s %q, expected %q or %q", paramSyncMode, mode, SyncModePoll, SyncModeNotify)
+		}
+	}
+	if direction, ok := parameters[paramSyncDirection]; ok {
+		switch SyncDirection(direction) {
+		case SyncDirectionOneWay, SyncDirectionTwoWay:
+			spec.Direction = SyncDirection(direction)
+		default:
+			return fmt.Errorf("invalid %s %q, expected %q or %q", paramSyncDirection, direction, SyncDirectionOneWay, SyncDirectionTwoWay)
+		}
+	}
+	if policy, ok := parameters[paramConflictPolicy]; ok {
+		switch ConflictPolicy(policy) {
+		case ConflictPolicyNewerWins, ConflictPolicySourceWins, ConflictPolicyTargetWins, ConflictPolicyKeepBoth:
+			spec.ConflictPolicy = ConflictPolicy(policy)
+		default:
+			return fmt.Errorf("invalid %s %q, expected %q, %q, %q or %q", paramConflictPolicy, policy,
+				ConflictPolicyNewerWins, ConflictPolicySourceWins, ConflictPolicyTargetWins, ConflictPolicyKeepBoth)
+		}
+	}
+	if targets, ok := parameters[paramTargets]; ok {
+		spec.Targets = parseTargets(targets)
+		if len(spec.Targets) == 0 {
+			return fmt.Errorf("invalid %s %q: no remote", paramTargets, targets)
+		}
+	}
+	if layout, ok := parameters[paramLayout]; ok {
+		switch Layout(layout) {
+		case LayoutMirror, LayoutErasure:
+			spec.Layout = Layout(layout)
+		default:
+			return fmt.Errorf("invalid %s %q, expected %q or %q", paramLayout, layout, LayoutMirror, LayoutErasure)
+		}
+	}
+	if parityShards, ok := parameters[paramParityShards]; ok {
+		n, err := strconv.Atoi(parityShards)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid %s %q: must be a positive number", paramParityShards, parityShards)
+		}
+		spec.ParityShards = n
+	}
+	if minReplicas, ok := parameters[paramMinReplicas]; ok {
+		n, err := strconv.Atoi(minReplicas)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid %s %q: must be a positive number", paramMinReplicas, minReplicas)
+		}
+		spec.MinReplicas = n
+	}
+	if err := applyBandwidthParameters(spec, parameters[paramBandwidthLimit], parameters[paramBandwidthPriority]); err != nil {
+		return err
+	}
+	if err := applyFilterParameters(spec, parameters); err != nil {
+		return err
+	}
+	if maxDelete, ok := parameters[paramMaxDelete]; ok {
+		n, err := strconv.Atoi(maxDelete)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid %s %q: must be a positive number", paramMaxDelete, maxDelete)
+		}
+		spec.DeletionBrake.MaxFiles = n
+	}
+	for _, percent := range []struct {
+		key   string
+		value *float64
+	}{
+		{paramMaxDeletePercent, &spec.DeletionBrake.MaxFilesPercent},
+		{paramMaxDeleteBytesPercent, &spec.DeletionBrake.MaxBytesPercent},
+	} {
+		if value, ok := parameters[percent.key]; ok {
+			p, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err != nil || p <= 0 || p > 100 {
+				return fmt.Errorf("invalid %s %q: must be a percentage above 0", percent.key, value)
+			}
+			*percent.value = p
+		}
+	}
+	if versioning, ok := parameters[paramVersioning]; ok {
+		b, err := strconv.ParseBool(versioning)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", paramVersioning, versioning, err)
+		}
+		spec.Versioning.Enabled = b
+	}
+	if keep, ok := parameters[paramKeepVersions]; ok {
+		n, err := strconv.Atoi(keep)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid %s %q: must be a positive number", paramKeepVersions, keep)
+		}
+		spec.Versioning.KeepVersions = n
+	}
+	if keepFor, ok := parameters[paramKeepVersionsFor]; ok {
+		d, err := fs.ParseDuration(keepFor)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q: must be a positive duration", paramKeepVersionsFor, keepFor)
+		}
+		spec.Versioning.KeepFor = d
+	}
+	if threshold, ok := parameters[paramFailoverThreshold]; ok {
+		n, err := strconv.Atoi(threshold)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s %q: must be a number", paramFailoverThreshold, threshold)
+		}
+		spec.Failover.Threshold = n
+	}
+	if deletePods, ok := parameters[paramFailoverDeletePods]; ok {
+		b, err := strconv.ParseBool(deletePods)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", paramFailoverDeletePods, deletePods, err)
+		}
+		spec.Failover.DeletePods = b
+	}
+	spec.Encryption.SecretName = parameters[paramEncryptionSecretName]
+	spec.Encryption.SecretNamespace = parameters[paramEncryptionSecretNamespace]
+	if spec.Encryption.SecretNamespace != "" && spec.Encryption.SecretName == "" {
+		return fmt.Errorf("%s without %s", paramEncryptionSecretNamespace, paramEncryptionSecretName)
+	}
+	if compression, ok := parameters[paramCompression]; ok {
+		b, err := strconv.ParseBool(compression)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", paramCompression, compression, err)
+		}
+		spec.Compression.Enabled = b
+	}
+	if level, ok := parameters[paramCompressionLevel]; ok {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 1 || n > 9 {
+			return fmt.Errorf("invalid %s %q: must be a number from 1 to 9", paramCompressionLevel, level)
+		}
+		spec.Compression.Level = n
+	}
+	if repair, ok := parameters[paramScrubRepair]; ok {
+		b, err := strconv.ParseBool(repair)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", paramScrubRepair, repair, err)
+		}
+		spec.ScrubRepair = b
+	}
+	var err error
+	if spec.ScrubInterval, err = durationParameter(parameters, paramScrubInterval, DefaultScrubInterval); err != nil {
+		return err
+	}
+	if spec.NotifyDebounce, err = durationParameter(parameters, paramNotifyDebounce, spec.NotifyDebounce); err != nil {
+		return err
+	}
+	if spec.NotifyResyncInterval, err = durationParameter(parameters, paramNotifyResyncInterval, spec.NotifyResyncInterval); err != nil {
+		return err
+	}
+
+	interval, err := durationParameter(parameters, paramSyncInterval, DefaultSyncInterval)
+	if err != nil {
+		return err
+	}
+	if spec.MinSyncInterval, err = durationParameter(parameters, paramMinSyncInterval, interval); err != nil {
+		return err
+	}
+	if spec.MaxSyncInterval, err = durationParameter(parameters, paramMaxSyncInterval, interval); err != nil {
+		return err
+	}
+	if _, ok := parameters[paramMaxSyncInterval]; !ok && spec.MaxSyncInterval < spec.MinSyncInterval {
+		spec.MaxSyncInterval = spec.MinSyncInterval
+	}
+	if _, ok := parameters[paramMinSyncInterval]; !ok && spec.MinSyncInterval > spec.MaxSyncInterval {
+		spec.MinSyncInterval = spec.MaxSyncInterval
+	}
+	if spec.MinSyncInterval > spec.MaxSyncInterval {
+		return fmt.Errorf("%s %v is greater than %s %v", paramMinSyncInterval, spec.MinSyncInterval, paramMaxSyncInterval, spec.MaxSyncInterval)
+	}
+	return nil
+}
+
+// applyClaimAnnotations overrides the fields of spec configured by the
+// StorageClass with the annotations of the claim of the volume.
+func applyClaimAnnotations(spec *SyncJobSpec, annotations map[string]string) error {
+	if err := applyBandwidthParameters(spec, annotations[annBandwidthLimit], annotations[annBandwidthPriority]); err != nil {
+		return fmt.Errorf("claim annotation: %v", err)
+	}
+	parameters := map[string]string{}
+	for annotation, parameter := range claimFilterAnnotations {
+		if value, ok := annotations[annotation]; ok {
+			parameters[parameter] = value
+		}
+	}
+	if err := applyFilterParameters(spec, parameters); err != nil {
+		return fmt.Errorf("claim annotation: %v", err)
+	}
+	return nil
+}
+
+// applyFilterParameters sets the parts of the filter of spec that are given
+// in parameters, keeping the others.
+func applyFilterParameters(spec *SyncJobSpec, parameters map[string]string) error {
+	filter := &spec.Filter
+	if include, ok := parameters[paramInclude]; ok {
+		filter.Include = parsePatterns(include)
+	}
+	if exclude, ok := parameters[paramExclude]; ok {
+		filter.Exclude = parsePatterns(exclude)
+	}
+	if rules, ok := parameters[paramFilter]; ok {
+		filter.Rules = parseFilterRules(rules)
+	}
+	if paths, ok := parameters[paramFilterFrom]; ok {
+		filter.FilterFrom = parseTargets(paths)
+	}
+	for _, size := range []struct {
+		key   string
+		value *fs.SizeSuffix
+	}{
+		{paramMinSize, &filter.MinSize},
+		{paramMaxSize, &filter.MaxSize},
+	} {
+		if value, ok := parameters[size.key]; ok {
+			if err := size.value.Set(value); err != nil || *size.value < 0 {
+				return fmt.Errorf("invalid %s %q: must be a size such as 10M", size.key, value)
+			}
+		}
+	}
+	if maxAge, ok := parameters[paramMaxAge]; ok {
+		d, err := fs.ParseDuration(maxAge)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q: must be a positive duration such as 7d", paramMaxAge, maxAge)
+		}
+		filter.MaxAge = d
+	}
+	// The files of paramFilterFrom are read by every pass, they may not be
+	// there yet.
+	inline := *filter
+	inline.FilterFrom = nil
+	if _, err := inline.newFilter(true); err != nil {
+		return fmt.Errorf("invalid filter: %v", err)
+	}
+	return nil
+}
+
+// applyBandwidthParameters sets the bandwidth limit and priority of spec to
+// the given values unless they are empty.
+func applyBandwidthParameters(spec *SyncJobSpec, limit, priority string) error {
+	if limit != "" {
+		timetable, err := parseBandwidth(limit)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", paramBandwidthLimit, limit, err)
+		}
+		spec.BandwidthLimit = timetable
+	}
+	if priority != "" {
+		n, err := strconv.Atoi(priority)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid %s %q: must be a positive number", paramBandwidthPriority, priority)
+		}
+		spec.BandwidthPriority = n
+	}
+	return nil
+}
+
+// nextSyncInterval returns the interval before the pass following a pass
+// that ran after interval: the minimum if the pass replicated changes,
+// otherwise twice the interval, capped at the maximum.
+func nextSyncInterval(spec SyncJobSpec, interval time.Duration, changed bool) time.Duration {
+	if changed || interval < spec.MinSyncInterval {
+		return spec.MinSyncInterval
+	}
+	interval *= 2
+	if interval > spec.MaxSyncInterval {
+		return spec.MaxSyncInterval
+	}
+	return interval
+}
+
+// parseTargets splits the value of paramTargets into remote names.
+func parseTargets(value string) []string {
+	var targets []string
+	for _, target := range strings.Split(value, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// durationParameter parses the positive duration parameters[key], returning
+// def if it is omitted.
+func durationParameter(parameters map[string]string, key string, def time.Duration) (time.Duration, error) {
+	value, ok := parameters[key]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", key, value)
+	}
+	return d, nil
+}
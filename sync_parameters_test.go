@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplySyncIntervalParameters(t *testing.T) {
+	tests := []struct {
+		name        string
+		parameters  map[string]string
+		expectedMin time.Duration
+		expectedMax time.Duration
+		expectErr   bool
+	}{
+		{
+			name:        "defaults",
+			parameters:  nil,
+			expectedMin: DefaultSyncInterval,
+			expectedMax: DefaultSyncInterval,
+		},
+		{
+			name:        "fixed interval",
+			parameters:  map[string]string{"syncInterval": "1h"},
+			expectedMin: time.Hour,
+			expectedMax: time.Hour,
+		},
+		{
+			name:        "adaptive interval",
+			parameters:  map[string]string{"minSyncInterval": "5s", "maxSyncInterval": "5m"},
+			expectedMin: 5 * time.Second,
+			expectedMax: 5 * time.Minute,
+		},
+		{
+			name:        "maximum only",
+			parameters:  map[string]string{"syncInterval": "10s", "maxSyncInterval": "1m"},
+			expectedMin: 10 * time.Second,
+			expectedMax: time.Minute,
+		},
+		{
+			name:        "minimum above interval",
+			parameters:  map[string]string{"syncInterval": "10s", "minSyncInterval": "1m"},
+			expectedMin: time.Minute,
+			expectedMax: time.Minute,
+		},
+		{
+			name:       "minimum above maximum",
+			parameters: map[string]string{"minSyncInterval": "1m", "maxSyncInterval": "10s"},
+			expectErr:  true,
+		},
+		{
+			name:       "invalid duration",
+			parameters: map[string]string{"syncInterval": "hourly"},
+			expectErr:  true,
+		},
+		{
+			name:       "negative duration",
+			parameters: map[string]string{"syncInterval": "-1s"},
+			expectErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var spec SyncJobSpec
+			err := applySyncParameters(&spec, test.parameters)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error but got spec %+v", spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if spec.MinSyncInterval != test.expectedMin || spec.MaxSyncInterval != test.expectedMax {
+				t.Errorf("expected interval %v-%v but got %v-%v", test.expectedMin, test.expectedMax, spec.MinSyncInterval, spec.MaxSyncInterval)
+			}
+		})
+	}
+}
+
+func TestNextSyncInterval(t *testing.T) {
+	spec := SyncJobSpec{MinSyncInterval: time.Second, MaxSyncInterval: 5 * time.Second}
+	interval := spec.MinSyncInterval
+	var intervals []time.Duration
+	for i := 0; i < 4; i++ {
+		interval = nextSyncInterval(spec, interval, false)
+		intervals = append(intervals, interval)
+	}
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i := range expected {
+		if intervals[i] != expected[i] {
+			t.Fatalf("expected idle intervals %v but got %v", expected, intervals)
+		}
+	}
+	if interval = nextSyncInterval(spec, interval, true); interval != spec.MinSyncInterval {
+		t.Errorf("expected %v after changes but got %v", spec.MinSyncInterval, interval)
+	}
+}
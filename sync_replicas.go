@@ -0,0 +1,244 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/rclone/rclone/fs"
+	v1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// replicaSet is the replication of a volume to all of its targets, one job
+// per target. The jobs replicate independently but share the source:
+// recovery of the source and the replication state written to it are
+// serialized by sourceLock.
+type replicaSet struct {
+	spec SyncJobSpec
+	jobs []*syncJob
+	// unavailable are the targets without a job, whose file systems could
+	// not be created when the replication started, see
+	// SyncManager.RetryUnavailable.
+	unavailable []string
+
+	sourceLock sync.Mutex
+
+	healthLock sync.Mutex
+	// degraded is whether the volume was reported degraded last,
+	// failingOver whether a failover has been requested.
+	degraded    bool
+	failingOver bool
+
+	// statusHandler is called by reportStatus, failoverHandler by
+	// requestFailover. Both may be nil.
+	statusHandler   func(SyncJobStatus)
+	failoverHandler func(SyncJobStatus, string)
+	// remoteHealthy tells whether a remote is healthy, may be nil.
+	remoteHealthy func(string) bool
+	// secretReader reads the Secret of an encrypted volume, may be nil.
+	secretReader secretReader
+}
+
+// uses tells whether the volume is stored on remote.
+func (r *replicaSet) uses(remote string) bool {
+	if r.spec.Source == remote {
+		return true
+	}
+	for _, target := range r.spec.Targets {
+		if target == remote {
+			return true
+		}
+	}
+	return false
+}
+
+// unavailableTarget tells whether remote is a target left out by Start.
+func (r *replicaSet) unavailableTarget(remote string) bool {
+	for _, target := range r.unavailable {
+		if target == remote {
+			return true
+		}
+	}
+	return false
+}
+
+// stopped tells whether all jobs have exited.
+func (r *replicaSet) stopped() bool {
+	for _, job := range r.jobs {
+		if job.getState() != SyncJobStopped {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *replicaSet) status() SyncJobStatus {
+	status := SyncJobStatus{
+		SyncJobSpec: r.spec,
+		State:       SyncJobStopped,
+	}
+	for i, job := range r.jobs {
+		replica := job.status()
+		status.Replicas = append(status.Replicas, replica)
+		switch {
+		case replica.State == SyncJobRunning:
+			status.State = SyncJobRunning
+		case replica.State == SyncJobPaused && status.State == SyncJobStopped:
+			status.State = SyncJobPaused
+		}
+		if replica.healthy() {
+			status.HealthyReplicas++
+		} else if status.LastError == "" {
+			status.LastError = replica.LastError
+		}
+		if i == 0 || replica.LastSyncTime.Before(status.LastSyncTime) {
+			status.LastSyncTime = replica.LastSyncTime
+		}
+		if i == 0 || replica.SyncInterval < status.SyncInterval {
+			status.SyncInterval = replica.SyncInterval
+		}
+		if i == 0 || job.startTime.Before(status.StartTime) {
+			status.StartTime = job.startTime
+		}
+		if replica.SourceFailures > 0 {
+			status.SourceUnreachable = true
+		}
+		if replica.InitialSync != nil {
+			status.InitialSync = status.InitialSync.add(replica.InitialSync)
+		}
+	}
+	for _, remote := range append([]string{r.spec.Source}, r.spec.Targets...) {
+		if r.unavailableTarget(remote) || r.remoteHealthy != nil && !r.remoteHealthy(remote) {
+			status.UnhealthyRemotes = append(status.UnhealthyRemotes, remote)
+		}
+	}
+	status.Degraded = status.HealthyReplicas < r.spec.MinReplicas || status.SourceUnreachable || len(status.UnhealthyRemotes) > 0
+	status.Phase = ReplicationSynced
+	for _, replica := range status.Replicas {
+		status.BytesTransferred += replica.BytesTransferred
+		switch {
+		case replica.Recovering:
+			status.Phase = ReplicationRecovering
+		case status.Phase == ReplicationRecovering:
+		case replica.SplitBrain != nil:
+			status.Phase = ReplicationFenced
+		case status.Phase == ReplicationFenced:
+		case replica.DeletionHold != nil:
+			status.Phase = ReplicationNeedsAttention
+		case status.Phase == ReplicationNeedsAttention:
+		case status.Degraded:
+			status.Phase = ReplicationDegraded
+		case !replica.Settled:
+			status.Phase = ReplicationSyncing
+		}
+	}
+	// Without any job the volume only has unavailable targets.
+	if status.Phase == ReplicationSynced && status.Degraded {
+		status.Phase = ReplicationDegraded
+	}
+	return status
+}
+
+// reportStatus passes the status of the volume to the status handler.
+func (r *replicaSet) reportStatus() {
+	if r == nil || r.statusHandler == nil {
+		return
+	}
+	r.statusHandler(r.status())
+}
+
+// checkHealth reports the volume degraded when fewer than MinReplicas
+// replicas are healthy after a pass of reporter, and healthy again when
+// enough have recovered.
+func (r *replicaSet) checkHealth(reporter *syncJob) {
+	if r == nil {
+		return
+	}
+	failing := append([]string{}, r.unavailable...)
+	healthy := 0
+	for _, job := range r.jobs {
+		if job.status().healthy() {
+			healthy++
+		} else {
+			failing = append(failing, job.spec.Target)
+		}
+	}
+
+	r.healthLock.Lock()
+	defer r.healthLock.Unlock()
+	degraded := healthy < r.spec.MinReplicas
+	if degraded == r.degraded {
+		return
+	}
+	r.degraded = degraded
+	if degraded {
+		reporter.event(v1.EventTypeWarning, "ReplicationDegraded", "%d of %d replicas healthy, %d required, failing: %s",
+			healthy, len(r.jobs)+len(r.unavailable), r.spec.MinReplicas, strings.Join(failing, ", "))
+	} else {
+		reporter.event(v1.EventTypeNormal, "ReplicationHealthy", "%d of %d replicas healthy", healthy, len(r.jobs)+len(r.unavailable))
+	}
+}
+
+// freshestReplica returns the replication state of the replica the source of
+// j is to be recovered from and its file system: the healthy replica synced
+// last. Returns a nil state if no healthy replica has any.
+func (j *syncJob) freshestReplica() (*replicationState, fs.Fs) {
+	candidates := []*syncJob{j}
+	if j.replicas != nil {
+		candidates = j.replicas.jobs
+	}
+	var freshest *replicationState
+	from := j.fdst
+	for _, job := range candidates {
+		if job != j && !job.status().healthy() {
+			continue
+		}
+		state, err := readReplicationState(job.transferCtx, job.fdst)
+		if err != nil {
+			klog.Infof("Volume %q: failed to read replication state of %s: %v", j.spec.VolumeName, job.fdst, err)
+			continue
+		}
+		if state != nil && (freshest == nil || fresherThan(state, freshest)) {
+			freshest, from = state, job.fdst
+		}
+	}
+	return freshest, from
+}
+
+// fresherThan tells whether replica a has been synced after replica b. A
+// replica of a later promotion epoch is fresher.
+func fresherThan(a, b *replicationState) bool {
+	if a.Epoch != b.Epoch {
+		return a.Epoch > b.Epoch
+	}
+	if !a.LastSyncTime.Equal(b.LastSyncTime) {
+		return a.LastSyncTime.After(b.LastSyncTime)
+	}
+	return a.Generation > b.Generation
+}
+
+// lockSource serializes changes of the source of j with the other replicas
+// of its volume. The returned function unlocks it.
+func (j *syncJob) lockSource() func() {
+	if j.replicas == nil {
+		return func() {}
+	}
+	j.replicas.sourceLock.Lock()
+	return j.replicas.sourceLock.Unlock
+}
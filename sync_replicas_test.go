@@ -0,0 +1,147 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncManagerReplicas(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	target2Root := filepath.Join(filepath.Dir(targetRoot), "target2")
+	sourceDir := filepath.Join(sourceRoot, "vol-1")
+	writeFile(t, filepath.Join(sourceDir, "a"), "a", time.Now())
+
+	spec := SyncJobSpec{
+		VolumeName: "pv-1",
+		Source:     "source",
+		Targets:    []string{"target", "target2"},
+		Directory:  "/export/vol-1",
+	}
+	m := NewSyncManager("test", nil)
+	if err := m.Start(spec); err != nil {
+		t.Fatalf("unexpected error starting job: %v", err)
+	}
+	for _, root := range []string{targetRoot, target2Root} {
+		waitForFile(t, filepath.Join(root, "vol-1", replicationStateFile), 10*time.Second)
+	}
+	status, err := m.Status("pv-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Replicas) != 2 || status.HealthyReplicas != 2 || status.Degraded {
+		t.Errorf("unexpected status %+v", status)
+	}
+	m.Shutdown(time.Second)
+
+	// target2 is the freshest replica and has content the other one lacks.
+	writeFile(t, filepath.Join(target2Root, "vol-1", "b"), "b", time.Now())
+	markerPath := filepath.Join(target2Root, "vol-1", replicationStateFile)
+	state := &replicationState{}
+	data, err := ioutil.ReadFile(markerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		t.Fatal(err)
+	}
+	state.LastSyncTime = state.LastSyncTime.Add(time.Hour)
+	replica, err := newFsDirFromVolume(context.Background(), "target2", spec.Directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeReplicationState(context.Background(), replica, state); err != nil {
+		t.Fatal(err)
+	}
+	removeAll(t, sourceDir)
+
+	m = NewSyncManager("test", nil)
+	defer m.Shutdown(time.Second)
+	if err := m.Start(spec); err != nil {
+		t.Fatalf("unexpected error restarting job: %v", err)
+	}
+	waitForFile(t, filepath.Join(sourceDir, "b"), 10*time.Second)
+	waitForFile(t, filepath.Join(targetRoot, "vol-1", "b"), 10*time.Second)
+}
+
+func TestSyncManagerUnavailableTarget(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	target2Dir := filepath.Join(filepath.Dir(targetRoot), "target2", "vol-1")
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "a", time.Now())
+	// A file where the volume directory is expected.
+	writeFile(t, target2Dir, "", time.Now())
+
+	m := NewSyncManager("test", nil)
+	defer m.Shutdown(time.Second)
+	err := m.Start(SyncJobSpec{
+		VolumeName: "pv-1",
+		Source:     "source",
+		Targets:    []string{"target", "target2"},
+		Directory:  "/export/vol-1",
+	})
+	if _, ok := err.(*unavailableError); !ok {
+		t.Fatalf("expected target2 to be unavailable but got %v", err)
+	}
+	waitForFile(t, filepath.Join(targetRoot, "vol-1", "a"), 10*time.Second)
+	status, err := m.Status("pv-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Replicas) != 1 || !status.Degraded || len(status.UnhealthyRemotes) != 1 || status.UnhealthyRemotes[0] != "target2" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if err := m.RetryUnavailable("pv-1"); err == nil {
+		t.Error("expected target2 to be still unavailable")
+	}
+
+	// The replica is added once the remote is healthy again.
+	removeAll(t, target2Dir)
+	m.remoteHealthChanged("target2", true)
+	waitForFile(t, filepath.Join(target2Dir, "a"), 10*time.Second)
+	if status, err := m.Status("pv-1"); err != nil || len(status.Replicas) != 2 || len(status.UnhealthyRemotes) != 0 {
+		t.Errorf("unexpected status %+v: %v", status, err)
+	}
+}
+
+func TestSyncJobSpecValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      SyncJobSpec
+		expectErr bool
+	}{
+		{"single target", SyncJobSpec{Source: "s", Target: "t"}, false},
+		{"several targets", SyncJobSpec{Source: "s", Targets: []string{"t1", "t2"}, MinReplicas: 1}, false},
+		{"no target", SyncJobSpec{Source: "s"}, true},
+		{"target is source", SyncJobSpec{Source: "s", Targets: []string{"t", "s"}}, true},
+		{"duplicate target", SyncJobSpec{Source: "s", Targets: []string{"t", "t"}}, true},
+		{"too many replicas", SyncJobSpec{Source: "s", Targets: []string{"t1", "t2"}, MinReplicas: 3}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := test.spec
+			spec.setDefaults()
+			if err := spec.validate(); (err != nil) != test.expectErr {
+				t.Errorf("expected error %t but got %v", test.expectErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// DefaultMaxConcurrentSyncs is the number of replication passes running
+	// at once unless set with SetConcurrency.
+	DefaultMaxConcurrentSyncs = 16
+	// DefaultMaxConcurrentSyncsPerRemote is the number of replication passes
+	// replicating to the same target remote at once unless set with
+	// SetConcurrency. The source of the passes is not counted.
+	DefaultMaxConcurrentSyncsPerRemote = 4
+)
+
+// passScheduler bounds the number of replication passes running at once,
+// in total and per target remote. Passes that are due wait in a queue and run in
+// the order they became due. A pass whose remotes are all busy does not hold
+// up passes behind it that use other remotes.
+type passScheduler struct {
+	lock sync.Mutex
+	// maxTotal and maxPerRemote are the limits, 0 for no limit.
+	maxTotal     int
+	maxPerRemote int
+	running      int
+	remotes      map[string]int
+	queue        []*passRequest
+}
+
+// passRequest is a pass waiting in the queue.
+type passRequest struct {
+	remotes []string
+	// ready is closed when the pass may run.
+	ready chan struct{}
+}
+
+func newPassScheduler(maxTotal, maxPerRemote int) *passScheduler {
+	return &passScheduler{
+		maxTotal:     maxTotal,
+		maxPerRemote: maxPerRemote,
+		remotes:      map[string]int{},
+	}
+}
+
+// setLimits changes the limits. Passes running above new, lower limits are
+// not interrupted.
+func (s *passScheduler) setLimits(maxTotal, maxPerRemote int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maxTotal, s.maxPerRemote = maxTotal, maxPerRemote
+	s.dispatch()
+}
+
+// acquire blocks until a pass using the given remotes may run or ctx is
+// done. The returned function must be called when the pass has finished.
+func (s *passScheduler) acquire(ctx context.Context, remotes []string) (func(), error) {
+	start := time.Now()
+	req := &passRequest{remotes: remotes, ready: make(chan struct{})}
+	s.lock.Lock()
+	s.queue = append(s.queue, req)
+	SM.SchedulerQueueDepth.Inc()
+	s.dispatch()
+	s.lock.Unlock()
+
+	select {
+	case <-req.ready:
+	case <-ctx.Done():
+		s.lock.Lock()
+		select {
+		case <-req.ready:
+			// Granted in the meantime, hand the slot on.
+			s.lock.Unlock()
+			s.release(remotes)
+		default:
+			s.remove(req)
+			s.lock.Unlock()
+		}
+		return nil, ctx.Err()
+	}
+	wait := time.Since(start)
+	SM.SchedulerWaitSeconds.Observe(wait.Seconds())
+	klog.V(5).Infof("Replication pass on %v waited %v", remotes, wait)
+	return func() { s.release(remotes) }, nil
+}
+
+// release ends a pass and starts the queued passes that fit.
+func (s *passScheduler) release(remotes []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.running--
+	for _, remote := range remotes {
+		if s.remotes[remote]--; s.remotes[remote] == 0 {
+			delete(s.remotes, remote)
+		}
+	}
+	SM.SchedulerRunningPasses.Dec()
+	s.dispatch()
+}
+
+// dispatch starts the queued passes that fit in queue order. Must be called
+// with the lock held.
+func (s *passScheduler) dispatch() {
+	queue := s.queue[:0]
+	for _, req := range s.queue {
+		if s.fits(req.remotes) {
+			s.take(req.remotes)
+			SM.SchedulerQueueDepth.Dec()
+			close(req.ready)
+		} else {
+			queue = append(queue, req)
+		}
+	}
+	for i := len(queue); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+	s.queue = queue
+}
+
+// remove drops a request from the queue. Must be called with the lock held.
+func (s *passScheduler) remove(req *passRequest) {
+	for i, r := range s.queue {
+		if r == req {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			SM.SchedulerQueueDepth.Dec()
+			return
+		}
+	}
+}
+
+// fits returns whether a pass using remotes may run. Must be called with the
+// lock held.
+func (s *passScheduler) fits(remotes []string) bool {
+	if s.maxTotal > 0 && s.running >= s.maxTotal {
+		return false
+	}
+	if s.maxPerRemote > 0 {
+		for _, remote := range remotes {
+			if s.remotes[remote] >= s.maxPerRemote {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// take accounts a pass using remotes as running. Must be called with the lock
+// held.
+func (s *passScheduler) take(remotes []string) {
+	s.running++
+	for _, remote := range remotes {
+		s.remotes[remote]++
+	}
+	SM.SchedulerRunningPasses.Inc()
+}
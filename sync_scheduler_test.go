@@ -0,0 +1,116 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPassScheduler(t *testing.T) {
+	ctx := context.Background()
+	s := newPassScheduler(2, 1)
+
+	// acquireAsync queues a pass and returns a channel receiving its
+	// release function once it runs.
+	acquireAsync := func(ctx context.Context, remotes ...string) <-chan func() {
+		granted := make(chan func(), 1)
+		go func() {
+			if release, err := s.acquire(ctx, remotes); err == nil {
+				granted <- release
+			}
+		}()
+		// Keep the queue order deterministic.
+		time.Sleep(20 * time.Millisecond)
+		return granted
+	}
+	running := func(granted <-chan func()) func() {
+		t.Helper()
+		select {
+		case release := <-granted:
+			return release
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected pass to run")
+			return nil
+		}
+	}
+	waiting := func(granted <-chan func()) {
+		t.Helper()
+		select {
+		case <-granted:
+			t.Fatal("expected pass to wait")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	releaseA := running(acquireAsync(ctx, "source", "a"))
+	// The source is busy.
+	second := acquireAsync(ctx, "source", "b")
+	waiting(second)
+	// A pass on other remotes is not held up by the one in front of it.
+	releaseC := running(acquireAsync(ctx, "other", "c"))
+	// The total is reached.
+	cancelled, cancel := context.WithCancel(ctx)
+	third := acquireAsync(cancelled, "d")
+	fourth := acquireAsync(ctx, "e")
+	waiting(third)
+
+	cancel()
+	releaseC()
+	// The cancelled pass has left the queue, the pass behind it runs.
+	releaseE := running(fourth)
+	waiting(second)
+	releaseA()
+	releaseB := running(second)
+
+	releaseB()
+	releaseE()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.running != 0 || len(s.remotes) != 0 || len(s.queue) != 0 {
+		t.Errorf("expected idle scheduler but got %d running, remotes %v, %d queued", s.running, s.remotes, len(s.queue))
+	}
+}
+
+func TestTargetRemotes(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     SyncJobSpec
+		expected []string
+	}{
+		{
+			name:     "mirror",
+			spec:     SyncJobSpec{Source: "source", Target: "target"},
+			expected: []string{"target"},
+		},
+		{
+			name:     "erasure",
+			spec:     SyncJobSpec{Source: "source", Target: "erasure", Targets: []string{"target", "target2", "source"}, Layout: LayoutErasure},
+			expected: []string{"target", "target2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			job := &syncJob{spec: test.spec}
+			if remotes := job.targetRemotes(); !reflect.DeepEqual(remotes, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, remotes)
+			}
+		})
+	}
+}
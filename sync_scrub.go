@@ -0,0 +1,258 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/operations"
+	v1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// scrubEventFiles is how many files of each kind a ReplicaDivergence event
+// names.
+const scrubEventFiles = 5
+
+// ScrubResult is the outcome of the last scrub of a replica: the files,
+// relative to the volume root, found to differ between the source and the
+// replica.
+type ScrubResult struct {
+	Time time.Time
+	// Mismatched files differ in size or hash, Missing files exist on the
+	// source only and Extra files on the replica only.
+	Mismatched []string
+	Missing    []string
+	Extra      []string
+	// Repaired is the number of files repaired from the authoritative side.
+	Repaired int
+	// Error is why the scrub or its repair failed.
+	Error string
+}
+
+// diverged tells whether the replica differed from the source.
+func (r *ScrubResult) diverged() bool {
+	return len(r.Mismatched)+len(r.Missing)+len(r.Extra) > 0
+}
+
+// scrubDue tells whether the replica is to be scrubbed after the current
+// pass.
+func (j *syncJob) scrubDue() bool {
+	return j.spec.ScrubInterval > 0 && time.Since(j.lastScrub) >= j.spec.ScrubInterval
+}
+
+// scrub compares every file of the source and the replica by size and, where
+// both remotes support a common hash, by hash. Divergences are reported on
+// the claim and, with ScrubRepair, repaired from the authoritative side: the
+// target for two-way replication resolved by ConflictPolicyTargetWins, the
+// source otherwise.
+func (j *syncJob) scrub() *ScrubResult {
+	j.lastScrub = time.Now()
+	ctx := accounting.WithStatsGroup(j.transferCtx, "csiraid-scrub-"+j.spec.VolumeName+"-"+j.spec.Target)
+	accounting.Stats(ctx).ResetCounters()
+
+	klog.V(4).Infof("Volume %q: scrubbing %s", j.spec.VolumeName, j.fdst)
+	var differ, missing, extra, failed bytes.Buffer
+	fi, err := j.spec.Filter.newFilter(true)
+	if err == nil {
+		ctx = filter.ReplaceConfig(ctx, fi)
+		err = operations.Check(ctx, &operations.CheckOpt{
+			Fsrc:         j.fsrc,
+			Fdst:         j.fdst,
+			Differ:       &differ,
+			MissingOnDst: &missing,
+			MissingOnSrc: &extra,
+			Error:        &failed,
+		})
+	}
+	result := &ScrubResult{
+		Mismatched: scrubFiles(&differ),
+		Missing:    scrubFiles(&missing),
+		Extra:      scrubFiles(&extra),
+	}
+	// Check fails whenever it finds differences, only other failures make
+	// the result incomplete.
+	if err != nil && (!result.diverged() || failed.Len() > 0) {
+		result.Error = err.Error()
+	}
+
+	if result.diverged() {
+		j.event(v1.EventTypeWarning, "ReplicaDivergence", "%s differs from %s: %s",
+			j.fdst, j.fsrc, scrubSummary(result))
+		if j.spec.ScrubRepair && result.Error == "" {
+			repaired, err := j.repairDivergence(ctx, result)
+			result.Repaired = repaired
+			if err != nil {
+				result.Error = fmt.Sprintf("failed to repair: %v", err)
+			}
+			if repaired > 0 {
+				j.event(v1.EventTypeNormal, "ReplicaRepaired", "Repaired %d files of %s", repaired, j.fdst)
+				// The markers must not take the repairs for writes made
+				// outside of the replication.
+				j.updateReplicationState(true, j.spec.Direction != SyncDirectionTwoWay)
+			}
+		}
+	}
+	if result.Error != "" {
+		klog.Infof("Volume %q: scrub of %s: %s", j.spec.VolumeName, j.fdst, result.Error)
+	}
+	result.Time = time.Now()
+
+	labels := j.metricLabels()
+	SM.ScrubMismatchedFiles.WithLabelValues(labels...).Set(float64(len(result.Mismatched)))
+	SM.ScrubMissingFiles.WithLabelValues(labels...).Set(float64(len(result.Missing)))
+	SM.ScrubExtraFiles.WithLabelValues(labels...).Set(float64(len(result.Extra)))
+	SM.ScrubTimestampSeconds.WithLabelValues(labels...).Set(float64(result.Time.Unix()))
+	SM.ScrubRepairedFilesTotal.WithLabelValues(labels...).Add(float64(result.Repaired))
+
+	j.lock.Lock()
+	j.lastScrubResult = result
+	j.lock.Unlock()
+	return result
+}
+
+// repairDivergence makes the other side match the authoritative side for
+// the files of result. Returns the number of files repaired. The deletions
+// are braked as those of a pass and the files replaced or deleted on the
+// target are kept as versions. Files are only deleted from the source once
+// the deletion is acknowledged, a hold is engaged for them otherwise and the
+// next scrub follows the acknowledgement.
+func (j *syncJob) repairDivergence(ctx context.Context, result *ScrubResult) (int, error) {
+	from, to := j.fsrc, j.fdst
+	copies := append(append([]string{}, result.Mismatched...), result.Missing...)
+	deletes := result.Extra
+	toSource := j.spec.Direction == SyncDirectionTwoWay && j.spec.ConflictPolicy == ConflictPolicyTargetWins
+	if toSource {
+		from, to = j.fdst, j.fsrc
+		copies = append(append([]string{}, result.Mismatched...), result.Extra...)
+		deletes = result.Missing
+		defer j.lockSource()()
+	}
+
+	var heldErr error
+	if len(deletes) > 0 && !j.acknowledged && (toSource || j.spec.DeletionBrake.enabled()) {
+		count, err := countDeletions(ctx, to, deletes)
+		if err != nil {
+			return 0, err
+		}
+		if toSource {
+			heldErr = j.holdDeletion(to, count)
+		} else {
+			heldErr = j.brake(to, count)
+		}
+		if heldErr != nil {
+			deletes = nil
+			j.lastScrub = time.Time{}
+		}
+	}
+	var versions fs.Fs
+	if !toSource {
+		vctx, err := j.withVersions(ctx, "")
+		if err != nil {
+			return 0, err
+		}
+		ctx, versions = vctx, j.versions
+	}
+
+	repaired := 0
+	var firstErr error
+	fail := func(remote string, err error) {
+		klog.Infof("Volume %q: failed to repair %s on %s: %v", j.spec.VolumeName, remote, to, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, remote := range copies {
+		src, err := from.NewObject(ctx, remote)
+		if err != nil {
+			fail(remote, err)
+			continue
+		}
+		dst, err := to.NewObject(ctx, remote)
+		if err != nil {
+			dst = nil
+		}
+		if dst != nil && versions != nil {
+			if err := operations.MoveBackupDir(ctx, versions, dst); err != nil {
+				fail(remote, err)
+				continue
+			}
+			dst = nil
+		}
+		if _, err := operations.Copy(ctx, to, dst, remote, src); err != nil {
+			fail(remote, err)
+			continue
+		}
+		repaired++
+	}
+	for _, remote := range deletes {
+		dst, err := to.NewObject(ctx, remote)
+		if err == nil {
+			err = operations.DeleteFileWithBackupDir(ctx, dst, versions)
+		}
+		if err != nil && err != fs.ErrorObjectNotFound {
+			fail(remote, err)
+			continue
+		}
+		repaired++
+	}
+	if firstErr == nil {
+		firstErr = heldErr
+	}
+	return repaired, firstErr
+}
+
+// scrubFiles returns the file names Check wrote to buf, one per line.
+func scrubFiles(buf *bytes.Buffer) []string {
+	var files []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files
+}
+
+// scrubSummary describes the divergences of result for an event.
+func scrubSummary(result *ScrubResult) string {
+	var parts []string
+	for _, kind := range []struct {
+		name  string
+		files []string
+	}{
+		{"mismatched", result.Mismatched},
+		{"missing", result.Missing},
+		{"extra", result.Extra},
+	} {
+		if len(kind.files) == 0 {
+			continue
+		}
+		names := kind.files
+		if len(names) > scrubEventFiles {
+			names = append(names[:scrubEventFiles:scrubEventFiles], "...")
+		}
+		parts = append(parts, fmt.Sprintf("%d %s (%s)", len(kind.files), kind.name, strings.Join(names, ", ")))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/record"
+)
+
+func TestScrub(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	sourceDir := filepath.Join(sourceRoot, "vol-1")
+	targetDir := filepath.Join(targetRoot, "vol-1")
+	modTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeFile(t, filepath.Join(sourceDir, "a"), "aaaa", modTime)
+	writeFile(t, filepath.Join(sourceDir, "dir", "b"), "b", modTime)
+
+	recorder := record.NewFakeRecorder(10)
+	job := newTestSyncJob(t, SyncJobSpec{
+		VolumeName: "pv-1",
+	})
+	job.recorder = recorder
+	job.syncPass()
+	if job.scrubDue() {
+		t.Error("expected the first scrub one interval after the start")
+	}
+	if result := job.scrub(); result.diverged() || result.Error != "" {
+		t.Fatalf("expected replica to match: %+v", result)
+	}
+
+	// Bit rot a sync does not notice, a lost and an extra file.
+	writeFile(t, filepath.Join(targetDir, "a"), "abcd", modTime)
+	removeAll(t, filepath.Join(targetDir, "dir", "b"))
+	writeFile(t, filepath.Join(targetDir, "c"), "c", modTime)
+
+	result := job.scrub()
+	if result.Error != "" {
+		t.Fatalf("unexpected error: %s", result.Error)
+	}
+	for _, check := range []struct {
+		name     string
+		files    []string
+		expected []string
+	}{
+		{"mismatched", result.Mismatched, []string{"a"}},
+		{"missing", result.Missing, []string{"dir/b"}},
+		{"extra", result.Extra, []string{"c"}},
+	} {
+		if !reflect.DeepEqual(check.files, check.expected) {
+			t.Errorf("expected %s files %v but got %v", check.name, check.expected, check.files)
+		}
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "ReplicaDivergence") {
+		t.Errorf("expected ReplicaDivergence event but got %q", event)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(targetDir, "a")); string(data) != "abcd" {
+		t.Error("expected no repair without scrubRepair")
+	}
+
+	job.spec.ScrubRepair = true
+	if result := job.scrub(); result.Repaired != 3 || result.Error != "" {
+		t.Fatalf("expected 3 files repaired: %+v", result)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(targetDir, "a")); string(data) != "aaaa" {
+		t.Errorf("expected a to be repaired but got %q", data)
+	}
+	if !exists(filepath.Join(targetDir, "dir", "b")) || exists(filepath.Join(targetDir, "c")) {
+		t.Error("expected missing file restored and extra file deleted")
+	}
+	if result := job.scrub(); result.diverged() {
+		t.Errorf("expected replica to match after repair: %+v", result)
+	}
+	if status := job.status(); status.LastScrub == nil || status.LastScrub.diverged() {
+		t.Errorf("expected last scrub in status: %+v", status.LastScrub)
+	}
+}
+
+func TestScrubRepairSafety(t *testing.T) {
+	t.Run("replaced files are versioned", func(t *testing.T) {
+		sourceRoot, targetRoot := testRemotes(t)
+		modTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "aaaa", modTime)
+		job := newTestSyncJob(t, SyncJobSpec{
+			VolumeName:  "pv-1",
+			ScrubRepair: true,
+			Versioning:  VersioningSpec{Enabled: true},
+		})
+		job.syncPass()
+		writeFile(t, filepath.Join(targetRoot, "vol-1", "a"), "abcd", modTime)
+		if result := job.scrub(); result.Repaired != 1 || result.Error != "" {
+			t.Fatalf("expected a to be repaired: %+v", result)
+		}
+		versions, err := job.listVersions(context.Background(), "a")
+		if err != nil || len(versions) != 1 {
+			t.Errorf("expected the replaced file to be kept as a version but got %v: %v", versions, err)
+		}
+	})
+
+	t.Run("deletions from the source are held", func(t *testing.T) {
+		sourceRoot, targetRoot := testRemotes(t)
+		writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "a", time.Now())
+		job := newTestSyncJob(t, SyncJobSpec{
+			VolumeName:     "pv-1",
+			Direction:      SyncDirectionTwoWay,
+			ConflictPolicy: ConflictPolicyTargetWins,
+			ScrubRepair:    true,
+		})
+		job.syncPass()
+		// Written to the source after the pass.
+		writeFile(t, filepath.Join(sourceRoot, "vol-1", "new"), "new", time.Now())
+		result := job.scrub()
+		if result.Repaired != 0 || !strings.Contains(result.Error, errDeletionHeld.Error()) {
+			t.Fatalf("expected the repair to be held: %+v", result)
+		}
+		hold := job.status().DeletionHold
+		if hold == nil || hold.Files != 1 || !strings.Contains(hold.Remote, sourceRoot) {
+			t.Fatalf("unexpected hold %+v", hold)
+		}
+		if !exists(filepath.Join(sourceRoot, "vol-1", "new")) {
+			t.Fatal("expected the file to be kept on the source")
+		}
+		if !job.scrubDue() {
+			t.Error("expected a scrub after the acknowledgement")
+		}
+		if !job.acknowledge(hold.Token) {
+			t.Fatal("expected acknowledgement to release the hold")
+		}
+		// The pass following the acknowledgement replicates the file
+		// first, the scrub has nothing left to delete.
+		job.syncPass()
+		if !exists(filepath.Join(sourceRoot, "vol-1", "new")) || !exists(filepath.Join(targetRoot, "vol-1", "new")) {
+			t.Error("expected the file to be replicated")
+		}
+		if status := job.status(); status.DeletionHold != nil || status.LastScrub == nil || status.LastScrub.diverged() {
+			t.Errorf("expected the replica to match: %+v", status.LastScrub)
+		}
+	})
+}
@@ -0,0 +1,488 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/sync"
+	v1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// stateDir is the directory in the root of a volume holding the state of
+// its replication rather than its content. It is never replicated itself:
+// the stateDirRule excludes it from every pass. Being part of the volume, it
+// is lost together with its content, but also when a user removes every
+// file of the volume, dotfiles included: the anchor of the volume tells a
+// wiped volume from an emptied one.
+const stateDir = ".csiraid"
+
+// volumeAnchorDir is the directory next to the volumes on a remote, outside
+// of their exports, holding an anchor object per volume replicated from the
+// remote. An anchor is lost only with the remote or the directory of its
+// volume.
+const volumeAnchorDir = ".csiraid-volumes"
+
+// stateDirRule is the filter rule excluding the stateDir of the volume root.
+const stateDirRule = "/" + stateDir + "/**"
+
+// replicationStateFile is the marker object in the stateDir of a volume on
+// both remotes.
+const replicationStateFile = stateDir + "/state.json"
+
+// replicationStateRefreshInterval is how often the markers are rewritten
+// when the volume does not change, to keep LastSyncTime current.
+const replicationStateRefreshInterval = time.Minute
+
+// replicationDigestInterval is how often the digests of the copies are
+// listed at most, while the volume changes or they are unknown.
+var replicationDigestInterval = time.Minute
+
+// replicationState is the content of the marker object. A remote without
+// marker has never been part of a successful replication of the volume, or
+// it has lost its content.
+type replicationState struct {
+	// Volume is the name of the PersistentVolume.
+	Volume string `json:"volume"`
+	// Generation is the generation of the content of the copy. It is
+	// increased only when the copy is written to: on a source by every pass
+	// that replicated its changes and by its promotion, a replica takes the
+	// generation of the source it is synced with.
+	Generation int64 `json:"generation"`
+	// Epoch is increased when the copy is promoted to the primary copy of
+	// the volume, and replicated with the generation.
+	Epoch int64 `json:"epoch,omitempty"`
+	// Synced is the last generation the copy had in common with each other
+	// copy, by remote: one per target on a source, the one of its source on
+	// a replica. Each replica of a source updates its own entry only.
+	Synced map[string]int64 `json:"synced,omitempty"`
+	// Digest is the listingDigest of the copy when the marker was written,
+	// empty if it is not known. A copy whose listing does not match it any
+	// more has been written to since.
+	Digest string `json:"digest,omitempty"`
+	// LastSyncTime is the end of the last successful pass.
+	LastSyncTime time.Time `json:"lastSyncTime"`
+	// ControllerID is the identity of the controller that wrote the marker.
+	ControllerID string `json:"controllerID"`
+}
+
+// recoveryDecision is what a pass does when the source is empty but the
+// target is not.
+type recoveryDecision string
+
+const (
+	// recoveryRestore copies the target back: the source has lost its
+	// marker and its anchor together with its content, it is a fresh or
+	// wiped replica.
+	recoveryRestore recoveryDecision = "Restore"
+	// recoveryReplicate replicates the empty source: the source still has
+	// its marker or its anchor, so it has been emptied by the user.
+	recoveryReplicate recoveryDecision = "Replicate"
+	// recoveryHold does neither: the target has no marker, so it cannot be
+	// told whether it or the source is the current copy.
+	recoveryHold recoveryDecision = "Hold"
+)
+
+// decideRecovery decides what to do with a volume whose source is empty and
+// whose target is not, given the markers found on both remotes and whether
+// the source is anchored. A source that lost its marker but is anchored has
+// been emptied through its mount, dotfiles included.
+func decideRecovery(source, target *replicationState, anchored bool) recoveryDecision {
+	switch {
+	case source != nil:
+		return recoveryReplicate
+	case target == nil:
+		return recoveryHold
+	case anchored:
+		return recoveryReplicate
+	default:
+		return recoveryRestore
+	}
+}
+
+// volumeAnchor returns the file system of the root of the remote of the
+// volume f and the name of the anchor of the volume in it.
+func volumeAnchor(ctx context.Context, f fs.Fs) (fs.Fs, string, error) {
+	loadRcloneConfig()
+	dir, _ := config.Data().GetValue(f.Name(), "path")
+	root, err := fs.NewFs(ctx, f.Name()+":"+dir)
+	if err != nil {
+		return nil, "", err
+	}
+	return root, volumeAnchorDir + "/" + path.Base(f.Root()), nil
+}
+
+// writeVolumeAnchor writes the anchor of the volume f of the given name.
+func writeVolumeAnchor(ctx context.Context, f fs.Fs, volumeName string) error {
+	root, remote, err := volumeAnchor(ctx, f)
+	if err != nil {
+		return err
+	}
+	return writeStateFile(ctx, root, remote, &replicationState{Volume: volumeName}, time.Now())
+}
+
+// removeVolumeAnchor removes the anchor of the volume f, if any.
+func removeVolumeAnchor(ctx context.Context, f fs.Fs) error {
+	root, remote, err := volumeAnchor(ctx, f)
+	if err != nil {
+		return err
+	}
+	obj, err := root.NewObject(ctx, remote)
+	if err == fs.ErrorObjectNotFound || err == fs.ErrorDirNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return obj.Remove(ctx)
+}
+
+// anchored tells whether the directory of the volume f exists and its remote
+// holds the anchor of the volume.
+func anchored(ctx context.Context, f fs.Fs) (bool, error) {
+	if _, err := f.List(ctx, ""); err == fs.ErrorDirNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	root, remote, err := volumeAnchor(ctx, f)
+	if err != nil {
+		return false, err
+	}
+	_, err = root.NewObject(ctx, remote)
+	if err == fs.ErrorObjectNotFound || err == fs.ErrorDirNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// readReplicationState returns the marker of f, nil if there is none.
+func readReplicationState(ctx context.Context, f fs.Fs) (*replicationState, error) {
+	state := &replicationState{}
+	if found, err := readStateFile(ctx, f, replicationStateFile, state); !found || err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// writeReplicationState writes state as marker of f.
+func writeReplicationState(ctx context.Context, f fs.Fs, state *replicationState) error {
+	return writeStateFile(ctx, f, replicationStateFile, state, state.LastSyncTime)
+}
+
+// readStateFile decodes the JSON object remote of f into v. Returns false if
+// there is no such object.
+func readStateFile(ctx context.Context, f fs.Fs, remote string, v interface{}) (bool, error) {
+	obj, err := f.NewObject(ctx, remote)
+	if err == fs.ErrorObjectNotFound || err == fs.ErrorDirNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	in, err := obj.Open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("invalid %s on %s: %v", remote, f, err)
+	}
+	return true, nil
+}
+
+// writeStateFile writes v as JSON object remote of f.
+func writeStateFile(ctx context.Context, f fs.Fs, remote string, v interface{}, modTime time.Time) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = operations.Rcat(ctx, f, remote, ioutil.NopCloser(bytes.NewReader(data)), modTime)
+	return err
+}
+
+// isStateFile tells whether remote, relative to the volume root, is the
+// stateDir or below it.
+func isStateFile(remote string) bool {
+	return remote == stateDir || strings.HasPrefix(remote, stateDir+"/")
+}
+
+// countVolumeEntries returns the number of entries of a volume root listing
+// that are not state files and are selected by the filter of ctx. A volume
+// holding excluded entries only, such as a freshly formatted lost+found, is
+// empty.
+func countVolumeEntries(ctx context.Context, entries fs.DirEntries) int {
+	fi := filter.GetConfig(ctx)
+	n := 0
+	for _, entry := range entries {
+		if !isStateFile(entry.Remote()) && includedEntry(ctx, fi, entry) {
+			n++
+		}
+	}
+	return n
+}
+
+// recover decides what to do with the volume of j, whose source is empty
+// while its target is not, and restores the source from the freshest replica
+// if it is a wiped replica. ctx is the context of the pass. Returns true if
+// the source is to be replicated to the target afterwards.
+func (j *syncJob) recover(ctx context.Context) bool {
+	defer j.lockSource()()
+	// Another replica may have restored the source in the meantime.
+	if entries, err := listVolume(ctx, j.fsrc); err == nil && countVolumeEntries(ctx, entries) > 0 {
+		return true
+	}
+	source, err := readReplicationState(j.transferCtx, j.fsrc)
+	if err != nil {
+		klog.Infof("Volume %q: failed to read replication state of %s: %v", j.spec.VolumeName, j.fsrc, err)
+		j.recordSync(err)
+		return false
+	}
+	target, from := j.freshestReplica()
+	j.sourceState, j.statesLoaded = source, false
+	var anchor bool
+	if source == nil && target != nil {
+		if anchor, err = anchored(j.transferCtx, j.fsrc); err != nil {
+			klog.Infof("Volume %q: failed to read the anchor of %s: %v", j.spec.VolumeName, j.fsrc, err)
+			j.recordSync(err)
+			return false
+		}
+	}
+
+	decision := decideRecovery(source, target, anchor)
+	report := decision != j.lastDecision
+	j.lastDecision = decision
+	switch decision {
+	case recoveryRestore:
+		j.event(v1.EventTypeNormal, "RecoveryStarted", "Source %s is empty and has no replication state, restoring generation %d from %s, last synced at %s by %s",
+			j.fsrc, target.Generation, from, target.LastSyncTime.Format(time.RFC3339), target.ControllerID)
+		j.setRecovering(true)
+		err := sync.Sync(ctx, j.fsrc, from, false)
+		j.recordSync(err)
+		j.setRecovering(false)
+		if err != nil {
+			j.event(v1.EventTypeWarning, "RecoveryFailed", "Failed to restore %s from %s: %v", j.fsrc, from, err)
+			return false
+		}
+		j.event(v1.EventTypeNormal, "RecoveryFinished", "Restored %s from %s", j.fsrc, from)
+		SM.RecoveriesTotal.WithLabelValues(j.metricLabels()...).Inc()
+		// A later wipe is reported again.
+		j.lastDecision = ""
+		return true
+	case recoveryReplicate:
+		if report && source == nil {
+			j.event(v1.EventTypeNormal, "VolumeEmptied", "Source %s has been emptied together with its replication state, replicating the deletion to %s",
+				j.fsrc, j.fdst)
+		} else if report {
+			j.event(v1.EventTypeNormal, "VolumeEmptied", "Source %s has been emptied, replicating the deletion to %s", j.fsrc, j.fdst)
+		}
+		return true
+	default:
+		if report {
+			j.event(v1.EventTypeWarning, "RecoveryHeld", "Source %s is empty and neither it nor any replica has replication state, not replicating until the source has content again",
+				j.fsrc)
+		}
+		return false
+	}
+}
+
+// loadReplicationStates reads the markers of both remotes unless they have
+// been read since they were last written. Returns false if either cannot be
+// read.
+func (j *syncJob) loadReplicationStates() bool {
+	if j.statesLoaded {
+		return true
+	}
+	ctx := j.transferCtx
+	var err error
+	if j.sourceState, err = readReplicationState(ctx, j.fsrc); err != nil {
+		klog.Infof("Volume %q: failed to read replication state of %s: %v", j.spec.VolumeName, j.fsrc, err)
+		return false
+	}
+	if j.targetState, err = readReplicationState(ctx, j.fdst); err != nil {
+		klog.Infof("Volume %q: failed to read replication state of %s: %v", j.spec.VolumeName, j.fdst, err)
+		return false
+	}
+	j.statesLoaded = true
+	return true
+}
+
+// updateReplicationState writes the markers of both remotes after a
+// successful pass. The generation of the source is increased if the pass
+// replicated changes not counted yet, the target takes it. The digests of
+// both copies are listed again by a full pass that changed the target or
+// found them unknown, at most every replicationDigestInterval: the passes in
+// between leave them unknown. Unchanged markers are rewritten every
+// replicationStateRefreshInterval only.
+func (j *syncJob) updateReplicationState(changed, full bool) {
+	ctx := j.transferCtx
+	if !j.loadReplicationStates() {
+		return
+	}
+
+	now := time.Now()
+	marked := j.sourceState != nil && j.targetState != nil
+	listDue := full && now.Sub(j.digestsListed) >= replicationDigestInterval
+	unknown := marked && (j.sourceState.Digest == "" || j.targetState.Digest == "")
+	if !changed && marked && !(unknown && listDue) &&
+		now.Sub(j.targetState.LastSyncTime) < replicationStateRefreshInterval {
+		return
+	}
+	// A pass that changed nothing left both digests valid. currentDigest
+	// is the listing of the source, even if not recorded.
+	var sourceDigest, targetDigest, currentDigest string
+	keepDigests := !changed && marked && !(unknown && listDue)
+	if keepDigests {
+		targetDigest = j.targetState.Digest
+	} else if listDue {
+		var err error
+		if sourceDigest, err = listingDigest(ctx, j.fsrc); err == nil {
+			targetDigest, err = listingDigest(ctx, j.fdst)
+		}
+		if err != nil {
+			klog.Infof("Volume %q: failed to list the copies for their digests: %v", j.spec.VolumeName, err)
+			sourceDigest, targetDigest = "", ""
+		} else {
+			j.digestsListed = now
+		}
+		currentDigest = sourceDigest
+	} else if changed && full && j.sourceState != nil && j.sourceState.Digest != "" {
+		// The changes may be reverted writes to the target, which the
+		// listing of the source tells as long as its digest is known.
+		var err error
+		if currentDigest, err = listingDigest(ctx, j.fsrc); err != nil {
+			klog.Infof("Volume %q: failed to list %s for its digest: %v", j.spec.VolumeName, j.fsrc, err)
+		}
+	}
+
+	// The source marker is shared with the other replicas of the volume:
+	// it is read again and only the entry of this target is replaced.
+	unlock := j.lockSource()
+	defer unlock()
+	source, err := readReplicationState(ctx, j.fsrc)
+	if err != nil {
+		klog.Infof("Volume %q: failed to read replication state of %s: %v", j.spec.VolumeName, j.fsrc, err)
+		j.statesLoaded = false
+		return
+	}
+	var generation, epoch int64
+	if j.targetState != nil {
+		generation, epoch = j.targetState.Generation, j.targetState.Epoch
+	}
+	if source != nil {
+		if source.Generation > generation {
+			generation = source.Generation
+		}
+		if source.Epoch > epoch {
+			epoch = source.Epoch
+		}
+	}
+	if source == nil {
+		generation++
+	} else if synced, ok := source.Synced[j.spec.Target]; changed && (!ok || synced >= source.Generation) &&
+		(currentDigest == "" || currentDigest != source.Digest) {
+		// The changes replicated to a target that was behind are those
+		// another replica already counted in the generation of the source,
+		// those of a source whose files did not change reverted writes to
+		// the target.
+		generation++
+	}
+	target := &replicationState{
+		Volume:       j.spec.VolumeName,
+		Generation:   generation,
+		Epoch:        epoch,
+		Synced:       map[string]int64{j.spec.Source: generation},
+		Digest:       targetDigest,
+		LastSyncTime: now,
+		ControllerID: j.identity,
+	}
+	if source == nil {
+		source = &replicationState{Volume: j.spec.VolumeName}
+	}
+	if source.Synced == nil {
+		source.Synced = map[string]int64{}
+	}
+	source.Generation, source.Epoch = generation, epoch
+	if !keepDigests {
+		source.Digest = sourceDigest
+	}
+	source.Synced[j.spec.Target] = generation
+	source.LastSyncTime, source.ControllerID = now, j.identity
+
+	// The target first: a source with marker is never restored, so it must
+	// not get one before the target holds its content.
+	if err := writeReplicationState(ctx, j.fdst, target); err != nil {
+		klog.Infof("Volume %q: failed to write replication state to %s: %v", j.spec.VolumeName, j.fdst, err)
+		j.statesLoaded = false
+		return
+	}
+	j.targetState = target
+	if err := writeReplicationState(ctx, j.fsrc, source); err != nil {
+		klog.Infof("Volume %q: failed to write replication state to %s: %v", j.spec.VolumeName, j.fsrc, err)
+		j.statesLoaded = false
+		return
+	}
+	j.sourceState = source
+	if !j.anchored {
+		if err := writeVolumeAnchor(ctx, j.fsrc, j.spec.VolumeName); err != nil {
+			klog.Infof("Volume %q: failed to write the anchor of %s: %v", j.spec.VolumeName, j.fsrc, err)
+		} else {
+			j.anchored = true
+		}
+	}
+	klog.V(4).Infof("Volume %q: replication state generation %d", j.spec.VolumeName, generation)
+}
+
+// listingDigest returns a digest of the paths, sizes and modification times
+// of the files of f. It ignores the filter of the volume, whose age limits
+// would change it without any write.
+func listingDigest(ctx context.Context, f fs.Fs) (string, error) {
+	files, err := listFiles(ctx, f)
+	if err != nil {
+		return "", err
+	}
+	remotes := make([]string, 0, len(files))
+	for remote := range files {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+	h := sha256.New()
+	for _, remote := range remotes {
+		obj := files[remote]
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", remote, obj.Size(), obj.ModTime(ctx).UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSyncPassRecovery(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare changes the volume on the remotes after the first pass.
+		prepare        func(t *testing.T, sourceDir, targetDir string)
+		filter         FilterSpec
+		expectedReason string
+		expectSource   bool
+		expectTarget   bool
+	}{
+		{
+			name: "wiped source is restored",
+			prepare: func(t *testing.T, sourceDir, targetDir string) {
+				removeAll(t, sourceDir)
+			},
+			expectedReason: "RecoveryStarted",
+			expectSource:   true,
+			expectTarget:   true,
+		},
+		{
+			name: "wiped source with excluded directory is restored",
+			prepare: func(t *testing.T, sourceDir, targetDir string) {
+				// The remote is formatted again, with the anchor.
+				removeAll(t, filepath.Dir(sourceDir))
+				if err := os.MkdirAll(filepath.Join(sourceDir, "lost+found"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			},
+			filter:         FilterSpec{Exclude: []string{"lost+found/"}},
+			expectedReason: "RecoveryStarted",
+			expectSource:   true,
+			expectTarget:   true,
+		},
+		{
+			name: "emptied source is replicated",
+			prepare: func(t *testing.T, sourceDir, targetDir string) {
+				removeAll(t, filepath.Join(sourceDir, "a"))
+			},
+			expectedReason: "VolumeEmptied",
+		},
+		{
+			name: "source emptied with its state is replicated",
+			prepare: func(t *testing.T, sourceDir, targetDir string) {
+				removeAll(t, sourceDir)
+				if err := os.MkdirAll(sourceDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expectedReason: "VolumeEmptied",
+		},
+		{
+			name: "source without state is held",
+			prepare: func(t *testing.T, sourceDir, targetDir string) {
+				removeAll(t, sourceDir)
+				removeAll(t, filepath.Join(targetDir, replicationStateFile))
+			},
+			expectedReason: "RecoveryHeld",
+			expectTarget:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sourceRoot, targetRoot := testRemotes(t)
+			sourceDir := filepath.Join(sourceRoot, "vol-1")
+			targetDir := filepath.Join(targetRoot, "vol-1")
+			if err := os.MkdirAll(sourceDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(sourceDir, "a"), []byte("a"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := record.NewFakeRecorder(10)
+			job := newTestSyncJob(t, SyncJobSpec{
+				VolumeName: "pv-1",
+				Filter:     test.filter,
+			})
+			job.recorder = recorder
+			if job.syncPass() {
+				t.Fatal("unexpected stop after the first pass")
+			}
+			for _, dir := range []string{sourceDir, targetDir} {
+				if _, err := os.Stat(filepath.Join(dir, replicationStateFile)); err != nil {
+					t.Fatalf("expected replication state after the first pass: %v", err)
+				}
+			}
+			if !exists(filepath.Join(sourceRoot, volumeAnchorDir, "vol-1")) {
+				t.Fatal("expected anchor of the source after the first pass")
+			}
+
+			test.prepare(t, sourceDir, targetDir)
+			// A new job, as after a restart of the controller.
+			job = newTestSyncJob(t, job.spec)
+			job.recorder = recorder
+			if job.syncPass() {
+				t.Fatal("unexpected stop after the second pass")
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.Contains(event, test.expectedReason) {
+					t.Errorf("expected event %s but got %q", test.expectedReason, event)
+				}
+			default:
+				t.Errorf("expected event %s but got none", test.expectedReason)
+			}
+			if exists(filepath.Join(sourceDir, "a")) != test.expectSource {
+				t.Errorf("expected file on source: %t", test.expectSource)
+			}
+			if exists(filepath.Join(targetDir, "a")) != test.expectTarget {
+				t.Errorf("expected file on target: %t", test.expectTarget)
+			}
+		})
+	}
+}
+
+func TestReplicationDigestInterval(t *testing.T) {
+	sourceRoot, _ := testRemotes(t)
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "a"), "a", time.Now().Add(-time.Hour))
+	job := newTestSyncJob(t, SyncJobSpec{VolumeName: "pv-digest"})
+	digests := func() (string, string) {
+		t.Helper()
+		source, err := readReplicationState(context.Background(), job.fsrc)
+		if err != nil || source == nil {
+			t.Fatalf("expected replication state of the source but got %v", err)
+		}
+		target, err := readReplicationState(context.Background(), job.fdst)
+		if err != nil || target == nil {
+			t.Fatalf("expected replication state of the target but got %v", err)
+		}
+		return source.Digest, target.Digest
+	}
+
+	if job.syncPass() {
+		t.Fatal("unexpected stop")
+	}
+	if source, target := digests(); source == "" || target == "" {
+		t.Fatalf("expected digests after the first pass but got %q, %q", source, target)
+	}
+	// Changes within the interval leave the digests unknown, without
+	// listing the copies again.
+	writeFile(t, filepath.Join(sourceRoot, "vol-1", "b"), "b", time.Now().Add(-time.Hour))
+	if job.syncPass() {
+		t.Fatal("unexpected stop")
+	}
+	if source, target := digests(); source != "" || target != "" {
+		t.Errorf("expected unknown digests after changes within the interval but got %q, %q", source, target)
+	}
+	// A later pass lists them again.
+	defer func(interval time.Duration) { replicationDigestInterval = interval }(replicationDigestInterval)
+	replicationDigestInterval = 0
+	if job.syncPass() {
+		t.Fatal("unexpected stop")
+	}
+	if source, target := digests(); source == "" || source != target {
+		t.Errorf("expected digests of the unchanged copies but got %q, %q", source, target)
+	}
+}
+
+func removeAll(t *testing.T, path string) {
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
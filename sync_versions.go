@@ -0,0 +1,268 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/fspath"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/walk"
+	v1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// versionsDir is the directory next to the volumes on a target that
+	// holds the previous versions of their files, one directory per volume.
+	versionsDir = ".csiraid-versions"
+	// versionTimeFormat names the directory of the versions replaced by a
+	// pass after the time the pass started.
+	versionTimeFormat = "20060102T150405Z"
+	// versionPruneInterval is how often the retention rules are enforced.
+	versionPruneInterval = time.Hour
+)
+
+// VersioningSpec keeps the files of a replica that are overwritten or
+// deleted by a pass. They are moved into a directory named after the time of
+// the pass, below versionsDir on the same remote, with the same path.
+type VersioningSpec struct {
+	Enabled bool
+	// KeepVersions is the most versions kept of a file, 0 for no bound.
+	KeepVersions int
+	// KeepFor is how long versions are kept, 0 for ever.
+	KeepFor time.Duration
+}
+
+// retained tells whether the retention rules prune versions at all.
+func (s VersioningSpec) retained() bool {
+	return s.Enabled && (s.KeepVersions > 0 || s.KeepFor > 0)
+}
+
+// FileVersion is a previous version of a file of a replica.
+type FileVersion struct {
+	// Target is the remote holding the version.
+	Target string
+	// Time is when the version was replaced, it identifies the version.
+	Time    time.Time
+	Size    int64
+	ModTime time.Time
+}
+
+// versionsPath returns the path of the versions of the volume of the job,
+// below dir if it is not empty.
+func (j *syncJob) versionsPath(dir string) (string, error) {
+	target := j.fdst
+	if t, ok := target.(*throttledFs); ok {
+		target = t.Fs
+	}
+	return versionsRoot(target, dir)
+}
+
+// versionsRoot returns the path of the versions of the volume at the root of
+// f, below dir if it is not empty.
+func versionsRoot(f fs.Fs, dir string) (string, error) {
+	parent, leaf, err := fspath.Split(fs.ConfigString(f))
+	if err != nil {
+		return "", err
+	}
+	return fspath.JoinRootPath(parent+versionsDir, path.Join(leaf, dir)), nil
+}
+
+// purgeVersions deletes the versions of the volume at the root of f, if any.
+func purgeVersions(ctx context.Context, f fs.Fs) error {
+	root, err := versionsRoot(f, "")
+	if err != nil {
+		return err
+	}
+	versions, err := fs.NewFs(ctx, root)
+	if err != nil {
+		return err
+	}
+	if _, err := versions.List(ctx, ""); err == fs.ErrorDirNotFound {
+		return nil
+	}
+	return operations.Purge(ctx, versions, "")
+}
+
+// withVersions returns ctx for a pass that replicates the directory dir of
+// the volume, the root if empty. With versioning, the files the pass
+// replaces on the target are moved into a directory of their versions
+// instead, which the pass also records for two-way replication.
+func (j *syncJob) withVersions(ctx context.Context, dir string) (context.Context, error) {
+	j.versions = nil
+	if !j.spec.Versioning.Enabled {
+		return ctx, nil
+	}
+	root, err := j.versionsPath(path.Join(j.passStart.UTC().Format(versionTimeFormat), dir))
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.NewFs(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	// sync.Sync looks the backup directory up in the cache, it must read
+	// at the rate of the volume and accept the objects of the target.
+	f = newThrottledFs(f, j.bandwidth)
+	cache.Put(root, f)
+	j.versions = f
+	ctx, ci := fs.AddConfig(ctx)
+	ci.BackupDir = root
+	return ctx, nil
+}
+
+// versionsFs returns the file system holding all versions of the volume.
+func (j *syncJob) versionsFs(ctx context.Context) (fs.Fs, error) {
+	root, err := j.versionsPath("")
+	if err != nil {
+		return nil, err
+	}
+	return fs.NewFs(ctx, root)
+}
+
+// listVersions returns the versions of the file remote of the volume, the
+// newest first.
+func (j *syncJob) listVersions(ctx context.Context, remote string) ([]FileVersion, error) {
+	f, err := j.versionsFs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.List(ctx, "")
+	if err == fs.ErrorDirNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []FileVersion
+	for _, entry := range entries {
+		t, err := time.Parse(versionTimeFormat, entry.Remote())
+		if _, ok := entry.(fs.Directory); !ok || err != nil {
+			continue
+		}
+		obj, err := f.NewObject(ctx, path.Join(entry.Remote(), remote))
+		if err == fs.ErrorObjectNotFound || err == fs.ErrorDirNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, FileVersion{
+			Target:  j.spec.Target,
+			Time:    t,
+			Size:    obj.Size(),
+			ModTime: obj.ModTime(ctx),
+		})
+	}
+	sort.Slice(versions, func(a, b int) bool { return versions[a].Time.After(versions[b].Time) })
+	return versions, nil
+}
+
+// restoreVersion copies the version of the file remote replaced at t back to
+// the source, from where the next pass replicates it.
+func (j *syncJob) restoreVersion(ctx context.Context, remote string, t time.Time) error {
+	f, err := j.versionsFs(ctx)
+	if err != nil {
+		return err
+	}
+	version, err := f.NewObject(ctx, path.Join(t.UTC().Format(versionTimeFormat), remote))
+	if err != nil {
+		return fmt.Errorf("version of %s at %v: %v", remote, t, err)
+	}
+	defer j.lockSource()()
+	current, err := j.fsrc.NewObject(ctx, remote)
+	if err != nil {
+		current = nil
+	}
+	if _, err := operations.Copy(ctx, j.fsrc, current, remote, version); err != nil {
+		return err
+	}
+	j.event(v1.EventTypeNormal, "VersionRestored", "Restored %s from its version of %s on %s", remote, t.UTC().Format(time.RFC3339), j.spec.Target)
+	return nil
+}
+
+// pruneDue tells whether the retention rules are to be enforced after a
+// pass.
+func (j *syncJob) pruneDue() bool {
+	return j.spec.Versioning.retained() && time.Since(j.lastPrune) >= versionPruneInterval
+}
+
+// pruneVersions deletes the versions beyond the retention rules and the
+// directories left empty. Returns the number of versions deleted.
+func (j *syncJob) pruneVersions(ctx context.Context) (int, error) {
+	j.lastPrune = time.Now()
+	f, err := j.versionsFs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	type version struct {
+		t   time.Time
+		obj fs.Object
+	}
+	byFile := map[string][]version{}
+	err = walk.ListR(ctx, f, "", true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		entries.ForObject(func(obj fs.Object) {
+			slash := strings.IndexByte(obj.Remote(), '/')
+			if slash < 0 {
+				return
+			}
+			t, err := time.Parse(versionTimeFormat, obj.Remote()[:slash])
+			if err != nil {
+				return
+			}
+			remote := obj.Remote()[slash+1:]
+			byFile[remote] = append(byFile[remote], version{t, obj})
+		})
+		return nil
+	})
+	if err == fs.ErrorDirNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	retention := j.spec.Versioning
+	deleted := 0
+	for _, versions := range byFile {
+		sort.Slice(versions, func(a, b int) bool { return versions[a].t.After(versions[b].t) })
+		for i, v := range versions {
+			expired := retention.KeepFor > 0 && time.Since(v.t) > retention.KeepFor
+			if (retention.KeepVersions > 0 && i >= retention.KeepVersions) || expired {
+				if err := operations.DeleteFile(ctx, v.obj); err != nil {
+					return deleted, err
+				}
+				deleted++
+			}
+		}
+	}
+	if deleted > 0 {
+		if err := operations.Rmdirs(ctx, f, "", true); err != nil {
+			return deleted, err
+		}
+		klog.V(4).Infof("Volume %q: pruned %d versions on %s", j.spec.VolumeName, deleted, j.spec.Target)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApplyVersioningParameters(t *testing.T) {
+	var spec SyncJobSpec
+	err := applySyncParameters(&spec, map[string]string{
+		paramVersioning:      "true",
+		paramKeepVersions:    "3",
+		paramKeepVersionsFor: "7d",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := VersioningSpec{Enabled: true, KeepVersions: 3, KeepFor: 7 * 24 * time.Hour}
+	if spec.Versioning != expected {
+		t.Errorf("expected %+v but got %+v", expected, spec.Versioning)
+	}
+	for _, parameters := range []map[string]string{
+		{paramVersioning: "maybe"},
+		{paramKeepVersions: "0"},
+		{paramKeepVersionsFor: "-1h"},
+	} {
+		if err := applySyncParameters(&SyncJobSpec{}, parameters); err == nil {
+			t.Errorf("expected %v to be rejected", parameters)
+		}
+	}
+}
+
+func TestVersionedReplica(t *testing.T) {
+	sourceRoot, targetRoot := testRemotes(t)
+	sourceFile := filepath.Join(sourceRoot, "vol-1", "dir", "f")
+	writeFile(t, sourceFile, "v1", time.Now().Add(-2*time.Hour))
+	ctx := context.Background()
+	job := newTestSyncJob(t, SyncJobSpec{
+		VolumeName: "pv-versions",
+		Versioning: VersioningSpec{Enabled: true},
+	})
+	pass := func() {
+		// Versions are named after the second their pass started.
+		time.Sleep(1100 * time.Millisecond)
+		if job.syncPass() {
+			t.Fatal("unexpected stop")
+		}
+		if status := job.status(); status.LastError != "" {
+			t.Fatalf("unexpected error %s", status.LastError)
+		}
+	}
+	pass()
+	writeFile(t, sourceFile, "v2.", time.Now().Add(-time.Hour))
+	pass()
+	removeAll(t, sourceFile)
+	pass()
+	if exists(filepath.Join(targetRoot, "vol-1", "dir", "f")) {
+		t.Fatal("expected deletion to be replicated")
+	}
+
+	versions, err := job.listVersions(ctx, "dir/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Size != 3 || versions[1].Size != 2 || !versions[0].Time.After(versions[1].Time) {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+	if err := job.restoreVersion(ctx, "dir/f", versions[1].Time); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(sourceFile); string(data) != "v1" {
+		t.Errorf("expected first version to be restored but got %q", data)
+	}
+
+	job.spec.Versioning.KeepVersions = 1
+	if deleted, err := job.pruneVersions(ctx); err != nil || deleted != 1 {
+		t.Fatalf("expected one version to be pruned but got %d: %v", deleted, err)
+	}
+	if versions, _ := job.listVersions(ctx, "dir/f"); len(versions) != 1 || versions[0].Size != 3 {
+		t.Errorf("expected newest version to be kept but got %+v", versions)
+	}
+	job.spec.Versioning.KeepFor = time.Nanosecond
+	if deleted, err := job.pruneVersions(ctx); err != nil || deleted != 1 {
+		t.Fatalf("expected expired version to be pruned but got %d: %v", deleted, err)
+	}
+	if exists(filepath.Join(targetRoot, versionsDir, "vol-1", versions[0].Time.UTC().Format(versionTimeFormat))) {
+		t.Error("expected empty version directories to be removed")
+	}
+}
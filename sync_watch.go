@@ -0,0 +1,243 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rclone/rclone/fs"
+	klog "k8s.io/klog/v2"
+)
+
+// changeNotifyPollInterval is how often remotes implementing ChangeNotify
+// are asked for changes.
+const changeNotifyPollInterval = 10 * time.Second
+
+// notifyMaxWaitPeriods is the most debounce periods a change waits for the
+// volume to be quiet before it is handed over anyway.
+const notifyMaxWaitPeriods = 10
+
+// changeWatcher delivers the directories of a volume that changed, relative
+// to the volume root, in batches once the volume has been quiet for the
+// debounce period, or notifyMaxWaitPeriods debounce periods after the first
+// change of a batch if it is written continuously. The root directory is "".
+//
+// Local paths are watched with inotify. Note that inotify only sees changes
+// made through the mount of this host: an NFS export written to by other
+// clients needs the periodic full pass of notify mode to be replicated.
+type changeWatcher struct {
+	events  chan string
+	batches chan []string
+}
+
+// newChangeWatcher watches f until ctx is done. Returns nil if f can neither
+// be watched locally nor reports changes itself.
+func newChangeWatcher(ctx context.Context, f fs.Fs, debounce time.Duration) *changeWatcher {
+	w := &changeWatcher{
+		events:  make(chan string, 64),
+		batches: make(chan []string),
+	}
+	switch {
+	case f.Features().IsLocal:
+		if err := w.watchLocal(ctx, f.Root()); err != nil {
+			klog.Warningf("Failed to watch %s: %v", f, err)
+			return nil
+		}
+	case f.Features().ChangeNotify != nil:
+		w.watchRemote(ctx, f)
+	default:
+		return nil
+	}
+	go w.debounce(ctx, debounce, notifyMaxWaitPeriods*debounce)
+	return w
+}
+
+func (w *changeWatcher) notify(ctx context.Context, dir string) {
+	if dir == "." || dir == "/" {
+		dir = ""
+	}
+	dir = strings.TrimPrefix(dir, "/")
+	// The replication writes its own state, which is never replicated.
+	if isStateFile(dir) {
+		return
+	}
+	select {
+	case w.events <- dir:
+	case <-ctx.Done():
+	}
+}
+
+// watchLocal watches the directory tree at root with inotify.
+func (w *changeWatcher) watchLocal(ctx context.Context, root string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := addWatches(watcher, root); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				rel, err := filepath.Rel(root, event.Name)
+				if err != nil {
+					continue
+				}
+				rel = filepath.ToSlash(rel)
+				if event.Op&fsnotify.Create != 0 {
+					if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+						// Files may have been created before the watch.
+						if err := addWatches(watcher, event.Name); err != nil {
+							klog.Warningf("Failed to watch %s: %v", event.Name, err)
+						}
+						w.notify(ctx, rel)
+					}
+				}
+				w.notify(ctx, path.Dir(rel))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				// Events may have been lost, let the next batch replicate
+				// everything.
+				klog.Warningf("Error watching %s: %v", root, err)
+				w.notify(ctx, "")
+			}
+		}
+	}()
+	return nil
+}
+
+// addWatches adds dir and all directories below it to watcher.
+func addWatches(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		return watcher.Add(p)
+	})
+}
+
+// watchRemote relays the change notifications of a remote such as Google
+// Drive.
+func (w *changeWatcher) watchRemote(ctx context.Context, f fs.Fs) {
+	pollInterval := make(chan time.Duration, 1)
+	pollInterval <- changeNotifyPollInterval
+	f.Features().ChangeNotify(ctx, func(p string, entryType fs.EntryType) {
+		if entryType == fs.EntryObject {
+			p = path.Dir(p)
+		}
+		w.notify(ctx, p)
+	}, pollInterval)
+	go func() {
+		<-ctx.Done()
+		close(pollInterval)
+	}()
+}
+
+// debounce collects changed directories until no change has been reported
+// for the debounce period, or for at most maxWait since the first of them,
+// and hands them over to the job as one batch.
+func (w *changeWatcher) debounce(ctx context.Context, debounce, maxWait time.Duration) {
+	pending := map[string]bool{}
+	var ready []string
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	deadline := time.NewTimer(maxWait)
+	deadline.Stop()
+	stop := func(t *time.Timer) {
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+	}
+	release := func() {
+		stop(timer)
+		stop(deadline)
+		for dir := range pending {
+			ready = append(ready, dir)
+		}
+		ready = changedRoots(ready)
+		pending = map[string]bool{}
+	}
+	for {
+		var batches chan []string
+		if len(ready) > 0 {
+			batches = w.batches
+		}
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			deadline.Stop()
+			return
+		case dir := <-w.events:
+			if len(pending) == 0 {
+				deadline.Reset(maxWait)
+			}
+			pending[dir] = true
+			stop(timer)
+			timer.Reset(debounce)
+		case <-timer.C:
+			release()
+		case <-deadline.C:
+			release()
+		case batches <- ready:
+			ready = nil
+		}
+	}
+}
+
+// changedRoots returns the directories of dirs that are not below another
+// directory of dirs, sorted.
+func changedRoots(dirs []string) []string {
+	sorted := append([]string(nil), dirs...)
+	sort.Strings(sorted)
+	var roots []string
+next:
+	for _, dir := range sorted {
+		if dir == "" {
+			return []string{""}
+		}
+		for _, root := range roots {
+			if dir == root || strings.HasPrefix(dir, root+"/") {
+				continue next
+			}
+		}
+		roots = append(roots, dir)
+	}
+	return roots
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiraidcontroller
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangedRoots(t *testing.T) {
+	tests := []struct {
+		name     string
+		dirs     []string
+		expected []string
+	}{
+		{
+			name:     "single directory",
+			dirs:     []string{"a"},
+			expected: []string{"a"},
+		},
+		{
+			name:     "nested directories",
+			dirs:     []string{"a/b/c", "a", "a/b"},
+			expected: []string{"a"},
+		},
+		{
+			name:     "siblings with common prefix",
+			dirs:     []string{"a-b", "a/c", "a", "ab"},
+			expected: []string{"a", "a-b", "ab"},
+		},
+		{
+			name:     "duplicates",
+			dirs:     []string{"x/y", "x/y"},
+			expected: []string{"x/y"},
+		},
+		{
+			name:     "root",
+			dirs:     []string{"a", "", "b/c"},
+			expected: []string{""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			roots := changedRoots(test.dirs)
+			if !reflect.DeepEqual(test.expected, roots) {
+				t.Errorf("expected roots %v but got %v", test.expected, roots)
+			}
+		})
+	}
+}
+
+func TestDebounceMaxWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &changeWatcher{
+		events:  make(chan string, 64),
+		batches: make(chan []string),
+	}
+	go w.debounce(ctx, 100*time.Millisecond, 500*time.Millisecond)
+
+	// A volume written more often than the debounce period is handed over
+	// after the maximum wait.
+	start := time.Now()
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case batch := <-w.batches:
+			if !reflect.DeepEqual(batch, []string{"a"}) {
+				t.Errorf("expected batch [a], got %v", batch)
+			}
+			if waited := time.Since(start); waited < 500*time.Millisecond {
+				t.Errorf("batch handed over after %v, before the maximum wait", waited)
+			}
+			return
+		case <-ticker.C:
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("no batch while the volume is written continuously")
+			}
+			w.events <- "a"
+		}
+	}
+}
+
+func TestSyncModeNotify(t *testing.T) {
+	sourceDir, targetDir := testRemotes(t)
+	volumeDir := filepath.Join(sourceDir, "vol-1")
+	if err := os.MkdirAll(volumeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(volumeDir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewSyncManager("test", nil)
+	defer m.Shutdown(time.Second)
+	spec := SyncJobSpec{
+		VolumeName:           "pv-1",
+		Source:               "source",
+		Target:               "target",
+		Directory:            "/export/vol-1",
+		Mode:                 SyncModeNotify,
+		NotifyDebounce:       100 * time.Millisecond,
+		NotifyResyncInterval: time.Hour,
+	}
+	if err := m.Start(spec); err != nil {
+		t.Fatalf("unexpected error starting job: %v", err)
+	}
+	// The initial full pass.
+	waitForFile(t, filepath.Join(targetDir, "vol-1", "a"), 10*time.Second)
+
+	// Replicated on notification only, the full pass is an hour away.
+	if err := os.MkdirAll(filepath.Join(volumeDir, "sub", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(volumeDir, "sub", "dir", "b"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForFile(t, filepath.Join(targetDir, "vol-1", "sub", "dir", "b"), 10*time.Second)
+}
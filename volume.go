@@ -49,6 +49,26 @@ type Provisioner interface {
 	GetActive() bool
 }
 
+// MultiTargetProvisioner is an optional interface implemented by provisioners
+// that replicate volumes to more than one target remote. GetTarget is ignored
+// for provisioners implementing it.
+type MultiTargetProvisioner interface {
+	Provisioner
+	// GetTargets returns the rclone remotes holding a replica of each volume.
+	GetTargets() []string
+}
+
+// Exporter is an optional interface implemented by provisioners whose remotes
+// are exported by NFS servers, to which volumes can be promoted. Without it
+// the host of the rclone remote is taken as the NFS server.
+type Exporter interface {
+	Provisioner
+	// GetExport returns the NFS server and path exporting the directory of
+	// a volume on the given remote, the last element of the path of the
+	// volume.
+	GetExport(remote, directory string) (server, path string, err error)
+}
+
 // Qualifier is an optional interface implemented by provisioners to determine
 // whether a claim should be provisioned as early as possible (e.g. prior to
 // leader election).